@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"log/slog"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
@@ -12,49 +14,106 @@ import (
 )
 
 type Config struct {
-	pkg.ControllerCfg
-	LogLevel string
+	pkg.ControllerCfg `yaml:",inline"`
+	LogLevel          string   `yaml:"logLevel"`
+	LogFormat         string   `yaml:"logFormat"`
+	RedactKeys        []string `yaml:"redactKeys"`
+	MetricsAddress    string   `yaml:"metricsAddress"`
+	OtlpEndpoint      string   `yaml:"otlpEndpoint"`
+}
+
+// envFlags are the flags that can also be set by an environment variable
+var envFlags = map[string]string{
+	"create-cmd":          "CREATE_CMD",
+	"delete-cmd":          "DELETE_CMD",
+	"expand-cmd":          "EXPAND_CMD",
+	"create-snapshot-cmd": "CREATE_SNAPSHOT_CMD",
+	"delete-snapshot-cmd": "DELETE_SNAPSHOT_CMD",
+	"ssh-server":          "SSH_SERVER",
+	"ssh-user":            "SSH_USER",
+	"ssh-key":             "SSH_KEY",
+	"probe-cmd":           "PROBE_CMD",
+	"list-snapshots-cmd":  "LIST_SNAPSHOTS_CMD",
+	"hooks-dir":           "HOOKS_DIR",
+	"dispatcher-cmd":      "DISPATCHER_CMD",
+	"backend":             "BACKEND",
 }
 
 func validateConfig(config *Config) error {
-	if config.Endpoint == "" {
-		return fmt.Errorf("endpoint is required")
-	}
-	if config.CreateCmd == "" {
-		return fmt.Errorf("create-script is required")
-	}
-	if config.DeleteCmd == "" {
-		return fmt.Errorf("delete-script is required")
-	}
-	return nil
+	return config.ControllerCfg.Validate()
 }
 
 func main() {
 	var config Config
+	var configFile string
 
 	var rootCmd = &cobra.Command{
 		Use:     "csi plugin for external nfs with shell",
 		Short:   "nfs csi plugin that can run shell scripts hook",
 		Version: pkg.DriverVersion,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if configFile == "" {
+				return nil
+			}
+			return pkg.LoadConfigFile(configFile, &config, cmd.Flags(), envFlags)
+		},
 	}
+	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "", "",
+		"YAML or JSON config file, flags override environment variables which override the file")
 	rootCmd.PersistentFlags().StringVarP(&config.LogLevel, "log-level", "l", "info",
 		"Log level (debug, info, warn, error)")
+	rootCmd.PersistentFlags().StringVarP(&config.LogFormat, "log-format", "", "text",
+		"Log format (text, json)")
+	rootCmd.PersistentFlags().StringSliceVarP(&config.RedactKeys, "redact-keys", "", pkg.DefaultSensitiveKeys,
+		"env and parameter keys containing any of these words are masked in logs and errors")
 	rootCmd.PersistentFlags().StringVarP(&config.CreateCmd, "create-cmd", "c", os.Getenv("CREATE_CMD"),
-		"script to create volume")
+		"script to create volume, or @file to read it from a file")
 	rootCmd.PersistentFlags().StringVarP(&config.DeleteCmd, "delete-cmd", "d", os.Getenv("DELETE_CMD"),
-		"script to delete volume")
+		"script to delete volume, or @file")
 	rootCmd.PersistentFlags().StringVarP(&config.ExpandCmd, "expand-cmd", "", os.Getenv("EXPAND_CMD"),
-		"script to expand volume")
+		"script to expand volume, or @file")
 	rootCmd.PersistentFlags().StringVarP(&config.CreateSnapshotCmd, "create-snapshot-cmd", "", os.Getenv("CREATE_SNAPSHOT_CMD"),
-		"script to create snapshot")
+		"script to create snapshot, or @file")
 	rootCmd.PersistentFlags().StringVarP(&config.DeleteSnapshotCmd, "delete-snapshot-cmd", "", os.Getenv("DELETE_SNAPSHOT_CMD"),
-		"script to delete snapshot")
+		"script to delete snapshot, or @file")
+	rootCmd.PersistentFlags().StringVarP(&config.ListSnapshotsCmd, "list-snapshots-cmd", "", os.Getenv("LIST_SNAPSHOTS_CMD"),
+		"script to list snapshots, or @file")
+	rootCmd.PersistentFlags().StringVarP(&config.HooksDir, "hooks-dir", "", os.Getenv("HOOKS_DIR"),
+		"directory of <operation>.sh hooks (create_volume.sh, delete_volume.sh...) used when the matching --*-cmd is empty, reloaded when they change")
+	rootCmd.PersistentFlags().StringVarP(&config.DispatcherCmd, "dispatcher-cmd", "", os.Getenv("DISPATCHER_CMD"),
+		"script run for every operation without its own hook, with CSI_OPERATION set to the operation; CSI_OPERATION=csi_capabilities must print csi-shell-output:operations=<op>,<op>...")
+	rootCmd.PersistentFlags().StringVarP(&config.Backend, "backend", "", os.Getenv("BACKEND"),
+		"built-in backend running the operations whose --*-cmd is empty ("+strings.Join(pkg.BackendNames(), ", ")+")")
+	rootCmd.PersistentFlags().StringToStringVarP(&config.BackendConfig, "backend-config", "", nil,
+		"backend setting, key=value (e.g., parentDataset=tank/csi,nfsServer=10.0.0.1 for zfs)")
+	rootCmd.PersistentFlags().VarP(&config.Capacity.AllocationUnit, "allocation-unit", "",
+		"capacities are rounded up to a multiple of this size (e.g., 1Mi) before they reach the hooks, the backend chooses when unset")
+	rootCmd.PersistentFlags().VarP(&config.Capacity.MinSize, "min-volume-size", "",
+		"smallest volume created, smaller requests are raised to it; the minSize StorageClass parameter can raise it")
+	rootCmd.PersistentFlags().VarP(&config.Capacity.MaxSize, "max-volume-size", "",
+		"largest volume created or expanded, larger requests fail with OutOfRange; the maxSize StorageClass parameter can lower it")
+	rootCmd.PersistentFlags().BoolVarP(&config.Exports.Managed, "managed-exports", "", false,
+		"export every volume on its own with a file in --exports-dir instead of relying on an exported parent directory")
+	rootCmd.PersistentFlags().StringVarP(&config.Exports.Dir, "exports-dir", "", "/etc/exports.d",
+		"directory on the storage server of the csi-<volume>.exports files of managed exports")
+	rootCmd.PersistentFlags().StringSliceVarP(&config.Exports.Clients, "export-clients", "", []string{"*"},
+		"hosts or networks managed exports are exported to, overridden by the exportClients StorageClass parameter")
+	rootCmd.PersistentFlags().StringVarP(&config.Exports.Options, "export-options", "", "rw,sync,root_squash",
+		"options of managed exports, overridden by the exportOptions StorageClass parameter; fsid= is derived from the volume ID when not set")
+	rootCmd.PersistentFlags().VarP(pkg.NewHookSecretsValue(&config.HookSecrets), "hook-secret", "",
+		"request secrets a hook gets as CSI_SECRET_<key>, operation=key1,key2 (e.g., create_volume=passphrase), repeatable")
 	rootCmd.PersistentFlags().StringVarP(&config.SSHConfig.SshServer, "ssh-server", "", os.Getenv("SSH_SERVER"),
 		"SSH server address")
 	rootCmd.PersistentFlags().StringVarP(&config.SSHConfig.SshUser, "ssh-user", "", os.Getenv("SSH_USER"),
 		"SSH user")
 	rootCmd.PersistentFlags().StringVarP(&config.SSHConfig.SshKey, "ssh-key", "", os.Getenv("SSH_KEY"),
 		"SSH private key")
+	rootCmd.PersistentFlags().StringVarP(&config.ProbeCmd, "probe-cmd", "", os.Getenv("PROBE_CMD"),
+		"script run on the server by the liveness probe, use 'true' to only check the SSH handshake, empty to disable")
+	rootCmd.PersistentFlags().DurationVarP(&config.ProbeTimeout, "probe-timeout", "", 2*time.Second,
+		"timeout of the probe script")
+	rootCmd.PersistentFlags().DurationVarP(&config.ProbeCacheTTL, "probe-cache-ttl", "", 30*time.Second,
+		"how long a probe result is reused")
 
 	var runCommand = &cobra.Command{
 		Use:   "run",
@@ -63,19 +122,38 @@ func main() {
 			return validateConfig(&config)
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := pkg.SetupLogging(os.Stderr, config.LogLevel, config.LogFormat, config.RedactKeys); err != nil {
+				return err
+			}
 			driverCfg := config.ControllerCfg
 			driver := pkg.NewController(driverCfg)
-			var level slog.Level
-			err := level.UnmarshalText([]byte(config.LogLevel))
-			if err != nil {
-				return fmt.Errorf("invalid log level: %w", err)
+			if config.MetricsAddress != "" {
+				pkg.ServeMetrics(config.MetricsAddress)
+			}
+			if config.OtlpEndpoint != "" {
+				shutdown, err := pkg.SetupTracing(cmd.Context(), config.OtlpEndpoint, "csi-controller")
+				if err != nil {
+					return err
+				}
+				defer shutdown(context.Background())
 			}
-			slog.SetLogLoggerLevel(level)
 			return driver.Run()
 		},
 	}
 	runCommand.Flags().StringVarP(&config.Endpoint, "endpoint", "e", "unix:///tmp/csi.sock",
 		"CSI endpoint (e.g., unix:///tmp/csi.sock or tcp://0.0.0.0:9000)")
+	runCommand.Flags().StringVarP(&config.TLS.CertFile, "tls-cert", "", "",
+		"TLS certificate of a tcp endpoint, reloaded when it changes")
+	runCommand.Flags().StringVarP(&config.TLS.KeyFile, "tls-key", "", "",
+		"TLS private key of a tcp endpoint, reloaded when it changes")
+	runCommand.Flags().StringVarP(&config.TLS.ClientCAFile, "tls-client-ca", "", "",
+		"CA bundle to verify client certificates against, empty to not require client certificates")
+	runCommand.Flags().DurationVarP(&config.DrainTimeout, "drain-timeout", "", time.Minute,
+		"how long running hooks may finish after SIGTERM before they are canceled")
+	runCommand.Flags().StringVarP(&config.MetricsAddress, "metrics-address", "", "",
+		"address to expose prometheus metrics on (e.g., :9808), empty to disable")
+	runCommand.Flags().StringVarP(&config.OtlpEndpoint, "otlp-endpoint", "", "",
+		"OTLP gRPC collector to send traces to (e.g., otel-collector:4317), empty to disable tracing")
 	rootCmd.AddCommand(runCommand)
 
 	var versionCmd = &cobra.Command{
@@ -89,9 +167,12 @@ func main() {
 	}
 	rootCmd.AddCommand(versionCmd)
 
+	var dryRun, local, skipHooks, runBackends bool
 	var validateCmd = &cobra.Command{
 		Use:   "validate",
 		Short: "Validate configuration and scripts",
+		Long: "Validate the configuration, then run every configured hook with a synthetic volume and snapshot " +
+			"and check that it prints the keys its operation requires",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			fmt.Println("Validating configuration...")
 
@@ -99,12 +180,60 @@ func main() {
 				return fmt.Errorf("configuration validation failed: %w", err)
 			}
 			fmt.Println("✓ Configuration is valid")
+			if skipHooks {
+				fmt.Println("All validations passed!")
+				return nil
+			}
 
+			if err := pkg.SetupLogging(os.Stderr, config.LogLevel, config.LogFormat, config.RedactKeys); err != nil {
+				return err
+			}
+			driver := pkg.NewOfflineController(config.ControllerCfg, local)
+			target := config.SSHConfig.SshServer
+			if local {
+				target = "local shell"
+			}
+			fmt.Printf("Running hooks on %s (dry run: %v)...\n", target, dryRun)
+			failed := false
+			for _, check := range driver.ValidateHooks(cmd.Context(), dryRun, runBackends) {
+				switch {
+				case check.Skipped:
+					fmt.Printf("- %s: not configured\n", check.Operation)
+					continue
+				case check.NotRun != "":
+					fmt.Printf("- %s (%s): not run, %s; --run-backends runs it\n", check.Operation, check.Hook, check.NotRun)
+					continue
+				case check.Failed():
+					failed = true
+					fmt.Printf("✗ %s (%s, %s) %v\n", check.Operation, check.Hook, check.Hash, check.Duration.Round(time.Millisecond))
+				default:
+					fmt.Printf("✓ %s (%s, %s) %v\n", check.Operation, check.Hook, check.Hash, check.Duration.Round(time.Millisecond))
+				}
+				for _, e := range check.Errors {
+					fmt.Printf("    error: %s\n", e)
+				}
+				for _, w := range check.Warnings {
+					fmt.Printf("    warning: %s\n", w)
+				}
+			}
+			if failed {
+				return fmt.Errorf("hook validation failed")
+			}
 			fmt.Println("All validations passed!")
 			return nil
 		},
 	}
+	validateCmd.Flags().BoolVarP(&dryRun, "dry-run", "", false,
+		"set CSI_DRY_RUN=true so the hooks can skip changing the server")
+	validateCmd.Flags().BoolVarP(&runBackends, "run-backends", "", false,
+		"also run the operations of the built-in backend, which create and delete a real volume and snapshot on the server")
+	validateCmd.Flags().BoolVarP(&local, "local", "", false,
+		"run the hooks in a local shell instead of over SSH")
+	validateCmd.Flags().BoolVarP(&skipHooks, "skip-hooks", "", false,
+		"only validate the configuration, do not run the hooks")
 	rootCmd.AddCommand(validateCmd)
+	rootCmd.AddCommand(newVolumeCmd(&config))
+	rootCmd.AddCommand(newSnapshotCmd(&config))
 
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal(err)
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/jayl1e/csi-driver-ssh/pkg"
+)
+
+type operatorFlags struct {
+	output     string
+	csiAddress string
+	tls        pkg.ClientTLSConfig
+	local      bool
+}
+
+func (f *operatorFlags) register(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVarP(&f.output, "output", "o", "table",
+		"output format (table, json)")
+	cmd.PersistentFlags().StringVarP(&f.csiAddress, "csi-address", "", "",
+		"endpoint of a running driver to send the request to (e.g., unix:///csi/csi.sock), empty to run the hooks directly")
+	cmd.PersistentFlags().StringVarP(&f.tls.CAFile, "tls-ca", "", "",
+		"CA bundle verifying the TLS certificate of a --csi-address tcp endpoint, the system roots if empty")
+	cmd.PersistentFlags().StringVarP(&f.tls.CertFile, "tls-cert", "", "",
+		"client certificate for a --csi-address tcp endpoint verifying clients")
+	cmd.PersistentFlags().StringVarP(&f.tls.KeyFile, "tls-key", "", "",
+		"client private key for a --csi-address tcp endpoint verifying clients")
+	cmd.PersistentFlags().BoolVarP(&f.local, "local", "", false,
+		"run the hooks in a local shell instead of over SSH")
+}
+
+// run sends a request through an operator and prints the hook responses and the CSI response.
+func (f *operatorFlags) run(config *Config, call func(ctx context.Context, op *pkg.Operator) (proto.Message, error)) error {
+	if f.output != "table" && f.output != "json" {
+		return fmt.Errorf("invalid output format %q, must be table or json", f.output)
+	}
+	if f.tls.Enabled() && f.csiAddress == "" {
+		return fmt.Errorf("--tls-ca, --tls-cert and --tls-key require --csi-address")
+	}
+	if err := pkg.SetupLogging(os.Stderr, config.LogLevel, config.LogFormat, config.RedactKeys); err != nil {
+		return err
+	}
+	var op *pkg.Operator
+	var err error
+	if f.csiAddress != "" {
+		op, err = pkg.NewClientOperator(f.csiAddress, f.tls)
+	} else {
+		op, err = pkg.NewDirectOperator(config.ControllerCfg, f.local)
+	}
+	if err != nil {
+		return err
+	}
+	defer op.Close()
+
+	resp, err := call(context.Background(), op)
+	hooks := op.HookOutputs()
+	if err != nil {
+		printHookOutputs(hooks)
+		return err
+	}
+	if f.output == "json" {
+		return printJSON(hooks, resp)
+	}
+	printHookOutputs(hooks)
+	printResponse(resp)
+	return nil
+}
+
+func printJSON(hooks []pkg.HookOutput, resp proto.Message) error {
+	response, err := protojson.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(struct {
+		Hooks    []pkg.HookOutput `json:"hooks,omitempty"`
+		Response json.RawMessage  `json:"response"`
+	}{hooks, response})
+}
+
+func printHookOutputs(hooks []pkg.HookOutput) {
+	for _, hook := range hooks {
+		fmt.Printf("Hook %s output:\n", hook.Hook)
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "  KEY\tVALUE")
+		for _, key := range sortedKeys(hook.Output) {
+			fmt.Fprintf(w, "  %s\t%s\n", key, hook.Output[key])
+		}
+		w.Flush()
+		fmt.Println()
+	}
+}
+
+func printResponse(resp proto.Message) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	switch resp := resp.(type) {
+	case *csi.CreateVolumeResponse:
+		v := resp.GetVolume()
+		fmt.Fprintln(w, "VOLUME ID\tCAPACITY\tCONTEXT")
+		fmt.Fprintf(w, "%s\t%d\t%s\n", v.GetVolumeId(), v.GetCapacityBytes(), formatMap(v.GetVolumeContext()))
+	case *csi.ControllerExpandVolumeResponse:
+		fmt.Fprintln(w, "CAPACITY\tNODE EXPANSION REQUIRED")
+		fmt.Fprintf(w, "%d\t%v\n", resp.GetCapacityBytes(), resp.GetNodeExpansionRequired())
+	case *csi.CreateSnapshotResponse:
+		fmt.Fprintln(w, "SNAPSHOT ID\tSOURCE VOLUME\tSIZE\tREADY")
+		printSnapshot(w, resp.GetSnapshot())
+	case *csi.ListSnapshotsResponse:
+		fmt.Fprintln(w, "SNAPSHOT ID\tSOURCE VOLUME\tSIZE\tREADY")
+		for _, entry := range resp.GetEntries() {
+			printSnapshot(w, entry.GetSnapshot())
+		}
+		if resp.GetNextToken() != "" {
+			defer fmt.Printf("more snapshots, next token: %s\n", resp.GetNextToken())
+		}
+	default:
+		fmt.Fprintln(w, "OK")
+	}
+}
+
+func printSnapshot(w *tabwriter.Writer, s *csi.Snapshot) {
+	fmt.Fprintf(w, "%s\t%s\t%d\t%v\n", s.GetSnapshotId(), s.GetSourceVolumeId(), s.GetSizeBytes(), s.GetReadyToUse())
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatMap(m map[string]string) string {
+	pairs := make([]string, 0, len(m))
+	for _, k := range sortedKeys(m) {
+		pairs = append(pairs, k+"="+m[k])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func newVolumeCmd(config *Config) *cobra.Command {
+	var flags operatorFlags
+	var volumeCmd = &cobra.Command{
+		Use:   "volume",
+		Short: "Create, delete or expand a volume without Kubernetes",
+	}
+	flags.register(volumeCmd)
+
+	var capacity int64
+	var parameters map[string]string
+	var block bool
+	var fromVolume, fromSnapshot string
+	var createCmd = &cobra.Command{
+		Use:   "create NAME",
+		Short: "Create a volume",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return flags.run(config, func(ctx context.Context, op *pkg.Operator) (proto.Message, error) {
+				req := &csi.CreateVolumeRequest{
+					Name:          args[0],
+					CapacityRange: &csi.CapacityRange{RequiredBytes: capacity},
+					Parameters:    parameters,
+					VolumeCapabilities: []*csi.VolumeCapability{{
+						AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					}},
+				}
+				if block {
+					req.VolumeCapabilities[0].AccessType = &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}
+				}
+				switch {
+				case fromVolume != "":
+					req.VolumeContentSource = &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Volume{
+						Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: fromVolume},
+					}}
+				case fromSnapshot != "":
+					req.VolumeContentSource = &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Snapshot{
+						Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: fromSnapshot},
+					}}
+				}
+				return op.CreateVolume(ctx, req)
+			})
+		},
+	}
+	createCmd.Flags().Int64VarP(&capacity, "capacity-bytes", "", 1<<30, "requested capacity in bytes")
+	createCmd.Flags().StringToStringVarP(&parameters, "parameter", "p", nil, "StorageClass parameter, key=value")
+	createCmd.Flags().BoolVarP(&block, "block", "", false, "create a raw block volume")
+	createCmd.Flags().StringVarP(&fromVolume, "from-volume", "", "", "volume ID to clone")
+	createCmd.Flags().StringVarP(&fromSnapshot, "from-snapshot", "", "", "snapshot ID to restore")
+	volumeCmd.AddCommand(createCmd)
+
+	volumeCmd.AddCommand(&cobra.Command{
+		Use:   "delete VOLUME_ID",
+		Short: "Delete a volume",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return flags.run(config, func(ctx context.Context, op *pkg.Operator) (proto.Message, error) {
+				return op.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: args[0]})
+			})
+		},
+	})
+
+	var expandCapacity int64
+	var expandCmd = &cobra.Command{
+		Use:   "expand VOLUME_ID",
+		Short: "Expand a volume",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return flags.run(config, func(ctx context.Context, op *pkg.Operator) (proto.Message, error) {
+				return op.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+					VolumeId:      args[0],
+					CapacityRange: &csi.CapacityRange{RequiredBytes: expandCapacity},
+				})
+			})
+		},
+	}
+	expandCmd.Flags().Int64VarP(&expandCapacity, "capacity-bytes", "", 0, "new capacity in bytes")
+	expandCmd.MarkFlagRequired("capacity-bytes")
+	volumeCmd.AddCommand(expandCmd)
+	return volumeCmd
+}
+
+func newSnapshotCmd(config *Config) *cobra.Command {
+	var flags operatorFlags
+	var snapshotCmd = &cobra.Command{
+		Use:   "snapshot",
+		Short: "Create, delete or list snapshots without Kubernetes",
+	}
+	flags.register(snapshotCmd)
+
+	var sourceVolume string
+	var createCmd = &cobra.Command{
+		Use:   "create NAME",
+		Short: "Create a snapshot",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return flags.run(config, func(ctx context.Context, op *pkg.Operator) (proto.Message, error) {
+				return op.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: args[0], SourceVolumeId: sourceVolume})
+			})
+		},
+	}
+	createCmd.Flags().StringVarP(&sourceVolume, "source-volume", "", "", "volume ID to snapshot")
+	createCmd.MarkFlagRequired("source-volume")
+	snapshotCmd.AddCommand(createCmd)
+
+	snapshotCmd.AddCommand(&cobra.Command{
+		Use:   "delete SNAPSHOT_ID",
+		Short: "Delete a snapshot",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return flags.run(config, func(ctx context.Context, op *pkg.Operator) (proto.Message, error) {
+				return op.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: args[0]})
+			})
+		},
+	})
+
+	var listReq csi.ListSnapshotsRequest
+	var listCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List snapshots",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return flags.run(config, func(ctx context.Context, op *pkg.Operator) (proto.Message, error) {
+				return op.ListSnapshots(ctx, &listReq)
+			})
+		},
+	}
+	listCmd.Flags().StringVarP(&listReq.SourceVolumeId, "source-volume", "", "", "only list the snapshots of this volume ID")
+	listCmd.Flags().StringVarP(&listReq.SnapshotId, "snapshot-id", "", "", "only list this snapshot ID")
+	listCmd.Flags().Int32VarP(&listReq.MaxEntries, "max-entries", "", 0, "maximum number of snapshots, 0 for all")
+	listCmd.Flags().StringVarP(&listReq.StartingToken, "starting-token", "", "", "next token of a previous list")
+	snapshotCmd.AddCommand(listCmd)
+	return snapshotCmd
+}
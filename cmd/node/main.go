@@ -1,10 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"log/slog"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 
@@ -12,21 +13,42 @@ import (
 )
 
 type Config struct {
-	LogLevel string
-	NodeID   string
-	Endpoint string
+	pkg.NodeCfg    `yaml:",inline"`
+	LogLevel       string   `yaml:"logLevel"`
+	LogFormat      string   `yaml:"logFormat"`
+	RedactKeys     []string `yaml:"redactKeys"`
+	MetricsAddress string   `yaml:"metricsAddress"`
+	OtlpEndpoint   string   `yaml:"otlpEndpoint"`
+}
+
+// envFlags are the flags that can also be set by an environment variable
+var envFlags = map[string]string{
+	"node-id": "NODE_ID",
 }
 
 func main() {
 	var config Config
+	var configFile string
 
 	var rootCmd = &cobra.Command{
 		Use:     "csi plugin for external nfs with shell",
 		Short:   "nfs csi plugin that can run shell scripts hook",
 		Version: pkg.DriverVersion,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if configFile == "" {
+				return nil
+			}
+			return pkg.LoadConfigFile(configFile, &config, cmd.Flags(), envFlags)
+		},
 	}
+	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "", "",
+		"YAML or JSON config file, flags override environment variables which override the file")
 	rootCmd.PersistentFlags().StringVarP(&config.LogLevel, "log-level", "l", "info",
 		"Log level (debug, info, warn, error)")
+	rootCmd.PersistentFlags().StringVarP(&config.LogFormat, "log-format", "", "text",
+		"Log format (text, json)")
+	rootCmd.PersistentFlags().StringSliceVarP(&config.RedactKeys, "redact-keys", "", pkg.DefaultSensitiveKeys,
+		"env and parameter keys containing any of these words are masked in logs and errors")
 	rootCmd.PersistentFlags().StringVarP(&config.NodeID, "node-id", "n", os.Getenv("NODE_ID"),
 		"Node ID (required)")
 
@@ -34,21 +56,56 @@ func main() {
 		Use:   "run",
 		Short: "Run the NFS CSI driver",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			driver := pkg.NewNodeServer(pkg.NodeCfg{
-				Endpoint: config.Endpoint,
-				NodeID:   config.NodeID,
-			})
-			var level slog.Level
-			err := level.UnmarshalText([]byte(config.LogLevel))
-			if err != nil {
-				return fmt.Errorf("invalid log level: %w", err)
+			if err := pkg.SetupLogging(os.Stderr, config.LogLevel, config.LogFormat, config.RedactKeys); err != nil {
+				return err
+			}
+			if err := config.NodeCfg.Validate(); err != nil {
+				return err
+			}
+			driver := pkg.NewNodeServer(config.NodeCfg)
+			if config.MetricsAddress != "" {
+				pkg.ServeMetrics(config.MetricsAddress)
+			}
+			if config.OtlpEndpoint != "" {
+				shutdown, err := pkg.SetupTracing(cmd.Context(), config.OtlpEndpoint, "csi-node")
+				if err != nil {
+					return err
+				}
+				defer shutdown(context.Background())
 			}
-			slog.SetLogLoggerLevel(level)
 			return driver.Run()
 		},
 	}
 	runCommand.Flags().StringVarP(&config.Endpoint, "endpoint", "e", "unix:///tmp/csi.sock",
 		"CSI endpoint (e.g., unix:///tmp/csi.sock or tcp://0.0.0.0:9000)")
+	runCommand.Flags().StringVarP(&config.BlockStateDir, "block-state-dir", "", "/var/lib/csi-ssh/block",
+		"directory for the private NFS mounts that back raw block volumes, a host path mounted with Bidirectional propagation")
+	runCommand.Flags().DurationVarP(&config.MountTimeout, "mount-timeout", "", 90*time.Second,
+		"default timeout of a NFS mount, the mountTimeout StorageClass parameter overrides it")
+	runCommand.Flags().DurationVarP(&config.HealthCheckInterval, "health-check-interval", "", time.Minute,
+		"interval to probe published volumes for stale mounts, which are remounted and reported abnormal until the pod restarts, 0 to disable")
+	runCommand.Flags().DurationVarP(&config.HealthCheckTimeout, "health-check-timeout", "", 10*time.Second,
+		"timeout of a single volume probe")
+	runCommand.Flags().StringVarP(&config.KubeletDir, "kubelet-dir", "", "/var/lib/kubelet",
+		"kubelet root directory scanned for mounts of pods deleted from the API server, empty to disable")
+	runCommand.Flags().DurationVarP(&config.ReconcileInterval, "reconcile-interval", "", 10*time.Minute,
+		"interval to look for orphaned mounts after startup, 0 to only run at startup")
+	runCommand.Flags().BoolVarP(&config.ReconcileDryRun, "reconcile-dry-run", "", false,
+		"only report orphaned mounts, do not unmount them")
+	runCommand.Flags().StringSliceVarP(&config.ProbeBinaries, "probe-binaries", "", []string{"mount", "mount.nfs"},
+		"mount helpers the liveness probe requires to be installed, empty to disable")
+	runCommand.Flags().StringVarP(&config.TLS.CertFile, "tls-cert", "", "",
+		"TLS certificate of a tcp endpoint, reloaded when it changes")
+	runCommand.Flags().StringVarP(&config.TLS.KeyFile, "tls-key", "", "",
+		"TLS private key of a tcp endpoint, reloaded when it changes")
+	runCommand.Flags().StringVarP(&config.TLS.ClientCAFile, "tls-client-ca", "", "",
+		"CA bundle to verify client certificates against, empty to not require client certificates")
+	runCommand.Flags().DurationVarP(&config.DrainTimeout, "drain-timeout", "", 20*time.Second,
+		"how long running mounts may finish after SIGTERM before they are canceled")
+	runCommand.Flags().StringVarP(&config.MetricsAddress, "metrics-address", "", "",
+		"address to expose prometheus metrics on (e.g., :9809), empty to disable")
+	runCommand.Flags().StringVarP(&config.OtlpEndpoint, "otlp-endpoint", "", "",
+		"OTLP gRPC collector to send traces to (e.g., otel-collector:4317), empty to disable tracing")
 	rootCmd.AddCommand(runCommand)
 
 	var versionCmd = &cobra.Command{
@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// errHasDependents is wrapped by a backend refusing to delete a volume that
+// snapshots or clones depend on, DeleteVolume reports FailedPrecondition.
+var errHasDependents = errors.New("snapshots or clones depend on the volume")
+
+// Backend implements hook operations natively, running its commands on the
+// storage server through the Executer. It takes the CSI_* env of the hook and
+// returns what the hook would print.
+type Backend interface {
+	Name() string
+	// Supports reports whether the backend implements the operation
+	Supports(operation string) bool
+	Run(ctx context.Context, executer Executer, operation string, env map[string]string) ([]byte, error)
+}
+
+type backendFactory func(config map[string]string) (Backend, error)
+
+var backends = map[string]backendFactory{}
+
+func registerBackend(name string, factory backendFactory) {
+	backends[name] = factory
+}
+
+// NewBackend returns the built-in backend called name, configured with the
+// key=value settings of --backend-config.
+func NewBackend(name string, config map[string]string) (Backend, error) {
+	factory, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q, must be one of %s", name, strings.Join(BackendNames(), ", "))
+	}
+	return factory(config)
+}
+
+func BackendNames() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// formatHookOutput renders output as the lines a hook prints.
+func formatHookOutput(output map[string]string) []byte {
+	keys := make([]string, 0, len(output))
+	for k := range output {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s%s=%s\n", CSI_SHELL_OUTPUT_PREFIX, k, output[k])
+	}
+	return []byte(b.String())
+}
+
+// formatSnapshotList renders snapshots as the lines of a list_snapshots hook.
+func formatSnapshotList(snapshots []*csi.Snapshot) []byte {
+	var b strings.Builder
+	for _, s := range snapshots {
+		fmt.Fprintf(&b, "%s%s=%s=%s %s=%s %s=%d\n", CSI_SHELL_OUTPUT_PREFIX, CSI_REP_SNAPSHOT,
+			CSI_REP_SNAPSHOT_ID, s.SnapshotId, CSI_REP_SRC_VOLUME_ID, s.SourceVolumeId, CSI_REP_CAPACITY_BYTES, s.SizeBytes)
+	}
+	return []byte(b.String())
+}
+
+// shellQuote quotes s as a single POSIX shell word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shellCommand joins args into a command line, quoting every argument.
+func shellCommand(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// runCommand runs a command line built by shellCommand and returns its output
+// without the trailing newline.
+func runCommand(ctx context.Context, executer Executer, cmd string) (string, error) {
+	out, err := executer.ExecuteCommand(ctx, cmd, nil)
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %w, output: %s", cmd, err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+var backendNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:-]*$`)
+
+// checkBackendName rejects IDs that can not be used as a dataset, subvolume or
+// directory name.
+func checkBackendName(kind string, name string) error {
+	if !backendNamePattern.MatchString(name) || len(name) > 200 {
+		return fmt.Errorf("invalid %s %q", kind, name)
+	}
+	return nil
+}
+
+// requiredConfig returns the value of key in a backend config.
+func requiredConfig(backend string, config map[string]string, key string) (string, error) {
+	if config[key] == "" {
+		return "", fmt.Errorf("backend %s requires %s in --backend-config", backend, key)
+	}
+	return config[key], nil
+}
+
+// checkConfigKeys rejects the keys of a backend config the backend does not know.
+func checkConfigKeys(backend string, config map[string]string, known ...string) error {
+	for key := range config {
+		if !slices.Contains(known, key) {
+			return fmt.Errorf("unknown %s backend config %q, must be one of %s", backend, key, strings.Join(known, ", "))
+		}
+	}
+	return nil
+}
+
+// pathExists reports whether path exists on the storage server.
+func pathExists(ctx context.Context, executer Executer, path string) (bool, error) {
+	out, err := runCommand(ctx, executer, shellCommand("test", "-e", path)+" && echo yes || echo no")
+	if err != nil {
+		return false, err
+	}
+	return out == "yes", nil
+}
+
+// writeFileAtomic replaces path on the storage server with content, through a
+// temporary file renamed over it so readers never see a partial file.
+func writeFileAtomic(ctx context.Context, executer Executer, path string, content string) error {
+	tmp := path + ".tmp"
+	_, err := runCommand(ctx, executer, shellCommand("printf", "%s", content)+" > "+shellQuote(tmp)+" && "+shellCommand("mv", tmp, path))
+	return err
+}
@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+type scriptedRule struct {
+	contains string
+	out      string
+	err      error
+	once     bool
+}
+
+// scriptedExecuter records the commands it runs and answers them with the
+// first rule the command contains.
+type scriptedExecuter struct {
+	commands []string
+	rules    []scriptedRule
+}
+
+func (e *scriptedExecuter) on(contains string, out string, err error) *scriptedExecuter {
+	e.rules = append(e.rules, scriptedRule{contains: contains, out: out, err: err})
+	return e
+}
+
+// once adds a rule that only answers the first matching command.
+func (e *scriptedExecuter) once(contains string, out string, err error) *scriptedExecuter {
+	e.rules = append(e.rules, scriptedRule{contains: contains, out: out, err: err, once: true})
+	return e
+}
+
+func (e *scriptedExecuter) ExecuteCommand(ctx context.Context, cmd string, env map[string]string) ([]byte, error) {
+	e.commands = append(e.commands, cmd)
+	for i, r := range e.rules {
+		if strings.Contains(cmd, r.contains) {
+			if r.once {
+				e.rules = append(e.rules[:i:i], e.rules[i+1:]...)
+			}
+			return []byte(r.out), r.err
+		}
+	}
+	return nil, nil
+}
+
+// ran reports whether a command containing every part was run.
+func (e *scriptedExecuter) ran(parts ...string) bool {
+	for _, cmd := range e.commands {
+		matched := true
+		for _, p := range parts {
+			matched = matched && strings.Contains(cmd, p)
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+var errExit1 = errors.New("exit status 1")
+
+func TestShellCommandQuoting(t *testing.T) {
+	cmd := shellCommand("echo", "it's", "$HOME")
+	out, err := exec.Command("sh", "-c", cmd).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "it's $HOME\n" {
+		t.Errorf("arguments should reach the command unchanged, got %q", out)
+	}
+}
+
+func TestFormatHookOutput(t *testing.T) {
+	output := map[string]string{CSI_REP_VOLUME_ID: "pvc-1", CSI_REP_CAPACITY_BYTES: "10"}
+	parsed, err := parseShellResponse(formatHookOutput(output))
+	if err != nil || len(parsed) != 2 || parsed[CSI_REP_VOLUME_ID] != "pvc-1" {
+		t.Errorf("expected hook output to parse back, got %v, %v", parsed, err)
+	}
+	snapshots, err := parseSnapshotList(formatSnapshotList([]*csi.Snapshot{{SnapshotId: "pvc-1@snap", SourceVolumeId: "pvc-1", SizeBytes: 5}}))
+	if err != nil || len(snapshots) != 1 || snapshots[0].SnapshotId != CSI_SNAPSHOT_ID_PREFIX+"pvc-1@snap" || snapshots[0].SizeBytes != 5 {
+		t.Errorf("expected snapshot list to parse back, got %v, %v", snapshots, err)
+	}
+}
+
+func TestNewBackend(t *testing.T) {
+	if _, err := NewBackend("ceph", nil); err == nil {
+		t.Error("unknown backend should be rejected")
+	}
+	if _, err := NewBackend(ZFS_BACKEND, map[string]string{"parentDataset": "tank/csi"}); err == nil || !strings.Contains(err.Error(), "nfsServer") {
+		t.Errorf("missing config should be named, got %v", err)
+	}
+	if _, err := NewBackend(ZFS_BACKEND, map[string]string{"parentDataset": "tank/csi", "nfsServer": "nas", "pool": "x"}); err == nil {
+		t.Error("unknown config key should be rejected")
+	}
+}
+
+func TestControllerBackend(t *testing.T) {
+	executer := (&scriptedExecuter{}).
+		on("zfs' 'list' '-H' '-o' 'name", "cannot open 'tank/csi/pvc-1': dataset does not exist", errExit1).
+		on("'refquota,mountpoint'", "1024\t/tank/csi/pvc-1\n", nil)
+	driver := newTestDriver()
+	driver.config.CreateCmd = ""
+	driver.config.ExpandCmd = ""
+	driver.backend, _ = NewBackend(ZFS_BACKEND, map[string]string{"parentDataset": "tank/csi", "nfsServer": "nas"})
+	driver.executer = executer
+
+	resp, err := driver.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "pvc-1",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	if resp.Volume.CapacityBytes != 1024 || resp.Volume.VolumeContext[NFS_SHARE_PATH_KEY] != "/tank/csi/pvc-1" || resp.Volume.VolumeContext[NFS_SHARE_SERVER_KEY] != "nas" {
+		t.Errorf("unexpected volume %v", resp.Volume)
+	}
+	if !executer.ran("'zfs' 'create'", "'refquota=1024'", "'tank/csi/pvc-1'") {
+		t.Errorf("expected zfs create, ran %v", executer.commands)
+	}
+
+	// a configured hook takes precedence over the backend
+	if _, err := driver.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: CSI_VOLUME_ID_PREFIX + "pvc-1"}); err != nil {
+		t.Fatalf("DeleteVolume failed: %v", err)
+	}
+	if executer.ran("'zfs' 'destroy'") {
+		t.Error("delete should run the configured hook, not the backend")
+	}
+}
@@ -0,0 +1,152 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+const (
+	VOLUME_MODE_FILESYSTEM = "filesystem"
+	VOLUME_MODE_BLOCK      = "block"
+	BLOCK_IMAGE_KEY        = "block_image"
+)
+
+// LoopDevicer manages loop devices backed by image files.
+type LoopDevicer interface {
+	Attach(file string) (string, error)
+	Detach(device string) error
+	Resize(device string) error
+	// List returns the attached loop devices mapped to their backing files.
+	List() (map[string]string, error)
+}
+
+var _ LoopDevicer = &LosetupDevicer{}
+
+type LosetupDevicer struct {
+}
+
+func (l *LosetupDevicer) Attach(file string) (string, error) {
+	out, err := exec.Command("losetup", "--find", "--show", file).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("losetup attach %s failed: %w, output: %s", file, err, string(out))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (l *LosetupDevicer) Detach(device string) error {
+	out, err := exec.Command("losetup", "--detach", device).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("losetup detach %s failed: %w, output: %s", device, err, string(out))
+	}
+	return nil
+}
+
+func (l *LosetupDevicer) Resize(device string) error {
+	out, err := exec.Command("losetup", "--set-capacity", device).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("losetup resize %s failed: %w, output: %s", device, err, string(out))
+	}
+	return nil
+}
+
+func (l *LosetupDevicer) List() (map[string]string, error) {
+	out, err := exec.Command("losetup", "--list", "--noheadings", "--output", "NAME,BACK-FILE").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("losetup list failed: %w, output: %s", err, string(out))
+	}
+	return parseLosetupList(out), nil
+}
+
+func parseLosetupList(out []byte) map[string]string {
+	devices := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		name, backing, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if !ok {
+			continue
+		}
+		backing = strings.TrimSuffix(strings.TrimSpace(backing), " (deleted)")
+		devices[name] = backing
+	}
+	return devices
+}
+
+// loopDevicesUnder returns the loop devices whose backing file lives in dir.
+func loopDevicesUnder(loop LoopDevicer, dir string) ([]string, error) {
+	devices, err := loop.List()
+	if err != nil {
+		return nil, err
+	}
+	var found []string
+	prefix := filepath.Clean(dir) + string(os.PathSeparator)
+	for dev, backing := range devices {
+		if strings.HasPrefix(backing, prefix) {
+			found = append(found, dev)
+		}
+	}
+	return found, nil
+}
+
+// blockMountDir is the private directory where the NFS share holding the image
+// file of a block volume gets mounted, once for all its target paths.
+func blockMountDir(stateDir string, volumeID string) string {
+	return filepath.Join(stateDir, hashKey(volumeID))
+}
+
+func hashKey(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:8])
+}
+
+// blockTargetsDir holds a file per target path a block volume is published
+// at, its share and loop device are released with the last one.
+func blockTargetsDir(mountDir string) string {
+	return mountDir + ".targets"
+}
+
+func addBlockTarget(mountDir string, targetPath string) error {
+	dir := blockTargetsDir(mountDir)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, hashKey(targetPath)), []byte(targetPath), 0640)
+}
+
+// removeBlockTarget forgets a target path and returns the number of targets
+// left.
+func removeBlockTarget(mountDir string, targetPath string) (int, error) {
+	dir := blockTargetsDir(mountDir)
+	if err := os.Remove(filepath.Join(dir, hashKey(targetPath))); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	return len(entries), err
+}
+
+// isBlockTarget reports whether a volume path is the device file a block volume
+// is published at, filesystem volumes are published at directories.
+func isBlockTarget(volumePath string) (bool, error) {
+	info, err := os.Stat(volumePath)
+	if err != nil {
+		return false, err
+	}
+	return !info.IsDir(), nil
+}
+
+func volumeModeOf(caps []*csi.VolumeCapability) string {
+	for _, c := range caps {
+		if c.GetBlock() != nil {
+			return VOLUME_MODE_BLOCK
+		}
+	}
+	return VOLUME_MODE_FILESYSTEM
+}
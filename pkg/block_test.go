@@ -0,0 +1,63 @@
+package pkg
+
+import (
+	"fmt"
+	"testing"
+)
+
+type fakeLoopDevicer struct {
+	devices map[string]string
+	resized []string
+}
+
+func newFakeLoopDevicer() *fakeLoopDevicer {
+	return &fakeLoopDevicer{devices: make(map[string]string)}
+}
+
+func (f *fakeLoopDevicer) Attach(file string) (string, error) {
+	dev := fmt.Sprintf("/dev/loop%d", len(f.devices))
+	f.devices[dev] = file
+	return dev, nil
+}
+
+func (f *fakeLoopDevicer) Detach(device string) error {
+	delete(f.devices, device)
+	return nil
+}
+
+func (f *fakeLoopDevicer) Resize(device string) error {
+	f.resized = append(f.resized, device)
+	return nil
+}
+
+func (f *fakeLoopDevicer) List() (map[string]string, error) {
+	devices := make(map[string]string)
+	for k, v := range f.devices {
+		devices[k] = v
+	}
+	return devices, nil
+}
+
+func TestParseLosetupList(t *testing.T) {
+	out := []byte("/dev/loop0 /mnt/a/disk.img\n/dev/loop1 /mnt/b/my disk.img (deleted)\n\n")
+	devices := parseLosetupList(out)
+	if len(devices) != 2 {
+		t.Fatalf("Expected 2 devices, got %d: %v", len(devices), devices)
+	}
+	if devices["/dev/loop1"] != "/mnt/b/my disk.img" {
+		t.Errorf("unexpected backing file %q", devices["/dev/loop1"])
+	}
+}
+
+func TestLoopDevicesUnder(t *testing.T) {
+	loop := newFakeLoopDevicer()
+	loop.devices["/dev/loop0"] = "/state/abc/disk.img"
+	loop.devices["/dev/loop1"] = "/state/abcd/disk.img"
+	devices, err := loopDevicesUnder(loop, "/state/abc")
+	if err != nil {
+		t.Fatalf("loopDevicesUnder failed: %v", err)
+	}
+	if len(devices) != 1 || devices[0] != "/dev/loop0" {
+		t.Errorf("unexpected devices %v", devices)
+	}
+}
@@ -0,0 +1,425 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+const (
+	BTRFS_BACKEND = "btrfs"
+
+	// BTRFS_SNAPSHOT_SIZE_REFERENCED reports the data a snapshot refers to, the size of a restored volume
+	BTRFS_SNAPSHOT_SIZE_REFERENCED = "referenced"
+	// BTRFS_SNAPSHOT_SIZE_EXCLUSIVE reports the data only the snapshot holds, what deleting it frees
+	BTRFS_SNAPSHOT_SIZE_EXCLUSIVE = "exclusive"
+)
+
+func init() {
+	registerBackend(BTRFS_BACKEND, newBtrfsBackend)
+}
+
+// btrfsBackend creates a subvolume per volume in volumesDir, limited by its
+// qgroup, and read-only snapshots in snapshotsDir. Snapshot IDs are
+// <volume>@<snapshot name>. Quota must be enabled on the filesystem.
+type btrfsBackend struct {
+	volumesDir   string
+	snapshotsDir string
+	nfsServer    string
+	// exportRoot is removed from the path of a volume to get its nfs_path, for
+	// servers exporting volumesDir or a parent of it as the NFSv4 root
+	exportRoot   string
+	snapshotSize string
+}
+
+func newBtrfsBackend(config map[string]string) (Backend, error) {
+	if err := checkConfigKeys(BTRFS_BACKEND, config, "volumesDir", "snapshotsDir", "nfsServer", "exportRoot", "snapshotSize"); err != nil {
+		return nil, err
+	}
+	b := &btrfsBackend{snapshotSize: BTRFS_SNAPSHOT_SIZE_REFERENCED}
+	var err error
+	if b.volumesDir, err = requiredConfig(BTRFS_BACKEND, config, "volumesDir"); err != nil {
+		return nil, err
+	}
+	if b.snapshotsDir, err = requiredConfig(BTRFS_BACKEND, config, "snapshotsDir"); err != nil {
+		return nil, err
+	}
+	if b.nfsServer, err = requiredConfig(BTRFS_BACKEND, config, "nfsServer"); err != nil {
+		return nil, err
+	}
+	b.volumesDir = strings.TrimSuffix(b.volumesDir, "/")
+	b.snapshotsDir = strings.TrimSuffix(b.snapshotsDir, "/")
+	b.exportRoot = strings.TrimSuffix(config["exportRoot"], "/")
+	if b.exportRoot != "" && !strings.HasPrefix(b.volumesDir+"/", b.exportRoot+"/") {
+		return nil, fmt.Errorf("exportRoot %q must contain volumesDir %q", b.exportRoot, b.volumesDir)
+	}
+	if size := config["snapshotSize"]; size != "" {
+		if size != BTRFS_SNAPSHOT_SIZE_REFERENCED && size != BTRFS_SNAPSHOT_SIZE_EXCLUSIVE {
+			return nil, fmt.Errorf("invalid snapshotSize %q, must be %s or %s", size, BTRFS_SNAPSHOT_SIZE_REFERENCED, BTRFS_SNAPSHOT_SIZE_EXCLUSIVE)
+		}
+		b.snapshotSize = size
+	}
+	return b, nil
+}
+
+func (b *btrfsBackend) Name() string {
+	return BTRFS_BACKEND
+}
+
+func (b *btrfsBackend) Supports(operation string) bool {
+	switch operation {
+	case OP_CREATE_VOLUME, OP_DELETE_VOLUME, OP_EXPAND_VOLUME, OP_CREATE_SNAPSHOT, OP_DELETE_SNAPSHOT, OP_LIST_SNAPSHOTS:
+		return true
+	}
+	return false
+}
+
+func (b *btrfsBackend) Run(ctx context.Context, executer Executer, operation string, env map[string]string) ([]byte, error) {
+	switch operation {
+	case OP_CREATE_VOLUME:
+		return b.createVolume(ctx, executer, env)
+	case OP_DELETE_VOLUME:
+		return b.deleteVolume(ctx, executer, env)
+	case OP_EXPAND_VOLUME:
+		return b.expandVolume(ctx, executer, env)
+	case OP_CREATE_SNAPSHOT:
+		return b.createSnapshot(ctx, executer, env)
+	case OP_DELETE_SNAPSHOT:
+		return b.deleteSnapshot(ctx, executer, env)
+	case OP_LIST_SNAPSHOTS:
+		return b.listSnapshots(ctx, executer, env)
+	}
+	return nil, fmt.Errorf("btrfs backend does not support %s", operation)
+}
+
+func (b *btrfsBackend) volumePath(volumeID string) (string, error) {
+	if err := checkBackendName("volume ID", volumeID); err != nil {
+		return "", err
+	}
+	return b.volumesDir + "/" + volumeID, nil
+}
+
+// snapshotPath returns the path of a <volume>@<name> snapshot ID. An ID
+// without a volume is a snapshot of the former reference scripts, named after
+// the VolumeSnapshotContent, which can still be restored and deleted.
+func (b *btrfsBackend) snapshotPath(snapshotID string) (string, error) {
+	volumeID, name, ok := strings.Cut(snapshotID, "@")
+	if !ok {
+		if err := checkBackendName("snapshot ID", snapshotID); err != nil {
+			return "", err
+		}
+		return b.snapshotsDir + "/" + snapshotID, nil
+	}
+	if err := checkBackendName("volume ID", volumeID); err != nil {
+		return "", err
+	}
+	if err := checkBackendName("snapshot name", name); err != nil {
+		return "", err
+	}
+	return b.snapshotsDir + "/" + snapshotID, nil
+}
+
+func (b *btrfsBackend) nfsPath(path string) string {
+	if b.exportRoot == "" {
+		return path
+	}
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(path, b.exportRoot), "/")
+}
+
+// qgroup is a line of btrfs qgroup show --raw -r.
+type qgroup struct {
+	referenced int64
+	exclusive  int64
+	// limit is the max referenced size, 0 when unlimited
+	limit int64
+}
+
+// qgroups returns the level 0 qgroups of the filesystem of path by subvolume
+// ID. It commits the filesystem first, the numbers are only updated by a commit.
+func qgroups(ctx context.Context, executer Executer, path string) (map[string]qgroup, error) {
+	out, err := executer.ExecuteCommand(ctx, shellCommand("btrfs", "filesystem", "sync", path)+" && "+shellCommand("btrfs", "qgroup", "show", "--raw", "-r", path), nil)
+	if err != nil {
+		if strings.Contains(string(out), "quotas not enabled") {
+			return nil, fmt.Errorf("quota is not enabled on %s, run btrfs quota enable %s", path, path)
+		}
+		return nil, fmt.Errorf("btrfs qgroup show %s failed: %w, output: %s", path, err, strings.TrimSpace(string(out)))
+	}
+	return parseQgroups(string(out))
+}
+
+func parseQgroups(out string) (map[string]qgroup, error) {
+	groups := map[string]qgroup{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "0/") {
+			continue
+		}
+		referenced, err1 := strconv.ParseInt(fields[1], 10, 64)
+		exclusive, err2 := strconv.ParseInt(fields[2], 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("unexpected btrfs qgroup show line %q", line)
+		}
+		group := qgroup{referenced: referenced, exclusive: exclusive}
+		if fields[3] != "none" {
+			if group.limit, err1 = strconv.ParseInt(fields[3], 10, 64); err1 != nil {
+				return nil, fmt.Errorf("unexpected btrfs qgroup show line %q", line)
+			}
+		}
+		groups[strings.TrimPrefix(fields[0], "0/")] = group
+	}
+	return groups, nil
+}
+
+// subvolumeQgroup returns the qgroup of the subvolume at path.
+func subvolumeQgroup(ctx context.Context, executer Executer, path string) (qgroup, error) {
+	id, err := runCommand(ctx, executer, shellCommand("btrfs", "inspect-internal", "rootid", path))
+	if err != nil {
+		return qgroup{}, err
+	}
+	groups, err := qgroups(ctx, executer, path)
+	if err != nil {
+		return qgroup{}, err
+	}
+	group, ok := groups[id]
+	if !ok {
+		return qgroup{}, fmt.Errorf("no qgroup 0/%s for %s, was quota enabled after it was created? run btrfs quota rescan", id, path)
+	}
+	return group, nil
+}
+
+func (b *btrfsBackend) snapshotBytes(group qgroup) int64 {
+	if b.snapshotSize == BTRFS_SNAPSHOT_SIZE_EXCLUSIVE {
+		return group.exclusive
+	}
+	return group.referenced
+}
+
+// deleteMarker is the file keeping the ID of a subvolume that is being
+// deleted, hidden from the *@* snapshot list.
+func deleteMarker(path string) string {
+	i := strings.LastIndex(path, "/") + 1
+	return path[:i] + "." + path[i:] + ".deleting"
+}
+
+// deleteSubvolume deletes the subvolume at path and its qgroup, which older
+// kernels leave behind. The subvolume ID is kept in a marker until the qgroup
+// is destroyed, so that a retry after the sync was cut off still finds it.
+func deleteSubvolume(ctx context.Context, executer Executer, path string) error {
+	marker := deleteMarker(path)
+	exists, err := pathExists(ctx, executer, path)
+	if err != nil {
+		return err
+	}
+	var id string
+	if exists {
+		if id, err = runCommand(ctx, executer, shellCommand("btrfs", "inspect-internal", "rootid", path)); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(ctx, executer, marker, id); err != nil {
+			return err
+		}
+		if _, err := runCommand(ctx, executer, shellCommand("btrfs", "subvolume", "delete", "--commit-after", path)); err != nil {
+			return err
+		}
+	} else {
+		if id, err = runCommand(ctx, executer, shellCommand("cat", marker)+" 2>/dev/null || true"); err != nil {
+			return err
+		}
+		if id = strings.TrimSpace(id); id == "" {
+			return nil
+		}
+	}
+	// the qgroup can only be destroyed once the cleaner dropped the subvolume
+	parent := path[:strings.LastIndex(path, "/")+1]
+	if _, err := runCommand(ctx, executer, shellCommand("btrfs", "subvolume", "sync", parent, id)); err != nil {
+		return err
+	}
+	out, err := executer.ExecuteCommand(ctx, shellCommand("btrfs", "qgroup", "destroy", "0/"+id, parent), nil)
+	if err != nil && !strings.Contains(string(out), "No such file or directory") && !strings.Contains(string(out), "quotas not enabled") {
+		return fmt.Errorf("btrfs qgroup destroy 0/%s failed: %w, output: %s", id, err, strings.TrimSpace(string(out)))
+	}
+	_, err = runCommand(ctx, executer, shellCommand("rm", "-f", marker))
+	return err
+}
+
+func (b *btrfsBackend) createVolume(ctx context.Context, executer Executer, env map[string]string) ([]byte, error) {
+	if env[CSI_REQ_VOLUME_MODE] == VOLUME_MODE_BLOCK {
+		return nil, fmt.Errorf("btrfs backend does not support block volumes")
+	}
+	volumeID := env[CSI_REQ_VOLUME_ID]
+	target, err := b.volumePath(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	capacity, err := strconv.ParseInt(env[CSI_REQ_CAPACITY_BYTES], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid capacity %q: %w", env[CSI_REQ_CAPACITY_BYTES], err)
+	}
+	// fail before creating a subvolume that can not be limited
+	if _, err := qgroups(ctx, executer, b.volumesDir); err != nil {
+		return nil, err
+	}
+
+	exists, err := pathExists(ctx, executer, target)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		var cmd string
+		switch env[CSI_REQ_DATA_SOURCE] {
+		case "snapshot":
+			source, err := b.snapshotPath(env[CSI_REQ_SRC_SNAPSHOT_ID])
+			if err != nil {
+				return nil, err
+			}
+			cmd = shellCommand("btrfs", "subvolume", "snapshot", source, target)
+		case "volume":
+			source, err := b.volumePath(env[CSI_REQ_SRC_VOLUME_ID])
+			if err != nil {
+				return nil, err
+			}
+			cmd = shellCommand("btrfs", "subvolume", "snapshot", source, target)
+		default:
+			cmd = shellCommand("btrfs", "subvolume", "create", target)
+		}
+		if _, err := runCommand(ctx, executer, cmd); err != nil {
+			return nil, err
+		}
+	}
+	if capacity > 0 {
+		if _, err := runCommand(ctx, executer, shellCommand("btrfs", "qgroup", "limit", strconv.FormatInt(capacity, 10), target)); err != nil {
+			return nil, err
+		}
+	}
+
+	group, err := subvolumeQgroup(ctx, executer, target)
+	if err != nil {
+		return nil, err
+	}
+	output := map[string]string{
+		CSI_REP_VOLUME_ID:      volumeID,
+		CSI_REP_CAPACITY_BYTES: strconv.FormatInt(group.limit, 10),
+		NFS_SHARE_SERVER_KEY:   b.nfsServer,
+		NFS_SHARE_PATH_KEY:     b.nfsPath(target),
+		EXPORT_PATH_KEY:        target,
+	}
+	if env[CSI_REQ_DATA_SOURCE] != "" {
+		output[CSI_REP_DATA_SOURCE] = env[CSI_REQ_DATA_SOURCE]
+	}
+	return formatHookOutput(output), nil
+}
+
+func (b *btrfsBackend) deleteVolume(ctx context.Context, executer Executer, env map[string]string) ([]byte, error) {
+	target, err := b.volumePath(env[CSI_REQ_VOLUME_ID])
+	if err != nil {
+		return nil, err
+	}
+	if err := deleteSubvolume(ctx, executer, target); err != nil {
+		return nil, err
+	}
+	return formatHookOutput(map[string]string{CSI_REP_VOLUME_ID: env[CSI_REQ_VOLUME_ID]}), nil
+}
+
+func (b *btrfsBackend) expandVolume(ctx context.Context, executer Executer, env map[string]string) ([]byte, error) {
+	if env[CSI_REQ_VOLUME_MODE] == VOLUME_MODE_BLOCK {
+		return nil, fmt.Errorf("btrfs backend does not support block volumes")
+	}
+	target, err := b.volumePath(env[CSI_REQ_VOLUME_ID])
+	if err != nil {
+		return nil, err
+	}
+	capacity, err := strconv.ParseInt(env[CSI_REQ_CAPACITY_BYTES], 10, 64)
+	if err != nil || capacity <= 0 {
+		return nil, fmt.Errorf("invalid capacity %q", env[CSI_REQ_CAPACITY_BYTES])
+	}
+	if _, err := runCommand(ctx, executer, shellCommand("btrfs", "qgroup", "limit", strconv.FormatInt(capacity, 10), target)); err != nil {
+		return nil, err
+	}
+	group, err := subvolumeQgroup(ctx, executer, target)
+	if err != nil {
+		return nil, err
+	}
+	return formatHookOutput(map[string]string{CSI_REP_CAPACITY_BYTES: strconv.FormatInt(group.limit, 10)}), nil
+}
+
+func (b *btrfsBackend) createSnapshot(ctx context.Context, executer Executer, env map[string]string) ([]byte, error) {
+	snapshotID := env[CSI_REQ_SRC_VOLUME_ID] + "@" + env[CSI_REQ_SNAPSHOT_NAME]
+	target, err := b.snapshotPath(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	exists, err := pathExists(ctx, executer, target)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		source, _ := b.volumePath(env[CSI_REQ_SRC_VOLUME_ID])
+		if _, err := runCommand(ctx, executer, shellCommand("btrfs", "subvolume", "snapshot", "-r", source, target)); err != nil {
+			return nil, err
+		}
+	} else {
+		// a snapshot left writable, e.g. by hand, could have changed since
+		ro, err := runCommand(ctx, executer, shellCommand("btrfs", "property", "get", "-ts", target, "ro"))
+		if err != nil {
+			return nil, err
+		}
+		if ro != "ro=true" {
+			return nil, fmt.Errorf("snapshot %s exists but is not read-only", target)
+		}
+	}
+	group, err := subvolumeQgroup(ctx, executer, target)
+	if err != nil {
+		return nil, err
+	}
+	return formatHookOutput(map[string]string{
+		CSI_REP_SNAPSHOT_ID:    snapshotID,
+		CSI_REP_CAPACITY_BYTES: strconv.FormatInt(b.snapshotBytes(group), 10),
+	}), nil
+}
+
+func (b *btrfsBackend) deleteSnapshot(ctx context.Context, executer Executer, env map[string]string) ([]byte, error) {
+	target, err := b.snapshotPath(env[CSI_REQ_SNAPSHOT_ID])
+	if err != nil {
+		return nil, err
+	}
+	if err := deleteSubvolume(ctx, executer, target); err != nil {
+		return nil, err
+	}
+	return formatHookOutput(map[string]string{CSI_REP_SNAPSHOT_ID: env[CSI_REQ_SNAPSHOT_ID]}), nil
+}
+
+func (b *btrfsBackend) listSnapshots(ctx context.Context, executer Executer, env map[string]string) ([]byte, error) {
+	// prints <snapshot ID>\t<subvolume ID> for every snapshot
+	script := "cd " + shellQuote(b.snapshotsDir) + ` && for s in *@*; do [ -d "$s" ] || continue; printf '%s\t%s\n' "$s" "$(btrfs inspect-internal rootid "$s")"; done`
+	out, err := runCommand(ctx, executer, script)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := qgroups(ctx, executer, b.snapshotsDir)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []*csi.Snapshot
+	for _, line := range strings.Split(out, "\n") {
+		snapshotID, id, ok := strings.Cut(line, "\t")
+		if !ok {
+			continue
+		}
+		volumeID, _, _ := strings.Cut(snapshotID, "@")
+		if v := env[CSI_REQ_SRC_VOLUME_ID]; v != "" && v != volumeID {
+			continue
+		}
+		if s := env[CSI_REQ_SNAPSHOT_ID]; s != "" && s != snapshotID {
+			continue
+		}
+		group, ok := groups[id]
+		if !ok {
+			return nil, fmt.Errorf("no qgroup 0/%s for snapshot %s", id, snapshotID)
+		}
+		snapshots = append(snapshots, &csi.Snapshot{SnapshotId: snapshotID, SourceVolumeId: volumeID, SizeBytes: b.snapshotBytes(group)})
+	}
+	return formatSnapshotList(snapshots), nil
+}
@@ -0,0 +1,221 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+const testQgroupShow = `Qgroupid    Referenced    Exclusive  Max referenced   Path
+--------    ----------    ---------  --------------   ----
+0/5              16384        16384            none   <toplevel>
+0/256          1048576        16384      1073741824   nfs/pvc-1
+0/257          1048576         4096            none   snapshots/pvc-1@snap-1
+`
+
+func newTestBtrfsBackend(t *testing.T, config map[string]string) Backend {
+	t.Helper()
+	cfg := map[string]string{"volumesDir": "/data/nfs/", "snapshotsDir": "/data/snapshots", "nfsServer": "nas"}
+	for k, v := range config {
+		cfg[k] = v
+	}
+	b, err := NewBackend(BTRFS_BACKEND, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBtrfsConfig(t *testing.T) {
+	if _, err := NewBackend(BTRFS_BACKEND, map[string]string{"volumesDir": "/data/nfs", "nfsServer": "nas"}); err == nil || !strings.Contains(err.Error(), "snapshotsDir") {
+		t.Errorf("missing snapshotsDir should be named, got %v", err)
+	}
+	for _, config := range []map[string]string{{"snapshotSize": "used"}, {"exportRoot": "/srv"}} {
+		cfg := map[string]string{"volumesDir": "/data/nfs", "snapshotsDir": "/data/snapshots", "nfsServer": "nas"}
+		for k, v := range config {
+			cfg[k] = v
+		}
+		if _, err := NewBackend(BTRFS_BACKEND, cfg); err == nil {
+			t.Errorf("config %v should be rejected", config)
+		}
+	}
+}
+
+func TestBtrfsCreateVolume(t *testing.T) {
+	b := newTestBtrfsBackend(t, map[string]string{"exportRoot": "/data"})
+	executer := (&scriptedExecuter{}).
+		on("'test' '-e'", "no\n", nil).
+		on("'rootid'", "256\n", nil).
+		on("'qgroup' 'show'", testQgroupShow, nil)
+	output := runBackend(t, b, executer, OP_CREATE_VOLUME, map[string]string{
+		CSI_REQ_VOLUME_ID:      "pvc-1",
+		CSI_REQ_CAPACITY_BYTES: "1073741824",
+	})
+	if !executer.ran("'btrfs' 'subvolume' 'create' '/data/nfs/pvc-1'") || !executer.ran("'btrfs' 'qgroup' 'limit' '1073741824' '/data/nfs/pvc-1'") {
+		t.Errorf("unexpected commands %v", executer.commands)
+	}
+	if output[CSI_REP_CAPACITY_BYTES] != "1073741824" || output[NFS_SHARE_PATH_KEY] != "/nfs/pvc-1" {
+		t.Errorf("unexpected output %v", output)
+	}
+
+	executer = (&scriptedExecuter{}).
+		on("'test' '-e'", "no\n", nil).
+		on("'rootid'", "256\n", nil).
+		on("'qgroup' 'show'", testQgroupShow, nil)
+	runBackend(t, b, executer, OP_CREATE_VOLUME, map[string]string{
+		CSI_REQ_VOLUME_ID:       "pvc-1",
+		CSI_REQ_CAPACITY_BYTES:  "1073741824",
+		CSI_REQ_DATA_SOURCE:     "snapshot",
+		CSI_REQ_SRC_SNAPSHOT_ID: "pvc-0@snap-1",
+	})
+	if !executer.ran("'btrfs' 'subvolume' 'snapshot' '/data/snapshots/pvc-0@snap-1' '/data/nfs/pvc-1'") {
+		t.Errorf("expected a writable snapshot of the source, ran %v", executer.commands)
+	}
+}
+
+func TestBtrfsQuotaDisabled(t *testing.T) {
+	executer := (&scriptedExecuter{}).
+		on("'qgroup' 'show'", "ERROR: can't list qgroups: quotas not enabled", errExit1)
+	_, err := newTestBtrfsBackend(t, nil).Run(context.Background(), executer, OP_CREATE_VOLUME, map[string]string{
+		CSI_REQ_VOLUME_ID:      "pvc-1",
+		CSI_REQ_CAPACITY_BYTES: "1024",
+	})
+	if err == nil || !strings.Contains(err.Error(), "btrfs quota enable") {
+		t.Errorf("expected a quota error, got %v", err)
+	}
+	if executer.ran("'subvolume' 'create'") {
+		t.Error("no subvolume should be created without quota")
+	}
+}
+
+func TestBtrfsDeleteVolume(t *testing.T) {
+	b := newTestBtrfsBackend(t, nil)
+	executer := (&scriptedExecuter{}).
+		on("'test' '-e'", "yes\n", nil).
+		on("'rootid'", "256\n", nil)
+	runBackend(t, b, executer, OP_DELETE_VOLUME, map[string]string{CSI_REQ_VOLUME_ID: "pvc-1"})
+	for _, cmd := range []string{
+		"'btrfs' 'subvolume' 'delete' '--commit-after' '/data/nfs/pvc-1'",
+		"'btrfs' 'subvolume' 'sync' '/data/nfs/' '256'",
+		"'btrfs' 'qgroup' 'destroy' '0/256' '/data/nfs/'",
+	} {
+		if !executer.ran(cmd) {
+			t.Errorf("expected %s, ran %v", cmd, executer.commands)
+		}
+	}
+
+	// newer kernels drop the qgroup with the subvolume
+	executer = (&scriptedExecuter{}).
+		on("'test' '-e'", "yes\n", nil).
+		on("'rootid'", "256\n", nil).
+		on("'qgroup' 'destroy'", "ERROR: unable to destroy quota group: No such file or directory", errExit1)
+	runBackend(t, b, executer, OP_DELETE_VOLUME, map[string]string{CSI_REQ_VOLUME_ID: "pvc-1"})
+
+	executer = (&scriptedExecuter{}).on("'test' '-e'", "no\n", nil)
+	runBackend(t, b, executer, OP_DELETE_VOLUME, map[string]string{CSI_REQ_VOLUME_ID: "pvc-1"})
+	if executer.ran("'subvolume' 'delete'") || executer.ran("'qgroup' 'destroy'") {
+		t.Error("deleting a missing volume should succeed without delete")
+	}
+}
+
+func TestBtrfsDeleteVolumeRetry(t *testing.T) {
+	b := newTestBtrfsBackend(t, nil)
+	// the first attempt deleted the subvolume and was cut off in the sync
+	executer := (&scriptedExecuter{}).
+		on("'test' '-e'", "yes\n", nil).
+		on("'rootid'", "256\n", nil).
+		on("'subvolume' 'sync'", "", errors.New("signal: killed"))
+	if _, err := b.Run(context.Background(), executer, OP_DELETE_VOLUME, map[string]string{CSI_REQ_VOLUME_ID: "pvc-1"}); err == nil {
+		t.Fatal("expected the sync to fail")
+	}
+	if !executer.ran("'printf' '%s' '256' > '/data/nfs/.pvc-1.deleting.tmp'") {
+		t.Errorf("expected the subvolume ID saved before the delete, ran %v", executer.commands)
+	}
+
+	executer = (&scriptedExecuter{}).
+		on("'test' '-e'", "no\n", nil).
+		on("'cat' '/data/nfs/.pvc-1.deleting'", "256\n", nil)
+	runBackend(t, b, executer, OP_DELETE_VOLUME, map[string]string{CSI_REQ_VOLUME_ID: "pvc-1"})
+	for _, cmd := range []string{
+		"'btrfs' 'subvolume' 'sync' '/data/nfs/' '256'",
+		"'btrfs' 'qgroup' 'destroy' '0/256' '/data/nfs/'",
+		"'rm' '-f' '/data/nfs/.pvc-1.deleting'",
+	} {
+		if !executer.ran(cmd) {
+			t.Errorf("expected %s on retry, ran %v", cmd, executer.commands)
+		}
+	}
+}
+
+func TestBtrfsSnapshots(t *testing.T) {
+	b := newTestBtrfsBackend(t, map[string]string{"snapshotSize": BTRFS_SNAPSHOT_SIZE_EXCLUSIVE})
+	executer := (&scriptedExecuter{}).
+		on("'test' '-e'", "no\n", nil).
+		on("'rootid'", "257\n", nil).
+		on("'qgroup' 'show'", testQgroupShow, nil)
+	output := runBackend(t, b, executer, OP_CREATE_SNAPSHOT, map[string]string{
+		CSI_REQ_SRC_VOLUME_ID: "pvc-1",
+		CSI_REQ_SNAPSHOT_NAME: "snap-1",
+	})
+	if !executer.ran("'btrfs' 'subvolume' 'snapshot' '-r' '/data/nfs/pvc-1' '/data/snapshots/pvc-1@snap-1'") {
+		t.Errorf("expected a read-only snapshot, ran %v", executer.commands)
+	}
+	if output[CSI_REP_SNAPSHOT_ID] != "pvc-1@snap-1" || output[CSI_REP_CAPACITY_BYTES] != "4096" {
+		t.Errorf("unexpected output %v", output)
+	}
+
+	executer = (&scriptedExecuter{}).
+		on("'test' '-e'", "yes\n", nil).
+		on("'property' 'get'", "ro=false\n", nil)
+	if _, err := b.Run(context.Background(), executer, OP_CREATE_SNAPSHOT, map[string]string{
+		CSI_REQ_SRC_VOLUME_ID: "pvc-1",
+		CSI_REQ_SNAPSHOT_NAME: "snap-1",
+	}); err == nil || !strings.Contains(err.Error(), "read-only") {
+		t.Errorf("a writable snapshot should be rejected, got %v", err)
+	}
+
+	executer = (&scriptedExecuter{}).
+		on("for s in", "pvc-1@snap-1\t257\npvc-2@snap-2\t300\n", nil).
+		on("'qgroup' 'show'", testQgroupShow+"0/300 10 10 none snapshots/pvc-2@snap-2\n", nil)
+	out, err := b.Run(context.Background(), executer, OP_LIST_SNAPSHOTS, map[string]string{CSI_REQ_SRC_VOLUME_ID: "pvc-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := parseSnapshotList(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 || snapshots[0].SnapshotId != "v1:pvc-1@snap-1" || snapshots[0].SizeBytes != 4096 {
+		t.Errorf("unexpected snapshots %v", snapshots)
+	}
+}
+
+func TestBtrfsLegacySnapshotIDs(t *testing.T) {
+	b := newTestBtrfsBackend(t, nil)
+	executer := (&scriptedExecuter{}).
+		on("'test' '-e'", "yes\n", nil).
+		on("'rootid'", "258\n", nil)
+	runBackend(t, b, executer, OP_DELETE_SNAPSHOT, map[string]string{CSI_REQ_SNAPSHOT_ID: "snapcontent-1"})
+	if !executer.ran("'btrfs' 'subvolume' 'delete' '--commit-after' '/data/snapshots/snapcontent-1'") {
+		t.Errorf("expected the snapshot of the former scripts deleted, ran %v", executer.commands)
+	}
+
+	executer = (&scriptedExecuter{}).
+		once("'test' '-e'", "no\n", nil).
+		on("'rootid'", "256\n", nil).
+		on("'qgroup' 'show'", testQgroupShow, nil)
+	runBackend(t, b, executer, OP_CREATE_VOLUME, map[string]string{
+		CSI_REQ_VOLUME_ID:       "pvc-1",
+		CSI_REQ_CAPACITY_BYTES:  "1073741824",
+		CSI_REQ_DATA_SOURCE:     "snapshot",
+		CSI_REQ_SRC_SNAPSHOT_ID: "snapcontent-1",
+	})
+	if !executer.ran("'btrfs' 'subvolume' 'snapshot' '/data/snapshots/snapcontent-1' '/data/nfs/pvc-1'") {
+		t.Errorf("expected a restore of the former snapshot, ran %v", executer.commands)
+	}
+
+	if _, err := b.(*btrfsBackend).snapshotPath("../etc"); err == nil {
+		t.Error("an invalid snapshot ID should be rejected")
+	}
+}
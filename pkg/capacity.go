@@ -0,0 +1,199 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+// StorageClass parameters limiting the size of a volume
+const (
+	MIN_SIZE_KEY = "minSize"
+	MAX_SIZE_KEY = "maxSize"
+)
+
+// Size is a number of bytes, an integer with an optional suffix as in
+// Kubernetes quantities: Ki, Mi, Gi, Ti, Pi or k, M, G, T, P.
+type Size int64
+
+var sizeSuffixes = []struct {
+	suffix string
+	factor int64
+}{
+	{"Pi", 1 << 50}, {"Ti", 1 << 40}, {"Gi", 1 << 30}, {"Mi", 1 << 20}, {"Ki", 1 << 10},
+	{"P", 1e15}, {"T", 1e12}, {"G", 1e9}, {"M", 1e6}, {"k", 1e3},
+}
+
+func ParseSize(s string) (Size, error) {
+	number, factor := strings.TrimSpace(s), int64(1)
+	for _, u := range sizeSuffixes {
+		if n, ok := strings.CutSuffix(number, u.suffix); ok {
+			number, factor = n, u.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > math.MaxInt64/factor {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return Size(n * factor), nil
+}
+
+// String returns the size with the largest binary suffix dividing it.
+func (s Size) String() string {
+	for _, u := range sizeSuffixes[:5] {
+		if s != 0 && int64(s)%u.factor == 0 {
+			return strconv.FormatInt(int64(s)/u.factor, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(int64(s), 10)
+}
+
+func (s *Size) Set(value string) error {
+	size, err := ParseSize(value)
+	if err != nil {
+		return err
+	}
+	*s = size
+	return nil
+}
+
+func (s *Size) Type() string {
+	return "size"
+}
+
+func (s *Size) UnmarshalYAML(node *yaml.Node) error {
+	return s.Set(node.Value)
+}
+
+// CapacityConfig rounds and limits the capacity of volumes, zero disables a
+// setting.
+type CapacityConfig struct {
+	// AllocationUnit is the multiple of which capacities are requested from
+	// the hooks, the backend chooses it if empty
+	AllocationUnit Size `yaml:"allocationUnit"`
+	// MinSize and MaxSize apply to every volume, the minSize and maxSize
+	// StorageClass parameters can narrow them on creation
+	MinSize Size `yaml:"minSize"`
+	MaxSize Size `yaml:"maxSize"`
+}
+
+func (c CapacityConfig) Validate() error {
+	if c.MaxSize > 0 && c.MinSize > c.MaxSize {
+		return fmt.Errorf("minSize: %s is larger than maxSize %s", c.MinSize, c.MaxSize)
+	}
+	return nil
+}
+
+// allocationUnitBackend is implemented by backends allocating capacity in
+// units larger than a byte.
+type allocationUnitBackend interface {
+	AllocationUnit() int64
+}
+
+// capacityLimits is what a volume capacity must satisfy besides the CSI range.
+type capacityLimits struct {
+	unit int64
+	min  int64
+	max  int64
+}
+
+// capacityLimits returns the limits of an operation, the stricter of the
+// config and the minSize and maxSize parameters, which are only known on
+// creation.
+func (d *SshController) capacityLimits(ctx context.Context, operation string, params map[string]string) (capacityLimits, error) {
+	c := d.config.Capacity
+	limits := capacityLimits{unit: int64(c.AllocationUnit), min: int64(c.MinSize), max: int64(c.MaxSize)}
+	if b, ok := d.backend.(allocationUnitBackend); ok && limits.unit == 0 && d.backendRuns(ctx, operation) {
+		limits.unit = b.AllocationUnit()
+	}
+	if v, ok := params[MIN_SIZE_KEY]; ok {
+		size, err := ParseSize(v)
+		if err != nil {
+			return limits, status.Errorf(codes.InvalidArgument, "parameter %s: %s", MIN_SIZE_KEY, err)
+		}
+		limits.min = max(limits.min, int64(size))
+	}
+	if v, ok := params[MAX_SIZE_KEY]; ok {
+		size, err := ParseSize(v)
+		if err != nil {
+			return limits, status.Errorf(codes.InvalidArgument, "parameter %s: %s", MAX_SIZE_KEY, err)
+		}
+		if limits.max == 0 || (size > 0 && int64(size) < limits.max) {
+			limits.max = int64(size)
+		}
+	}
+	if limits.max > 0 && limits.min > limits.max {
+		return limits, status.Errorf(codes.InvalidArgument, "%s %d is larger than %s %d", MIN_SIZE_KEY, limits.min, MAX_SIZE_KEY, limits.max)
+	}
+	return limits, nil
+}
+
+// fit returns the capacity requested from the hook for a CSI capacity range:
+// the required bytes raised to the minimum size and rounded up to the
+// allocation unit.
+func (l capacityLimits) fit(r *csi.CapacityRange) (int64, error) {
+	required, limit := r.GetRequiredBytes(), r.GetLimitBytes()
+	if required < 0 || limit < 0 {
+		return 0, status.Error(codes.InvalidArgument, "capacity range must not be negative")
+	}
+	if limit > 0 && required > limit {
+		return 0, status.Errorf(codes.InvalidArgument, "required bytes %d exceed the limit bytes %d", required, limit)
+	}
+	if l.max > 0 && required > l.max {
+		return 0, status.Errorf(codes.OutOfRange, "required bytes %d exceed the maximum size %d", required, l.max)
+	}
+	if limit > 0 && limit < l.min {
+		return 0, status.Errorf(codes.OutOfRange, "limit bytes %d are below the minimum size %d", limit, l.min)
+	}
+	capacity := max(required, l.min)
+	if capacity == 0 {
+		return 0, status.Error(codes.InvalidArgument, "required bytes must be set when there is no minimum size")
+	}
+	if l.unit > 1 && capacity%l.unit != 0 {
+		if capacity > math.MaxInt64-l.unit {
+			return 0, status.Errorf(codes.OutOfRange, "required bytes %d are too large", required)
+		}
+		capacity += l.unit - capacity%l.unit
+	}
+	upper := l.max
+	if limit > 0 && (upper == 0 || limit < upper) {
+		upper = limit
+	}
+	if upper > 0 && capacity > upper {
+		return 0, status.Errorf(codes.OutOfRange, "no multiple of the allocation unit %d between %d and %d bytes", l.unit, max(required, l.min), upper)
+	}
+	return capacity, nil
+}
+
+// check verifies the capacity a hook reported against the CSI range and the
+// limits. A hook reporting 0 does not know the capacity, which is passed on as
+// 0, the unknown capacity of CSI.
+func (l capacityLimits) check(reported int64, r *csi.CapacityRange) (int64, error) {
+	if reported == 0 {
+		return 0, nil
+	}
+	if reported < r.GetRequiredBytes() {
+		return 0, status.Errorf(codes.OutOfRange, "hook reported %d bytes, less than the required %d", reported, r.GetRequiredBytes())
+	}
+	if reported < l.min {
+		return 0, status.Errorf(codes.OutOfRange, "hook reported %d bytes, less than the minimum size %d", reported, l.min)
+	}
+	if limit := r.GetLimitBytes(); limit > 0 && reported > limit {
+		return 0, status.Errorf(codes.OutOfRange, "hook reported %d bytes, more than the limit %d", reported, limit)
+	}
+	if l.max > 0 && reported > l.max {
+		return 0, status.Errorf(codes.OutOfRange, "hook reported %d bytes, more than the maximum size %d", reported, l.max)
+	}
+	return reported, nil
+}
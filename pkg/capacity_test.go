@@ -0,0 +1,163 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseSize(t *testing.T) {
+	for value, expected := range map[string]Size{
+		"1048576": 1 << 20,
+		"1Mi":     1 << 20,
+		"10Gi":    10 << 30,
+		"2k":      2000,
+		"1G":      1e9,
+		"0":       0,
+	} {
+		size, err := ParseSize(value)
+		if err != nil || size != expected {
+			t.Errorf("ParseSize(%q) = %d, %v, expected %d", value, size, err, expected)
+		}
+	}
+	for _, value := range []string{"", "-1Mi", "1.5Gi", "1GB", "9000000Pi"} {
+		if _, err := ParseSize(value); err == nil {
+			t.Errorf("ParseSize(%q) should fail", value)
+		}
+	}
+	if Size(3<<30).String() != "3Gi" || Size(1500).String() != "1500" {
+		t.Errorf("unexpected strings %s %s", Size(3<<30), Size(1500))
+	}
+}
+
+func TestCapacityFit(t *testing.T) {
+	limits := capacityLimits{unit: 1 << 20, min: 4 << 20, max: 100 << 20}
+	for _, c := range []struct {
+		required, limit int64
+		expected        int64
+		code            codes.Code
+	}{
+		{required: 10<<20 + 1, expected: 11 << 20},
+		{required: 1 << 20, expected: 4 << 20},
+		{required: 0, expected: 4 << 20},
+		{required: 10 << 20, limit: 10 << 20, expected: 10 << 20},
+		{required: 10<<20 + 1, limit: 10<<20 + 2, code: codes.OutOfRange},
+		{required: 101 << 20, code: codes.OutOfRange},
+		{limit: 2 << 20, code: codes.OutOfRange},
+		{required: 2 << 20, limit: 1 << 20, code: codes.InvalidArgument},
+		{required: -1, code: codes.InvalidArgument},
+	} {
+		capacity, err := limits.fit(&csi.CapacityRange{RequiredBytes: c.required, LimitBytes: c.limit})
+		if status.Code(err) != c.code || capacity != c.expected {
+			t.Errorf("fit(%d, %d) = %d, %v, expected %d, %s", c.required, c.limit, capacity, err, c.expected, c.code)
+		}
+	}
+	if _, err := (capacityLimits{}).fit(nil); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("an empty range without a minimum size should be rejected, got %v", err)
+	}
+}
+
+func TestCapacityLimitsParameters(t *testing.T) {
+	driver := NewOfflineController(ControllerCfg{Capacity: CapacityConfig{MinSize: 1 << 20, MaxSize: 1 << 30}}, true)
+	limits, err := driver.capacityLimits(context.Background(), OP_CREATE_VOLUME, map[string]string{MIN_SIZE_KEY: "512Ki", MAX_SIZE_KEY: "10Gi"})
+	if err != nil || limits.min != 1<<20 || limits.max != 1<<30 {
+		t.Errorf("parameters should only narrow the config, got %+v, %v", limits, err)
+	}
+	limits, err = driver.capacityLimits(context.Background(), OP_CREATE_VOLUME, map[string]string{MIN_SIZE_KEY: "2Mi", MAX_SIZE_KEY: "8Mi"})
+	if err != nil || limits.min != 2<<20 || limits.max != 8<<20 {
+		t.Errorf("unexpected limits %+v, %v", limits, err)
+	}
+	for _, params := range []map[string]string{{MIN_SIZE_KEY: "big"}, {MIN_SIZE_KEY: "8Mi", MAX_SIZE_KEY: "2Mi"}} {
+		if _, err := driver.capacityLimits(context.Background(), OP_CREATE_VOLUME, params); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected InvalidArgument for %v, got %v", params, err)
+		}
+	}
+
+	backend, err := NewBackend(LVM_THIN_BACKEND, map[string]string{"volumeGroup": "vg0", "thinPool": "pool", "exportRoot": "/export", "nfsServer": "10.0.0.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver.backend = backend
+	if limits, _ := driver.capacityLimits(context.Background(), OP_EXPAND_VOLUME, nil); limits.unit != 4<<20 {
+		t.Errorf("expected the allocation unit of the backend, got %d", limits.unit)
+	}
+}
+
+func TestCreateVolumeCapacityRange(t *testing.T) {
+	driver := NewOfflineController(ControllerCfg{
+		CreateCmd: `echo "csi-shell-output:volume_id=$CSI_VOLUME_ID"
+echo "csi-shell-output:capacity_bytes=$((CSI_CAPACITY_BYTES + ${CSI_PARAM_extra:-0}))"
+echo "csi-shell-output:nfs_server=127.0.0.1"
+echo "csi-shell-output:nfs_path=/data/$CSI_VOLUME_ID"`,
+		ExpandCmd: `echo "csi-shell-output:capacity_bytes=${CSI_CAPACITY_BYTES%??????}"`,
+		Capacity:  CapacityConfig{AllocationUnit: 1 << 20},
+	}, true)
+	request := func(params map[string]string) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name:          "pvc-1",
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 1000, LimitBytes: 2 << 20},
+			Parameters:    params,
+		}
+	}
+	resp, err := driver.CreateVolume(context.Background(), request(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Volume.CapacityBytes != 1<<20 {
+		t.Errorf("expected the capacity rounded up to 1Mi, got %d", resp.Volume.CapacityBytes)
+	}
+	if _, err := driver.CreateVolume(context.Background(), request(map[string]string{"extra": "2000000"})); status.Code(err) != codes.OutOfRange {
+		t.Errorf("a capacity above the limit should be OutOfRange, got %v", err)
+	}
+	if _, err := driver.CreateVolume(context.Background(), request(map[string]string{MIN_SIZE_KEY: "4Mi"})); status.Code(err) != codes.OutOfRange {
+		t.Errorf("a limit below minSize should be OutOfRange, got %v", err)
+	}
+
+	_, err = driver.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      CSI_VOLUME_ID_PREFIX + "pvc-1",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 3 << 20},
+	})
+	if status.Code(err) != codes.OutOfRange {
+		t.Errorf("an expand hook reporting less than required should be OutOfRange, got %v", err)
+	}
+}
+
+func TestCapacityCheck(t *testing.T) {
+	limits := capacityLimits{min: 4 << 20, max: 8 << 20}
+	r := &csi.CapacityRange{RequiredBytes: 1 << 20}
+	if capacity, err := limits.check(4<<20, r); err != nil || capacity != 4<<20 {
+		t.Errorf("a capacity within the limits should be kept, got %d, %v", capacity, err)
+	}
+	if capacity, err := limits.check(0, r); err != nil || capacity != 0 {
+		t.Errorf("an unknown capacity should stay unknown, got %d, %v", capacity, err)
+	}
+	for _, reported := range []int64{2 << 20, 16 << 20} {
+		if _, err := limits.check(reported, r); status.Code(err) != codes.OutOfRange {
+			t.Errorf("a capacity of %d should be OutOfRange, got %v", reported, err)
+		}
+	}
+}
+
+func TestCreateVolumeClassMaxSize(t *testing.T) {
+	driver := NewOfflineController(ControllerCfg{
+		CreateCmd: `echo "csi-shell-output:volume_id=$CSI_VOLUME_ID"
+echo "csi-shell-output:capacity_bytes=$CSI_CAPACITY_BYTES"
+echo "csi-shell-output:nfs_server=127.0.0.1"
+echo "csi-shell-output:nfs_path=/data/$CSI_VOLUME_ID"`,
+	}, true)
+	resp, err := driver.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "pvc-1",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 20},
+		Parameters:    map[string]string{MAX_SIZE_KEY: "4Mi"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// snapshot lists report the source as v1:<volume>, the ID must match
+	if resp.Volume.VolumeId != CSI_VOLUME_ID_PREFIX+"pvc-1" {
+		t.Errorf("expected the volume ID of the hook, got %q", resp.Volume.VolumeId)
+	}
+}
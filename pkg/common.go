@@ -2,11 +2,10 @@ package pkg
 
 import (
 	"context"
-	"log/slog"
 	"sync"
-	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 const (
@@ -20,6 +19,8 @@ const (
 	CSI_REP_SNAPSHOT_ID     = "snapshot_id"
 	CSI_REP_DATA_SOURCE     = "data_source"
 	CSI_REP_CAPACITY_BYTES  = "capacity_bytes"
+	CSI_REP_SNAPSHOT        = "snapshot"
+	CSI_REP_SRC_VOLUME_ID   = "source_volume_id"
 	CSI_VOLUME_ID_PREFIX    = "v1:"
 	CSI_SNAPSHOT_ID_PREFIX  = "v1:"
 	CSI_REQ_PREFIX          = "CSI_"
@@ -30,19 +31,39 @@ const (
 	CSI_REQ_SRC_SNAPSHOT_ID = CSI_REQ_PREFIX + "SRC_SNAPSHOT_ID"
 	CSI_REQ_SRC_VOLUME_ID   = CSI_REQ_PREFIX + "SRC_VOLUME_ID"
 	CSI_REQ_CAPACITY_BYTES  = CSI_REQ_PREFIX + "CAPACITY_BYTES"
+	CSI_REQ_VOLUME_MODE     = CSI_REQ_PREFIX + "VOLUME_MODE"
+	CSI_REQ_TRACE_ID        = CSI_REQ_PREFIX + "TRACE_ID"
+	CSI_REQ_DRY_RUN         = CSI_REQ_PREFIX + "DRY_RUN"
 	CSI_REQ_PARAM_PREFIX    = CSI_REQ_PREFIX + "PARAM_"
 )
+
+// hook operations
+const (
+	OP_CREATE_VOLUME   = "create_volume"
+	OP_DELETE_VOLUME   = "delete_volume"
+	OP_EXPAND_VOLUME   = "expand_volume"
+	OP_CREATE_SNAPSHOT = "create_snapshot"
+	OP_DELETE_SNAPSHOT = "delete_snapshot"
+	OP_LIST_SNAPSHOTS  = "list_snapshots"
+)
+
 const (
 	NFS_SHARE_SERVER_KEY = "nfs_server"
 	NFS_SHARE_PATH_KEY   = "nfs_path"
+	MOUNT_TIMEOUT_KEY    = "mountTimeout"
+	// MOUNT_GROUP_KEY is the StorageClass parameter giving the volume root to a
+	// group at create time, on the server, where root_squash does not apply
+	MOUNT_GROUP_KEY = "mountGroup"
 )
 
 type IdentityServer struct {
 	csi.UnimplementedIdentityServer
+	// prober, if set, decides whether the plugin is ready
+	prober *Prober
 }
 
 func (d *IdentityServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
-	slog.Info("GetPluginInfo called")
+	Logger(ctx).Info("GetPluginInfo called")
 	return &csi.GetPluginInfoResponse{
 		Name:          DriverName,
 		VendorVersion: DriverVersion,
@@ -50,7 +71,7 @@ func (d *IdentityServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginIn
 }
 
 func (d *IdentityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
-	slog.Info("GetPluginCapabilities called")
+	Logger(ctx).Info("GetPluginCapabilities called")
 	return &csi.GetPluginCapabilitiesResponse{
 		Capabilities: []*csi.PluginCapability{
 			{
@@ -64,8 +85,15 @@ func (d *IdentityServer) GetPluginCapabilities(ctx context.Context, req *csi.Get
 	}, nil
 }
 func (d *IdentityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	slog.Debug("Probe called")
-	return &csi.ProbeResponse{}, nil
+	Logger(ctx).Debug("Probe called")
+	if d.prober == nil {
+		return &csi.ProbeResponse{Ready: wrapperspb.Bool(true)}, nil
+	}
+	if err := d.prober.Check(ctx); err != nil {
+		Logger(ctx).Warn("Probe failed, plugin is not ready", "err", err)
+		return &csi.ProbeResponse{Ready: wrapperspb.Bool(false)}, nil
+	}
+	return &csi.ProbeResponse{Ready: wrapperspb.Bool(true)}, nil
 }
 
 var _ csi.IdentityServer = &IdentityServer{}
@@ -99,26 +127,3 @@ func (sm *StringMutex) UnLock(key string) {
 	sm.mu.Unlock()
 	lock.Unlock()
 }
-
-type ExecFunc func() (err error)
-type TimeoutFunc func() (err error)
-
-func WaitUntilTimeout(timeout time.Duration, execFunc ExecFunc, timeoutFunc TimeoutFunc) error {
-	// Create a channel to receive the result of the exec function
-	done := make(chan bool, 1)
-	var err error
-
-	// Start the exec function in a goroutine
-	go func() {
-		err = execFunc()
-		done <- true
-	}()
-
-	// Wait for the function to complete or time out
-	select {
-	case <-done:
-		return err
-	case <-time.After(timeout):
-		return timeoutFunc()
-	}
-}
@@ -0,0 +1,254 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadConfigFile decodes the YAML or JSON file at path into cfg, unknown fields
+// are rejected. The first value set wins, in this order: command line flags,
+// environment variables, the file, the flag defaults. envs maps flag names to
+// the environment variables that set them.
+func LoadConfigFile(path string, cfg any, flags *pflag.FlagSet, envs map[string]string) error {
+	changed := map[string]*pflag.Flag{}
+	values := map[string]any{}
+	flags.Visit(func(f *pflag.Flag) {
+		changed[f.Name] = f
+		if sv, ok := f.Value.(pflag.SliceValue); ok {
+			values[f.Name] = sv.GetSlice()
+		} else {
+			values[f.Name] = f.Value.String()
+		}
+	})
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer file.Close()
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	for name, env := range envs {
+		value, ok := os.LookupEnv(env)
+		if !ok || changed[name] != nil {
+			continue
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value of %s: %w", env, err)
+		}
+	}
+	for name, f := range changed {
+		if slice, ok := values[name].([]string); ok {
+			err = f.Value.(pflag.SliceValue).Replace(slice)
+		} else {
+			err = f.Value.Set(values[name].(string))
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value of --%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+const (
+	PARAM_TYPE_STRING   = "string"
+	PARAM_TYPE_INT      = "int"
+	PARAM_TYPE_BOOL     = "bool"
+	PARAM_TYPE_DURATION = "duration"
+)
+
+// ParameterSchema describes a StorageClass parameter accepted by CreateVolume.
+type ParameterSchema struct {
+	// Type is one of string, int, bool or duration, string if empty
+	Type     string   `yaml:"type"`
+	Required bool     `yaml:"required"`
+	Enum     []string `yaml:"enum"`
+}
+
+func (s ParameterSchema) validateSchema() error {
+	switch s.Type {
+	case "", PARAM_TYPE_STRING, PARAM_TYPE_INT, PARAM_TYPE_BOOL, PARAM_TYPE_DURATION:
+	default:
+		return fmt.Errorf("type: unknown type %q, must be string, int, bool or duration", s.Type)
+	}
+	for i, v := range s.Enum {
+		if err := s.validateType(v); err != nil {
+			return fmt.Errorf("enum[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (s ParameterSchema) validateType(value string) error {
+	var err error
+	switch s.Type {
+	case PARAM_TYPE_INT:
+		_, err = strconv.ParseInt(value, 10, 64)
+	case PARAM_TYPE_BOOL:
+		_, err = strconv.ParseBool(value)
+	case PARAM_TYPE_DURATION:
+		_, err = time.ParseDuration(value)
+	}
+	if err != nil {
+		return fmt.Errorf("%q is not a valid %s", value, s.Type)
+	}
+	return nil
+}
+
+func (s ParameterSchema) Validate(value string) error {
+	if err := s.validateType(value); err != nil {
+		return err
+	}
+	if len(s.Enum) > 0 && !slices.Contains(s.Enum, value) {
+		return fmt.Errorf("%q is not one of %v", value, s.Enum)
+	}
+	return nil
+}
+
+// validateParameters checks params against schemas, parameters without a
+// schema are accepted as is.
+func validateParameters(schemas map[string]ParameterSchema, params map[string]string) error {
+	for name, schema := range schemas {
+		value, ok := params[name]
+		if !ok {
+			if schema.Required {
+				return fmt.Errorf("parameter %s is required", name)
+			}
+			continue
+		}
+		if err := schema.Validate(value); err != nil {
+			return fmt.Errorf("parameter %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Validate reports every invalid field of the controller configuration, named
+// as in the config file.
+func (c *ControllerCfg) Validate() error {
+	var errs []error
+	if c.Endpoint == "" {
+		errs = append(errs, fmt.Errorf("endpoint (--endpoint) is required"))
+	}
+	if c.HooksDir != "" {
+		if info, err := os.Stat(c.HooksDir); err != nil || !info.IsDir() {
+			errs = append(errs, fmt.Errorf("hooksDir: %s is not a directory", c.HooksDir))
+		}
+	}
+	var backend Backend
+	if c.Backend != "" {
+		var err error
+		if backend, err = NewBackend(c.Backend, c.BackendConfig); err != nil {
+			errs = append(errs, fmt.Errorf("backend: %w", err))
+		}
+	} else if len(c.BackendConfig) > 0 {
+		errs = append(errs, fmt.Errorf("backendConfig: set without a backend"))
+	}
+	hooks := NewHookLoader(c.HooksDir)
+	if path := hooks.path(OP_DISPATCHER, c.DispatcherCmd); c.DispatcherCmd != "" && path != "" && !hooks.Has(OP_DISPATCHER, c.DispatcherCmd) {
+		errs = append(errs, fmt.Errorf("dispatcherCmd: hook file %s does not exist", path))
+	}
+	for _, h := range []struct {
+		field     string
+		flag      string
+		operation string
+		value     string
+		required  bool
+	}{
+		{"createCmd", "create-cmd", OP_CREATE_VOLUME, c.CreateCmd, true},
+		{"deleteCmd", "delete-cmd", OP_DELETE_VOLUME, c.DeleteCmd, true},
+		{"expandCmd", "expand-cmd", OP_EXPAND_VOLUME, c.ExpandCmd, false},
+		{"createSnapshotCmd", "create-snapshot-cmd", OP_CREATE_SNAPSHOT, c.CreateSnapshotCmd, false},
+		{"deleteSnapshotCmd", "delete-snapshot-cmd", OP_DELETE_SNAPSHOT, c.DeleteSnapshotCmd, false},
+		{"listSnapshotsCmd", "list-snapshots-cmd", OP_LIST_SNAPSHOTS, c.ListSnapshotsCmd, false},
+		{"probeCmd", "probe-cmd", "probe", c.ProbeCmd, false},
+	} {
+		if hooks.Has(h.operation, h.value) {
+			continue
+		}
+		if h.value == "" && backend != nil && backend.Supports(h.operation) {
+			continue
+		}
+		// the operations of the dispatcher are only known from its handshake
+		if h.value == "" && c.DispatcherCmd != "" {
+			continue
+		}
+		if path := hooks.path(h.operation, h.value); h.value != "" {
+			errs = append(errs, fmt.Errorf("%s: hook file %s does not exist", h.field, path))
+		} else if h.required && c.HooksDir != "" {
+			errs = append(errs, fmt.Errorf("%s (--%s) is required, or %s in hooksDir", h.field, h.flag, filepath.Base(path)))
+		} else if h.required {
+			errs = append(errs, fmt.Errorf("%s (--%s) is required", h.field, h.flag))
+		}
+	}
+	if c.ProbeTimeout < 0 {
+		errs = append(errs, fmt.Errorf("probeTimeout: must not be negative"))
+	}
+	if c.DrainTimeout < 0 {
+		errs = append(errs, fmt.Errorf("drainTimeout: must not be negative"))
+	}
+	if err := c.TLS.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("tls: %w", err))
+	}
+	if err := c.Capacity.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("capacity.%w", err))
+	}
+	if err := c.Exports.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("exports.%w", err))
+	}
+	for _, operation := range slices.Sorted(maps.Keys(c.HookSecrets)) {
+		if _, ok := hookContracts[operation]; !ok {
+			errs = append(errs, fmt.Errorf("hookSecrets: unknown operation %q", operation))
+		} else if slices.Contains(c.HookSecrets[operation], "") {
+			errs = append(errs, fmt.Errorf("hookSecrets.%s: empty secret key", operation))
+		}
+	}
+	for name, schema := range c.Parameters {
+		if err := schema.validateSchema(); err != nil {
+			errs = append(errs, fmt.Errorf("parameters.%s.%w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate reports every invalid field of the node configuration, named as in
+// the config file.
+func (c *NodeCfg) Validate() error {
+	var errs []error
+	if c.Endpoint == "" {
+		errs = append(errs, fmt.Errorf("endpoint (--endpoint) is required"))
+	}
+	if c.NodeID == "" {
+		errs = append(errs, fmt.Errorf("nodeID (--node-id) is required"))
+	}
+	if c.MountTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("mountTimeout: must be positive"))
+	}
+	if c.HealthCheckInterval > 0 && c.HealthCheckTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("healthCheckTimeout: must be positive when health checks are enabled"))
+	}
+	if c.ReconcileInterval < 0 {
+		errs = append(errs, fmt.Errorf("reconcileInterval: must not be negative"))
+	}
+	if c.DrainTimeout < 0 {
+		errs = append(errs, fmt.Errorf("drainTimeout: must not be negative"))
+	}
+	if err := c.TLS.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("tls: %w", err))
+	}
+	return errors.Join(errs...)
+}
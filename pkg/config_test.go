@@ -0,0 +1,150 @@
+package pkg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/spf13/pflag"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFilePrecedence(t *testing.T) {
+	var cfg ControllerCfg
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.StringVar(&cfg.Endpoint, "endpoint", "unix:///tmp/csi.sock", "")
+	flags.StringVar(&cfg.CreateCmd, "create-cmd", "", "")
+	flags.StringVar(&cfg.DeleteCmd, "delete-cmd", "", "")
+	flags.StringVar(&cfg.ExpandCmd, "expand-cmd", "", "")
+	flags.DurationVar(&cfg.ProbeTimeout, "probe-timeout", 2*time.Second, "")
+	if err := flags.Parse([]string{"--create-cmd", "from-flag"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_DELETE_CMD", "from-env")
+
+	path := writeConfigFile(t, `
+createCmd: from-file
+deleteCmd: from-file
+expandCmd: |
+  echo expand
+  echo done
+probeTimeout: 5s
+parameters:
+  quota:
+    type: int
+    required: true
+`)
+	envs := map[string]string{"create-cmd": "TEST_CREATE_CMD", "delete-cmd": "TEST_DELETE_CMD"}
+	if err := LoadConfigFile(path, &cfg, flags, envs); err != nil {
+		t.Fatalf("LoadConfigFile failed: %v", err)
+	}
+	if cfg.CreateCmd != "from-flag" {
+		t.Errorf("flag should override the file, got %q", cfg.CreateCmd)
+	}
+	if cfg.DeleteCmd != "from-env" {
+		t.Errorf("env should override the file, got %q", cfg.DeleteCmd)
+	}
+	if cfg.ExpandCmd != "echo expand\necho done\n" {
+		t.Errorf("file should override the default, got %q", cfg.ExpandCmd)
+	}
+	if cfg.ProbeTimeout != 5*time.Second {
+		t.Errorf("expected probe timeout from file, got %v", cfg.ProbeTimeout)
+	}
+	if cfg.Endpoint != "unix:///tmp/csi.sock" {
+		t.Errorf("default should be kept when the file does not set it, got %q", cfg.Endpoint)
+	}
+	if !cfg.Parameters["quota"].Required {
+		t.Errorf("expected parameter schema from file, got %v", cfg.Parameters)
+	}
+}
+
+func TestLoadConfigFileJSON(t *testing.T) {
+	var cfg NodeCfg
+	path := writeConfigFile(t, `{"nodeID": "node-1", "mountTimeout": "1m", "probeBinaries": ["mount"]}`)
+	if err := LoadConfigFile(path, &cfg, pflag.NewFlagSet("test", pflag.ContinueOnError), nil); err != nil {
+		t.Fatalf("LoadConfigFile failed: %v", err)
+	}
+	if cfg.NodeID != "node-1" || cfg.MountTimeout != time.Minute || len(cfg.ProbeBinaries) != 1 {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	for name, content := range map[string]string{
+		"createCmdd":   "createCmdd: echo",
+		"probeTimeout": "probeTimeout: soon",
+	} {
+		var cfg ControllerCfg
+		path := writeConfigFile(t, content)
+		err := LoadConfigFile(path, &cfg, pflag.NewFlagSet("test", pflag.ContinueOnError), nil)
+		if err == nil || !strings.Contains(err.Error(), "line 1") {
+			t.Errorf("expected error pointing at %s, got %v", name, err)
+		}
+	}
+}
+
+func TestControllerCfgValidate(t *testing.T) {
+	cfg := ControllerCfg{
+		Endpoint:   "unix:///tmp/csi.sock",
+		CreateCmd:  "echo",
+		TLS:        TLSConfig{CertFile: "tls.crt"},
+		Parameters: map[string]ParameterSchema{"quota": {Type: "number"}},
+	}
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected validation error")
+	}
+	for _, field := range []string{"deleteCmd", "tls: ", "parameters.quota.type"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("expected error to name %s, got %v", field, err)
+		}
+	}
+}
+
+func TestValidateParameters(t *testing.T) {
+	schemas := map[string]ParameterSchema{
+		"quota":       {Type: PARAM_TYPE_INT, Required: true},
+		"compression": {Enum: []string{"lz4", "zstd"}},
+	}
+	cases := []struct {
+		params map[string]string
+		valid  bool
+	}{
+		{map[string]string{"quota": "10"}, true},
+		{map[string]string{"quota": "10", "compression": "zstd", "other": "x"}, true},
+		{map[string]string{}, false},
+		{map[string]string{"quota": "ten"}, false},
+		{map[string]string{"quota": "10", "compression": "gzip"}, false},
+	}
+	for _, c := range cases {
+		err := validateParameters(schemas, c.params)
+		if (err == nil) != c.valid {
+			t.Errorf("validateParameters(%v) = %v, expected valid=%v", c.params, err, c.valid)
+		}
+	}
+}
+
+func TestCreateVolumeParameterSchema(t *testing.T) {
+	driver := newTestDriver()
+	driver.config.Parameters = map[string]ParameterSchema{"quota": {Type: PARAM_TYPE_INT}}
+	_, err := driver.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:       "test-volume",
+		Parameters: map[string]string{"quota": "big"},
+	})
+	if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "quota") {
+		t.Fatalf("expected InvalidArgument naming the parameter, got %v", err)
+	}
+}
@@ -2,27 +2,54 @@ package pkg
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type ControllerCfg struct {
-	Endpoint          string
-	CreateCmd         string
-	DeleteCmd         string
-	ExpandCmd         string
-	CreateSnapshotCmd string
-	DeleteSnapshotCmd string
-	SSHConfig         SshExecuter
+	Endpoint          string      `yaml:"endpoint"`
+	CreateCmd         string      `yaml:"createCmd"`
+	DeleteCmd         string      `yaml:"deleteCmd"`
+	ExpandCmd         string      `yaml:"expandCmd"`
+	CreateSnapshotCmd string      `yaml:"createSnapshotCmd"`
+	DeleteSnapshotCmd string      `yaml:"deleteSnapshotCmd"`
+	ListSnapshotsCmd  string      `yaml:"listSnapshotsCmd"`
+	SSHConfig         SshExecuter `yaml:"ssh"`
+	// HooksDir holds <operation>.sh scripts for the hooks not set above
+	HooksDir string `yaml:"hooksDir"`
+	// DispatcherCmd runs the operations without a hook of their own
+	DispatcherCmd string `yaml:"dispatcherCmd"`
+	// Backend is a built-in backend running the operations without a hook
+	Backend       string            `yaml:"backend"`
+	BackendConfig map[string]string `yaml:"backendConfig"`
+	// Exports, when managed, exports every volume on its own
+	Exports ExportsConfig `yaml:"exports"`
+	// HookSecrets lists the request secrets each hook gets, by operation
+	HookSecrets map[string][]string `yaml:"hookSecrets"`
+	// ProbeCmd is run on the storage server by Probe, empty disables the check
+	ProbeCmd      string        `yaml:"probeCmd"`
+	ProbeTimeout  time.Duration `yaml:"probeTimeout"`
+	ProbeCacheTTL time.Duration `yaml:"probeCacheTTL"`
+	// DrainTimeout is how long running hooks may finish on shutdown
+	DrainTimeout time.Duration `yaml:"drainTimeout"`
+	// TLS secures a tcp Endpoint
+	TLS TLSConfig `yaml:"tls"`
+	// Capacity rounds and limits the capacity of volumes
+	Capacity CapacityConfig `yaml:"capacity"`
+	// Parameters validates the StorageClass parameters of CreateVolume
+	Parameters map[string]ParameterSchema `yaml:"parameters"`
 }
 
 type SshController struct {
@@ -31,26 +58,87 @@ type SshController struct {
 	config   ControllerCfg
 	executer Executer
 	server   *GrpcServer
+	hooks    *HookLoader
+	// backend, if set, runs the operations without a configured hook
+	backend Backend
+	// exports is set when the exports are managed
+	exports *exportManager
+	// dispatcher is set when a dispatcher hook is configured
+	dispatcher *dispatcher
+	// recorder, if set, keeps the responses of the operations for the operator
+	recorder *hookRecorder
 }
 
 func NewController(config ControllerCfg) *SshController {
-	server, err := NewGrpcServer(config.Endpoint)
+	server, err := NewGrpcServer(config.Endpoint, config.TLS)
 	if err != nil {
 		log.Fatalf("failed to create gRPC server: %v", err)
 	}
 
-	return &SshController{
+	d := &SshController{
 		config:   config,
 		server:   server,
 		executer: &config.SSHConfig,
+		hooks:    NewHookLoader(config.HooksDir),
 	}
+	if config.Backend != "" {
+		d.backend, err = NewBackend(config.Backend, config.BackendConfig)
+		if err != nil {
+			log.Fatalf("failed to create backend: %v", err)
+		}
+	}
+	if config.Exports.Managed {
+		d.exports = &exportManager{config: config.Exports}
+	}
+	if config.DispatcherCmd != "" {
+		d.dispatcher = newDispatcher(config.DispatcherCmd, d.hooks)
+	}
+	if config.ProbeCmd != "" {
+		d.prober = NewProber(func(ctx context.Context) error {
+			probe, err := d.hooks.Load("probe", d.config.ProbeCmd)
+			if err != nil {
+				return err
+			}
+			return executerProbe(d.executer, probe.Script)(ctx)
+		}, config.ProbeTimeout, config.ProbeCacheTTL)
+	}
+	return d
 }
 
 var _ csi.ControllerServer = &SshController{}
 
+// NewOfflineController returns a controller that runs hooks for the command
+// line tools without listening on the endpoint. With local the hooks run in a
+// local shell instead of over SSH.
+func NewOfflineController(config ControllerCfg, local bool) *SshController {
+	d := &SshController{
+		config:   config,
+		executer: &config.SSHConfig,
+		hooks:    NewHookLoader(config.HooksDir),
+	}
+	if config.Backend != "" {
+		var err error
+		d.backend, err = NewBackend(config.Backend, config.BackendConfig)
+		if err != nil {
+			log.Fatalf("failed to create backend: %v", err)
+		}
+	}
+	if config.Exports.Managed {
+		d.exports = &exportManager{config: config.Exports}
+	}
+	if local {
+		d.executer = &LocalExecuter{}
+	}
+	if config.DispatcherCmd != "" {
+		d.dispatcher = newDispatcher(config.DispatcherCmd, d.hooks)
+	}
+	return d
+}
+
 func (d *SshController) Run() error {
 	csi.RegisterIdentityServer(d.server.server, d)
 	csi.RegisterControllerServer(d.server.server, d)
+	d.server.DrainTimeout = d.config.DrainTimeout
 
 	slog.Info("Starting NFS Controller CSI driver", "name", DriverName, "version", DriverVersion, "endpoint", d.config.Endpoint)
 
@@ -74,19 +162,46 @@ func varToEnvName(name string) string {
 }
 
 func (d *SshController) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
-	slog.InfoContext(ctx, "CreateVolume called", "name", req.GetName(), "capacity", req.GetCapacityRange().GetRequiredBytes())
+	Logger(ctx).Info("CreateVolume called", "name", req.GetName(), "capacity", req.GetCapacityRange().GetRequiredBytes())
 	volumeID := req.GetName()
 	if volumeID == "" {
 		return nil, status.Error(codes.InvalidArgument, "Volume name is required")
 	}
-	slog.Info("Creating volume", "volumeID", volumeID)
+	Logger(ctx).Info("Creating volume", "volumeID", volumeID)
+	if timeout := req.GetParameters()[MOUNT_TIMEOUT_KEY]; timeout != "" {
+		if dur, err := time.ParseDuration(timeout); err != nil || dur <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s %q", MOUNT_TIMEOUT_KEY, timeout)
+		}
+	}
+	mountGroup := -1
+	if group := req.GetParameters()[MOUNT_GROUP_KEY]; group != "" {
+		gid, err := strconv.Atoi(group)
+		if err != nil || gid < 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s %q", MOUNT_GROUP_KEY, group)
+		}
+		mountGroup = gid
+	}
+	if err := validateParameters(d.config.Parameters, req.GetParameters()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	limits, err := d.capacityLimits(ctx, OP_CREATE_VOLUME, req.GetParameters())
+	if err != nil {
+		return nil, err
+	}
+	requested, err := limits.fit(req.GetCapacityRange())
+	if err != nil {
+		return nil, err
+	}
+	volumeMode := volumeModeOf(req.GetVolumeCapabilities())
 	env := map[string]string{
 		CSI_REQ_VOLUME_ID:      volumeID,
-		CSI_REQ_CAPACITY_BYTES: strconv.FormatInt(req.GetCapacityRange().GetRequiredBytes(), 10),
+		CSI_REQ_CAPACITY_BYTES: strconv.FormatInt(requested, 10),
+		CSI_REQ_VOLUME_MODE:    volumeMode,
 	}
 	for k, v := range req.GetParameters() {
 		env[CSI_REQ_PARAM_PREFIX+varToEnvName(k)] = v
 	}
+	addCreateVolumeEnv(env, req)
 	if req.GetVolumeContentSource() != nil {
 		vs := req.VolumeContentSource
 		switch vs.Type.(type) {
@@ -108,43 +223,91 @@ func (d *SshController) CreateVolume(ctx context.Context, req *csi.CreateVolumeR
 			return nil, status.Errorf(codes.InvalidArgument, "%v not a proper volume source", vs)
 		}
 	}
-	slog.WarnContext(ctx, "Executing CreateVolume CMD", "req_id", volumeID)
-	stdout, err := d.executer.ExecuteCommand(d.config.CreateCmd, env)
+	Logger(ctx).Warn("Executing CreateVolume CMD", "req_id", volumeID)
+	stdout, err := d.runHook(ctx, OP_CREATE_VOLUME, env, req.GetSecrets())
 
 	if err != nil {
-		slog.ErrorContext(ctx, "Create volume script failed", "id", volumeID, "err", err, "output", string(stdout))
+		Logger(ctx).Error("Create volume script failed", "id", volumeID, "err", err, "output", redactor.RedactValues(string(stdout), env))
 		return nil, status.Errorf(codes.Internal, "Failed to create volume: %s", err)
 	}
-	shell_out, err := parseShellResponse(stdout)
+	shell_out, err := parseHookOutput(ctx, stdout)
+	if err != nil {
+		Logger(ctx).Error("Failed to parse create script output", "id", volumeID, "err", err)
+		return nil, status.Errorf(codes.Internal, "Failed to parse create script output: %s", err)
+	}
 	resVolumeID := PopKey(shell_out, CSI_REP_VOLUME_ID)
 	if resVolumeID == "" {
 		return nil, status.Errorf(codes.Internal, "Create script did not return volume_id")
 	}
-	slog.WarnContext(ctx, "Volume created successfully", "req_id", volumeID, "resp_id", resVolumeID)
+	Logger(ctx).Warn("Volume created successfully", "req_id", volumeID, "resp_id", resVolumeID)
 	capacity_str := PopKey(shell_out, CSI_REP_CAPACITY_BYTES)
 	capacity, err := strconv.ParseInt(capacity_str, 10, 64)
 	if err != nil {
-		slog.ErrorContext(ctx, "Failed to parse capacity bytes", "id", volumeID, "err", err)
+		Logger(ctx).Error("Failed to parse capacity bytes", "id", volumeID, "err", err)
 		return nil, status.Errorf(codes.Internal, "Failed to parse capacity bytes: %s", err)
 	}
+	if capacity, err = limits.check(capacity, req.GetCapacityRange()); err != nil {
+		Logger(ctx).Error("Create script returned a capacity out of range", "id", volumeID, "err", err)
+		return nil, err
+	}
 
 	serverName := PopKey(shell_out, NFS_SHARE_SERVER_KEY)
 	serverPath := PopKey(shell_out, NFS_SHARE_PATH_KEY)
+	exportPath := PopKey(shell_out, EXPORT_PATH_KEY)
+	// nfs_path may be relative to the NFSv4 root, only a hook without it is
+	// mounted at the path it exports
+	if d.exports != nil && serverPath == "" {
+		serverPath = exportPath
+	}
 	if serverName == "" || serverPath == "" {
 		return nil, status.Errorf(codes.Internal, "Create script did not return nfs share information")
 	}
+	if exportPath == "" {
+		exportPath = serverPath
+	}
+	if mountGroup >= 0 {
+		executer, err := d.executerFor(req.GetSecrets())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err := assignMountGroup(ctx, executer, exportPath, mountGroup); err != nil {
+			Logger(ctx).Error("Failed to assign the mount group", "id", resVolumeID, "path", exportPath, "err", err)
+			return nil, status.Errorf(codes.Internal, "Failed to assign the mount group: %s", err)
+		}
+	}
+	if d.exports != nil {
+		executer, err := d.executerFor(req.GetSecrets())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err := d.exports.Export(ctx, executer, resVolumeID, exportPath, req.GetParameters()); err != nil {
+			Logger(ctx).Error("Failed to export volume", "id", resVolumeID, "path", exportPath, "err", err)
+			return nil, status.Errorf(codes.Internal, "Failed to export volume: %s", err)
+		}
+	}
+	volumeContext := map[string]string{
+		NFS_SHARE_SERVER_KEY: serverName,
+		NFS_SHARE_PATH_KEY:   serverPath,
+	}
+	if timeout := req.GetParameters()[MOUNT_TIMEOUT_KEY]; timeout != "" {
+		volumeContext[MOUNT_TIMEOUT_KEY] = timeout
+	}
+	if volumeMode == VOLUME_MODE_BLOCK {
+		image := PopKey(shell_out, BLOCK_IMAGE_KEY)
+		if image == "" {
+			return nil, status.Errorf(codes.Internal, "Create script did not return %s for block volume", BLOCK_IMAGE_KEY)
+		}
+		volumeContext[BLOCK_IMAGE_KEY] = image
+	}
 	contentSource := req.GetVolumeContentSource()
 	if PopKey(shell_out, CSI_REP_DATA_SOURCE) == "" {
 		contentSource = nil
 	}
-	slog.InfoContext(ctx, "CreateVolume response", "volumeID", resVolumeID, "capacity", capacity)
+	Logger(ctx).Info("CreateVolume response", "volumeID", resVolumeID, "capacity", capacity)
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId: CSI_VOLUME_ID_PREFIX + resVolumeID,
-			VolumeContext: map[string]string{
-				NFS_SHARE_SERVER_KEY: serverName,
-				NFS_SHARE_PATH_KEY:   serverPath,
-			},
+			VolumeId:      CSI_VOLUME_ID_PREFIX + resVolumeID,
+			VolumeContext: volumeContext,
 			CapacityBytes: int64(capacity),
 			ContentSource: contentSource,
 		},
@@ -165,16 +328,27 @@ func parseShellResponse(stdout []byte) (map[string]string, error) {
 	resp := make(map[string]string)
 	for _, line := range lines {
 		if after, ok := strings.CutPrefix(line, CSI_SHELL_OUTPUT_PREFIX); ok {
-			line = after
-			vals := strings.SplitN(line, "=", 2)
-			resp[vals[0]] = vals[1]
+			key, value, ok := strings.Cut(after, "=")
+			if !ok {
+				return resp, fmt.Errorf("malformed hook output line %q, expected %skey=value", line, CSI_SHELL_OUTPUT_PREFIX)
+			}
+			resp[key] = value
 		}
 	}
 	return resp, nil
 }
 
+// parseHookOutput parses the hook response within its own span.
+func parseHookOutput(ctx context.Context, stdout []byte) (map[string]string, error) {
+	_, span := tracer.Start(ctx, "hook.parse_output")
+	resp, err := parseShellResponse(stdout)
+	span.SetAttributes(attribute.Int("hook.output_keys", len(resp)))
+	endSpan(span, err)
+	return resp, err
+}
+
 func (d *SshController) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
-	slog.InfoContext(ctx, "DeleteVolume called", "req_volume_id", req.GetVolumeId())
+	Logger(ctx).Info("DeleteVolume called", "req_volume_id", req.GetVolumeId())
 	volumeID, err := trimVolumeID(req.GetVolumeId())
 	if err != nil {
 		return nil, err
@@ -182,13 +356,26 @@ func (d *SshController) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeR
 	env := map[string]string{
 		CSI_REQ_VOLUME_ID: volumeID,
 	}
-	slog.InfoContext(ctx, "Exec Deleting Volume CMD", "volumeID", volumeID)
-	stdout, err := d.executer.ExecuteCommand(d.config.DeleteCmd, env)
+	if d.exports != nil {
+		executer, err := d.executerFor(req.GetSecrets())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err := d.exports.Unexport(ctx, executer, volumeID); err != nil {
+			Logger(ctx).Error("Failed to unexport volume", "id", volumeID, "err", err)
+			return nil, status.Errorf(codes.Internal, "Failed to unexport volume: %s", err)
+		}
+	}
+	Logger(ctx).Info("Exec Deleting Volume CMD", "volumeID", volumeID)
+	stdout, err := d.runHook(ctx, OP_DELETE_VOLUME, env, req.GetSecrets())
+	if errors.Is(err, errHasDependents) {
+		return nil, status.Errorf(codes.FailedPrecondition, "Failed to delete volume: %s", err)
+	}
 	if err != nil {
-		log.Printf("Delete volume script failed for %s: %s, output: %s", volumeID, err, string(stdout))
+		Logger(ctx).Error("Delete volume script failed", "id", volumeID, "err", err, "output", redactor.RedactValues(string(stdout), env))
 		return nil, status.Errorf(codes.Internal, "Failed to delete volume: %s", err)
 	}
-	slog.WarnContext(ctx, "Volume deleted successfully", "id", volumeID)
+	Logger(ctx).Warn("Volume deleted successfully", "id", volumeID)
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
@@ -214,34 +401,56 @@ func trimSnapshotID(snapshotID string) (string, error) {
 }
 
 func (d *SshController) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	slog.InfoContext(ctx, "ControllerExpandVolume called", "req_volume_id", req.GetVolumeId())
+	Logger(ctx).Info("ControllerExpandVolume called", "req_volume_id", req.GetVolumeId())
 	volumeID, err := trimVolumeID(req.GetVolumeId())
 	if err != nil {
 		return nil, err
 	}
+	volumeMode := VOLUME_MODE_FILESYSTEM
+	if req.GetVolumeCapability() != nil {
+		volumeMode = volumeModeOf([]*csi.VolumeCapability{req.GetVolumeCapability()})
+	}
+	limits, err := d.capacityLimits(ctx, OP_EXPAND_VOLUME, nil)
+	if err != nil {
+		return nil, err
+	}
+	requested, err := limits.fit(req.GetCapacityRange())
+	if err != nil {
+		return nil, err
+	}
 	env := map[string]string{
 		CSI_REQ_VOLUME_ID:      volumeID,
-		CSI_REQ_CAPACITY_BYTES: fmt.Sprintf("%d", req.GetCapacityRange().GetRequiredBytes()),
+		CSI_REQ_CAPACITY_BYTES: strconv.FormatInt(requested, 10),
+		CSI_REQ_VOLUME_MODE:    volumeMode,
 	}
-	slog.InfoContext(ctx, "Exec Expanding Volume CMD", "volumeID", volumeID, "capacity", env[CSI_REQ_CAPACITY_BYTES])
-	shell_out, err := d.execCmd(ctx, d.config.ExpandCmd, env)
+	Logger(ctx).Info("Exec Expanding Volume CMD", "volumeID", volumeID, "capacity", env[CSI_REQ_CAPACITY_BYTES])
+	shell_out, err := d.execCmd(ctx, OP_EXPAND_VOLUME, env, req.GetSecrets())
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Failed to expand volume: %s", err)
 	}
 	capacity_str := PopKey(shell_out, CSI_REP_CAPACITY_BYTES)
 	capacity, err := strconv.ParseInt(capacity_str, 10, 64)
 	if err != nil {
-		slog.ErrorContext(ctx, "Failed to parse capacity bytes", "id", volumeID, "err", err)
+		Logger(ctx).Error("Failed to parse capacity bytes", "id", volumeID, "err", err)
 		return nil, status.Errorf(codes.Internal, "Failed to parse capacity bytes: %s", err)
 	}
-	slog.InfoContext(ctx, "Volume expanded successfully", "volumeID", volumeID, "capacity", capacity)
+	if capacity, err = limits.check(capacity, req.GetCapacityRange()); err != nil {
+		Logger(ctx).Error("Expand script returned a capacity out of range", "id", volumeID, "err", err)
+		return nil, err
+	}
+	if capacity == 0 {
+		// unlike create, CSI requires the capacity after an expansion
+		return nil, status.Error(codes.Internal, "Expand script did not report the capacity of the volume")
+	}
+	Logger(ctx).Info("Volume expanded successfully", "volumeID", volumeID, "capacity", capacity)
 	return &csi.ControllerExpandVolumeResponse{
-		CapacityBytes: capacity,
+		CapacityBytes:         capacity,
+		NodeExpansionRequired: volumeMode == VOLUME_MODE_BLOCK,
 	}, nil
 }
 
 func (d *SshController) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
-	slog.InfoContext(ctx, "ValidateVolumeCapabilities called", "volume_id", req.GetVolumeId())
+	Logger(ctx).Info("ValidateVolumeCapabilities called", "volume_id", req.GetVolumeId())
 	return &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
 			VolumeCapabilities: req.GetVolumeCapabilities(),
@@ -249,13 +458,116 @@ func (d *SshController) ValidateVolumeCapabilities(ctx context.Context, req *csi
 	}, nil
 }
 
-func (d *SshController) execCmd(ctx context.Context, cmd string, env map[string]string) (map[string]string, error) {
-	stdout, err := d.executer.ExecuteCommand(cmd, env)
+// assignMountGroup gives the volume root on the server to gid and sets the
+// setgid bit, so new files inherit the group. The node can not do it through
+// an export squashing root.
+func assignMountGroup(ctx context.Context, executer Executer, path string, gid int) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("can not assign the group of %q, the create script must print an absolute %s or %s", path, EXPORT_PATH_KEY, NFS_SHARE_PATH_KEY)
+	}
+	_, err := runCommand(ctx, executer, shellCommand("chgrp", strconv.Itoa(gid), path)+" && "+shellCommand("chmod", "g+rwxs", path))
+	return err
+}
+
+// configuredHook returns the configured script or file reference of an operation.
+func (d *SshController) configuredHook(operation string) string {
+	switch operation {
+	case OP_CREATE_VOLUME:
+		return d.config.CreateCmd
+	case OP_DELETE_VOLUME:
+		return d.config.DeleteCmd
+	case OP_EXPAND_VOLUME:
+		return d.config.ExpandCmd
+	case OP_CREATE_SNAPSHOT:
+		return d.config.CreateSnapshotCmd
+	case OP_DELETE_SNAPSHOT:
+		return d.config.DeleteSnapshotCmd
+	case OP_LIST_SNAPSHOTS:
+		return d.config.ListSnapshotsCmd
+	}
+	return ""
+}
+
+func (d *SshController) hasHook(ctx context.Context, operation string) bool {
+	if d.hooks.Has(operation, d.configuredHook(operation)) {
+		return true
+	}
+	// a failed handshake is reported when the operation runs
+	if dispatched, err := d.dispatches(ctx, operation, d.executer); dispatched || err != nil {
+		return true
+	}
+	return d.backendRuns(ctx, operation)
+}
+
+// backendRuns reports whether the backend runs the operation, a configured
+// hook or the dispatcher take precedence.
+func (d *SshController) backendRuns(ctx context.Context, operation string) bool {
+	if d.backend == nil || !d.backend.Supports(operation) || d.hooks.Has(operation, d.configuredHook(operation)) {
+		return false
+	}
+	dispatched, err := d.dispatches(ctx, operation, d.executer)
+	return !dispatched && err == nil
+}
+
+// runHook executes the hook of an operation and records its duration and exit
+// code. secrets are the secrets of the request, which may choose the server.
+func (d *SshController) runHook(ctx context.Context, operation string, env map[string]string, secrets map[string]string) (stdout []byte, err error) {
+	ctx, span := tracer.Start(ctx, "hook."+operation)
+	defer func() { endSpan(span, err) }()
+	if id := traceID(ctx); id != "" {
+		env[CSI_REQ_TRACE_ID] = id
+	}
+	executer, err := d.executerFor(secrets)
 	if err != nil {
-		slog.ErrorContext(ctx, "Failed to execute command", "cmd", cmd, "err", err, "output", string(stdout))
-		return nil, fmt.Errorf("failed to execute command %q: %w", cmd, err)
+		return nil, err
+	}
+	// a due handshake runs on the server of the request
+	if _, err := d.dispatches(ctx, operation, executer); err != nil {
+		return nil, err
+	}
+	if d.backendRuns(ctx, operation) {
+		span.SetAttributes(attribute.String("hook.backend", d.backend.Name()))
+		Logger(ctx).Info("Running backend", "operation", operation, "backend", d.backend.Name())
+		start := time.Now()
+		stdout, err = d.backend.Run(ctx, executer, operation, env)
+		observeHook(operation, executerTarget(executer), start, err)
+		if err == nil {
+			d.recorder.record(operation, stdout)
+		}
+		return stdout, redactor.RedactError(err, env)
+	}
+	hook, err := d.loadHook(ctx, operation, executer)
+	if err != nil {
+		return nil, err
+	}
+	env[CSI_REQ_OPERATION] = operation
+	span.SetAttributes(attribute.String("hook.source", hook.String()), attribute.String("hook.hash", hook.Hash))
+	Logger(ctx).Info("Running hook", "operation", operation, "hook", hook.String(), "hook_hash", hook.Hash)
+	secretEnv := d.hookSecretEnv(operation, secrets)
+	start := time.Now()
+	if len(secretEnv) == 0 {
+		stdout, err = executer.ExecuteCommand(ctx, hook.Script, env)
+	} else if se, ok := executer.(secretExecuter); ok {
+		stdout, err = se.ExecuteCommandWithSecrets(ctx, hook.Script, env, secretEnv)
+	} else {
+		err = fmt.Errorf("%s can not pass secrets to hooks", executerTarget(executer))
+	}
+	observeHook(operation, executerTarget(executer), start, err)
+	// hooks may print their secrets, mask them before the output is logged
+	stdout = []byte(redactor.RedactValues(string(stdout), secretEnv))
+	if err == nil {
+		d.recorder.record(operation, stdout)
 	}
-	return parseShellResponse(stdout)
+	return stdout, redactor.RedactError(redactor.RedactError(err, env), secretEnv)
+}
+
+func (d *SshController) execCmd(ctx context.Context, operation string, env map[string]string, secrets map[string]string) (map[string]string, error) {
+	stdout, err := d.runHook(ctx, operation, env, secrets)
+	if err != nil {
+		Logger(ctx).Error("Failed to execute hook", "operation", operation, "err", err, "output", redactor.RedactValues(string(stdout), env))
+		return nil, fmt.Errorf("failed to execute %s hook: %w", operation, err)
+	}
+	return parseHookOutput(ctx, stdout)
 }
 
 func popCapacityFromShellOutput(shell_out map[string]string) (int64, error) {
@@ -272,8 +584,8 @@ func popCapacityFromShellOutput(shell_out map[string]string) (int64, error) {
 
 // create snapshot
 func (d *SshController) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	slog.InfoContext(ctx, "CreateSnapshot called", "name", req.GetName(), "source_volume_id", req.GetSourceVolumeId())
-	if d.config.CreateSnapshotCmd == "" {
+	Logger(ctx).Info("CreateSnapshot called", "name", req.GetName(), "source_volume_id", req.GetSourceVolumeId())
+	if !d.hasHook(ctx, OP_CREATE_SNAPSHOT) {
 		return nil, status.Error(codes.Unimplemented, "CreateSnapshot command is not configured")
 	}
 	if req.GetName() == "" {
@@ -287,7 +599,7 @@ func (d *SshController) CreateSnapshot(ctx context.Context, req *csi.CreateSnaps
 		CSI_REQ_SNAPSHOT_NAME: req.GetName(),
 		CSI_REQ_SRC_VOLUME_ID: volumeID,
 	}
-	result, err := d.execCmd(ctx, d.config.CreateSnapshotCmd, env)
+	result, err := d.execCmd(ctx, OP_CREATE_SNAPSHOT, env, req.GetSecrets())
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Failed to exec cmd %s", err)
 	}
@@ -300,7 +612,7 @@ func (d *SshController) CreateSnapshot(ctx context.Context, req *csi.CreateSnaps
 		return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to parse snapshot capacity: %s", err))
 	}
 
-	slog.InfoContext(ctx, "Snapshot created successfully", "snapshot_id", snap_id, "source_volume_id", volumeID, "capacity", capacity)
+	Logger(ctx).Info("Snapshot created successfully", "snapshot_id", snap_id, "source_volume_id", volumeID, "capacity", capacity)
 	return &csi.CreateSnapshotResponse{
 		Snapshot: &csi.Snapshot{
 			SnapshotId:     CSI_SNAPSHOT_ID_PREFIX + snap_id,
@@ -313,8 +625,8 @@ func (d *SshController) CreateSnapshot(ctx context.Context, req *csi.CreateSnaps
 }
 
 func (d *SshController) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	slog.InfoContext(ctx, "DeleteSnapshot called", "snapshot_id", req.GetSnapshotId())
-	if d.config.DeleteSnapshotCmd == "" {
+	Logger(ctx).Info("DeleteSnapshot called", "snapshot_id", req.GetSnapshotId())
+	if !d.hasHook(ctx, OP_DELETE_SNAPSHOT) {
 		return nil, status.Error(codes.Unimplemented, "DeleteSnapshot command is not configured")
 	}
 	snapshotID, err := trimSnapshotID(req.GetSnapshotId())
@@ -324,39 +636,136 @@ func (d *SshController) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnaps
 	env := map[string]string{
 		CSI_REQ_SNAPSHOT_ID: snapshotID,
 	}
-	slog.WarnContext(ctx, "Exec Deleting Snapshot CMD", "id", snapshotID)
-	result, err := d.execCmd(ctx, d.config.DeleteSnapshotCmd, env)
+	Logger(ctx).Warn("Exec Deleting Snapshot CMD", "id", snapshotID)
+	result, err := d.execCmd(ctx, OP_DELETE_SNAPSHOT, env, req.GetSecrets())
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Failed to exec cmd %s", err)
 	}
 	if PopKey(result, CSI_REP_SNAPSHOT_ID) != snapshotID {
 		return nil, status.Error(codes.Internal, "Failed to delete snapshot: returned snapshot ID is empty or does not match requested ID")
 	}
-	slog.InfoContext(ctx, "Snapshot deleted successfully", "snapshot_id", snapshotID)
+	Logger(ctx).Info("Snapshot deleted successfully", "snapshot_id", snapshotID)
 	return &csi.DeleteSnapshotResponse{}, nil
 }
 
+// parseSnapshotList parses the snapshot lines of the list hook, each one is
+// csi-shell-output:snapshot=snapshot_id=<id> source_volume_id=<id> capacity_bytes=<n>
+func parseSnapshotList(stdout []byte) ([]*csi.Snapshot, error) {
+	var snapshots []*csi.Snapshot
+	for _, line := range strings.Split(string(stdout), "\n") {
+		fields, ok := strings.CutPrefix(line, CSI_SHELL_OUTPUT_PREFIX+CSI_REP_SNAPSHOT+"=")
+		if !ok {
+			continue
+		}
+		values := map[string]string{}
+		for _, field := range strings.Fields(fields) {
+			key, value, _ := strings.Cut(field, "=")
+			values[key] = value
+		}
+		if values[CSI_REP_SNAPSHOT_ID] == "" || values[CSI_REP_SRC_VOLUME_ID] == "" {
+			return nil, fmt.Errorf("malformed snapshot line %q, %s and %s are required", line, CSI_REP_SNAPSHOT_ID, CSI_REP_SRC_VOLUME_ID)
+		}
+		capacity, err := popCapacityFromShellOutput(values)
+		if err != nil {
+			return nil, fmt.Errorf("malformed snapshot line %q: %w", line, err)
+		}
+		snapshots = append(snapshots, &csi.Snapshot{
+			SnapshotId:     CSI_SNAPSHOT_ID_PREFIX + values[CSI_REP_SNAPSHOT_ID],
+			SourceVolumeId: CSI_VOLUME_ID_PREFIX + values[CSI_REP_SRC_VOLUME_ID],
+			SizeBytes:      capacity,
+			ReadyToUse:     true,
+		})
+	}
+	return snapshots, nil
+}
+
+func (d *SshController) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	Logger(ctx).Info("ListSnapshots called", "snapshot_id", req.GetSnapshotId(), "source_volume_id", req.GetSourceVolumeId())
+	if !d.hasHook(ctx, OP_LIST_SNAPSHOTS) {
+		return nil, status.Error(codes.Unimplemented, "ListSnapshots command is not configured")
+	}
+	env := map[string]string{}
+	if req.GetSnapshotId() != "" {
+		snapshotID, err := trimSnapshotID(req.GetSnapshotId())
+		if err != nil {
+			// a snapshot this driver did not create does not exist
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		env[CSI_REQ_SNAPSHOT_ID] = snapshotID
+	}
+	if req.GetSourceVolumeId() != "" {
+		volumeID, err := trimVolumeID(req.GetSourceVolumeId())
+		if err != nil {
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		env[CSI_REQ_SRC_VOLUME_ID] = volumeID
+	}
+	stdout, err := d.runHook(ctx, OP_LIST_SNAPSHOTS, env, req.GetSecrets())
+	if err != nil {
+		Logger(ctx).Error("List snapshots script failed", "err", err, "output", redactor.RedactValues(string(stdout), env))
+		return nil, status.Errorf(codes.Internal, "Failed to list snapshots: %s", err)
+	}
+	snapshots, err := parseSnapshotList(stdout)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to parse snapshot list: %s", err)
+	}
+	// the hook may ignore the filters
+	entries := make([]*csi.ListSnapshotsResponse_Entry, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		if req.GetSnapshotId() != "" && snapshot.SnapshotId != req.GetSnapshotId() {
+			continue
+		}
+		if req.GetSourceVolumeId() != "" && snapshot.SourceVolumeId != req.GetSourceVolumeId() {
+			continue
+		}
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: snapshot})
+	}
+
+	start := 0
+	if req.GetStartingToken() != "" {
+		start, err = strconv.Atoi(req.GetStartingToken())
+		if err != nil || start < 0 || start > len(entries) {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %q", req.GetStartingToken())
+		}
+	}
+	end := len(entries)
+	if maxEntries := int(req.GetMaxEntries()); maxEntries > 0 && start+maxEntries < end {
+		end = start + maxEntries
+	}
+	resp := &csi.ListSnapshotsResponse{Entries: entries[start:end]}
+	if end < len(entries) {
+		resp.NextToken = strconv.Itoa(end)
+	}
+	return resp, nil
+}
+
 func (d *SshController) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
-	slog.Info("ControllerGetCapabilities called")
-	cap := &csi.ControllerGetCapabilitiesResponse{
-		Capabilities: []*csi.ControllerServiceCapability{
-			{
-				Type: &csi.ControllerServiceCapability_Rpc{
-					Rpc: &csi.ControllerServiceCapability_RPC{
-						Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-					},
+	Logger(ctx).Info("ControllerGetCapabilities called")
+	// a failed handshake must not fail the startup of the sidecars, the
+	// operations of the last successful one or every operation are advertised
+	if d.dispatcher != nil {
+		if _, err := d.dispatcher.Operations(ctx, d.executer); err != nil {
+			Logger(ctx).Warn("Dispatcher handshake failed, advertising the last known capabilities", "err", err)
+		}
+	}
+	cap := &csi.ControllerGetCapabilitiesResponse{}
+	// clones are made by the create hook, a dispatcher may implement neither
+	if d.hasHook(ctx, OP_CREATE_VOLUME) && d.hasHook(ctx, OP_DELETE_VOLUME) {
+		cap.Capabilities = append(cap.Capabilities, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 				},
 			},
-			{
-				Type: &csi.ControllerServiceCapability_Rpc{
-					Rpc: &csi.ControllerServiceCapability_RPC{
-						Type: csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
-					},
+		}, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
 				},
 			},
-		},
+		})
 	}
-	if d.config.ExpandCmd != "" {
+	if d.hasHook(ctx, OP_EXPAND_VOLUME) {
 		cap.Capabilities = append(cap.Capabilities, &csi.ControllerServiceCapability{
 			Type: &csi.ControllerServiceCapability_Rpc{
 				Rpc: &csi.ControllerServiceCapability_RPC{
@@ -365,7 +774,7 @@ func (d *SshController) ControllerGetCapabilities(ctx context.Context, req *csi.
 			},
 		})
 	}
-	if d.config.CreateSnapshotCmd != "" {
+	if d.hasHook(ctx, OP_CREATE_SNAPSHOT) {
 		cap.Capabilities = append(cap.Capabilities, &csi.ControllerServiceCapability{
 			Type: &csi.ControllerServiceCapability_Rpc{
 				Rpc: &csi.ControllerServiceCapability_RPC{
@@ -374,5 +783,14 @@ func (d *SshController) ControllerGetCapabilities(ctx context.Context, req *csi.
 			},
 		})
 	}
+	if d.hasHook(ctx, OP_LIST_SNAPSHOTS) {
+		cap.Capabilities = append(cap.Capabilities, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+				},
+			},
+		})
+	}
 	return cap, nil
 }
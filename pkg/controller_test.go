@@ -2,9 +2,15 @@ package pkg
 
 import (
 	"context"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func newTestDriver() *SshController {
@@ -47,6 +53,25 @@ func TestCreateVolume(t *testing.T) {
 	}
 }
 
+func TestCreateBlockVolume(t *testing.T) {
+	driver := newTestDriver()
+	resp, err := driver.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name: "test-volume",
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 1024 * 1024 * 10, // 10 MB
+		},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	if resp.Volume.VolumeContext[BLOCK_IMAGE_KEY] != "disk.img" {
+		t.Errorf("Expected block image in volume context, got %v", resp.Volume.VolumeContext)
+	}
+}
+
 func TestDeleteVolume(t *testing.T) {
 	driver := newTestDriver()
 	_, err := driver.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{
@@ -113,3 +138,93 @@ func TestControllerGetCapabilities(t *testing.T) {
 		t.Fatal("Expected capabilities in response, got none")
 	}
 }
+
+func TestControllerProbe(t *testing.T) {
+	driver := newTestDriver()
+	driver.config.ProbeCmd = "exit 1"
+	driver.prober = NewProber(executerProbe(driver.executer, driver.config.ProbeCmd), time.Second, 0)
+	resp, err := driver.Probe(context.Background(), &csi.ProbeRequest{})
+	if err != nil {
+		t.Fatalf("Probe failed: %v", err)
+	}
+	if resp.GetReady().GetValue() {
+		t.Error("Expected not ready when the probe command fails")
+	}
+}
+
+func TestListSnapshots(t *testing.T) {
+	driver := newTestDriver()
+	driver.config.ListSnapshotsCmd = "sh ../test/list_snapshots.sh"
+
+	resp, err := driver.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SourceVolumeId: CSI_VOLUME_ID_PREFIX + "test-volume"})
+	if err != nil {
+		t.Fatalf("ListSnapshots failed: %v", err)
+	}
+	if len(resp.Entries) != 1 || resp.Entries[0].Snapshot.SnapshotId != CSI_SNAPSHOT_ID_PREFIX+"snapshot-1" || resp.Entries[0].Snapshot.SizeBytes != 1 {
+		t.Errorf("expected snapshot-1 of test-volume, got %v", resp.Entries)
+	}
+
+	page, err := driver.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{MaxEntries: 1})
+	if err != nil {
+		t.Fatalf("ListSnapshots failed: %v", err)
+	}
+	if len(page.Entries) != 1 || page.NextToken != "1" {
+		t.Fatalf("expected a page of one snapshot with next token, got %v", page)
+	}
+	page, err = driver.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{MaxEntries: 1, StartingToken: page.NextToken})
+	if err != nil {
+		t.Fatalf("ListSnapshots failed: %v", err)
+	}
+	if len(page.Entries) != 1 || page.Entries[0].Snapshot.SnapshotId != CSI_SNAPSHOT_ID_PREFIX+"snapshot-2" || page.NextToken != "" {
+		t.Errorf("expected the last snapshot, got %v", page)
+	}
+
+	missing, err := driver.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SnapshotId: "unknown"})
+	if err != nil || len(missing.Entries) != 0 {
+		t.Errorf("expected no snapshot for a foreign ID, got %v, %v", missing, err)
+	}
+}
+
+func TestCreateVolumeMalformedOutput(t *testing.T) {
+	driver := NewOfflineController(ControllerCfg{CreateCmd: `echo "csi-shell-output:volume_id"`}, true)
+	_, err := driver.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "pvc-1",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024},
+	})
+	if status.Code(err) != codes.Internal || !strings.Contains(err.Error(), "parse") {
+		t.Errorf("expected the parse error, got %v", err)
+	}
+}
+
+func TestCreateVolumeMountGroup(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	driver := NewOfflineController(ControllerCfg{CreateCmd: `echo "csi-shell-output:volume_id=$CSI_VOLUME_ID"
+echo "csi-shell-output:capacity_bytes=$CSI_CAPACITY_BYTES"
+echo "csi-shell-output:nfs_server=127.0.0.1"
+echo "csi-shell-output:nfs_path=/pvc-1"
+echo "csi-shell-output:export_path=` + dir + `"`}, true)
+	create := func(group string) error {
+		_, err := driver.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:          "pvc-1",
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 1024},
+			Parameters:    map[string]string{MOUNT_GROUP_KEY: group},
+		})
+		return err
+	}
+	if err := create(strconv.Itoa(os.Getgid())); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSetgid == 0 || info.Mode().Perm() != 0770 {
+		t.Errorf("expected the export path to get setgid and group rwx, got %v", info.Mode())
+	}
+	if err := create("staff"); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("a non-numeric %s should be rejected, got %v", MOUNT_GROUP_KEY, err)
+	}
+}
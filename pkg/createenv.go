@@ -0,0 +1,97 @@
+package pkg
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// env of the create hook besides the name, capacity, parameters and data source
+const (
+	CSI_REQ_LIMIT_BYTES             = CSI_REQ_PREFIX + "LIMIT_BYTES"
+	CSI_REQ_ACCESS_MODES            = CSI_REQ_PREFIX + "ACCESS_MODES"
+	CSI_REQ_FS_TYPE                 = CSI_REQ_PREFIX + "FS_TYPE"
+	CSI_REQ_MOUNT_FLAGS             = CSI_REQ_PREFIX + "MOUNT_FLAGS"
+	CSI_REQ_PVC_NAME                = CSI_REQ_PREFIX + "PVC_NAME"
+	CSI_REQ_PVC_NAMESPACE           = CSI_REQ_PREFIX + "PVC_NAMESPACE"
+	CSI_REQ_PV_NAME                 = CSI_REQ_PREFIX + "PV_NAME"
+	CSI_REQ_TOPOLOGY_REQUISITE_JSON = CSI_REQ_PREFIX + "TOPOLOGY_REQUISITE_JSON"
+	CSI_REQ_TOPOLOGY_PREFERRED_JSON = CSI_REQ_PREFIX + "TOPOLOGY_PREFERRED_JSON"
+	CSI_REQ_PARAMETERS_JSON         = CSI_REQ_PREFIX + "PARAMETERS_JSON"
+	PARAM_PVC_NAME                  = "csi.storage.k8s.io/pvc/name"
+	PARAM_PVC_NAMESPACE             = "csi.storage.k8s.io/pvc/namespace"
+	PARAM_PV_NAME                   = "csi.storage.k8s.io/pv/name"
+)
+
+// addCreateVolumeEnv adds the rest of a CreateVolume request to the env of the
+// create hook:
+//   - CSI_LIMIT_BYTES, 0 when the volume has no limit
+//   - CSI_ACCESS_MODES, the CSI access modes, e.g. SINGLE_NODE_WRITER, comma separated
+//   - CSI_FS_TYPE and CSI_MOUNT_FLAGS (comma separated) of mount capabilities
+//   - CSI_PVC_NAME, CSI_PVC_NAMESPACE and CSI_PV_NAME when external-provisioner
+//     runs with --extra-create-metadata
+//   - CSI_TOPOLOGY_REQUISITE_JSON and CSI_TOPOLOGY_PREFERRED_JSON, the
+//     accessibility requirements as a JSON list of segments, [] if there are none
+//   - CSI_PARAMETERS_JSON, the parameters as a JSON object with the names that
+//     CSI_PARAM_<parameter> can not keep, such as zfs.com.example:tag
+func addCreateVolumeEnv(env map[string]string, req *csi.CreateVolumeRequest) {
+	env[CSI_REQ_LIMIT_BYTES] = strconv.FormatInt(req.GetCapacityRange().GetLimitBytes(), 10)
+
+	var modes, flags []string
+	fsType := ""
+	for _, c := range req.GetVolumeCapabilities() {
+		if mode := c.GetAccessMode().GetMode(); mode != csi.VolumeCapability_AccessMode_UNKNOWN && !slices.Contains(modes, mode.String()) {
+			modes = append(modes, mode.String())
+		}
+		if mount := c.GetMount(); mount != nil {
+			if fsType == "" {
+				fsType = mount.GetFsType()
+			}
+			for _, flag := range mount.GetMountFlags() {
+				if !slices.Contains(flags, flag) {
+					flags = append(flags, flag)
+				}
+			}
+		}
+	}
+	env[CSI_REQ_ACCESS_MODES] = strings.Join(modes, ",")
+	env[CSI_REQ_FS_TYPE] = fsType
+	env[CSI_REQ_MOUNT_FLAGS] = strings.Join(flags, ",")
+
+	for param, key := range map[string]string{
+		PARAM_PVC_NAME:      CSI_REQ_PVC_NAME,
+		PARAM_PVC_NAMESPACE: CSI_REQ_PVC_NAMESPACE,
+		PARAM_PV_NAME:       CSI_REQ_PV_NAME,
+	} {
+		if v := req.GetParameters()[param]; v != "" {
+			env[key] = v
+		}
+	}
+
+	env[CSI_REQ_TOPOLOGY_REQUISITE_JSON] = topologyJSON(req.GetAccessibilityRequirements().GetRequisite())
+	env[CSI_REQ_TOPOLOGY_PREFERRED_JSON] = topologyJSON(req.GetAccessibilityRequirements().GetPreferred())
+
+	params := req.GetParameters()
+	if params == nil {
+		params = map[string]string{}
+	}
+	out, _ := json.Marshal(params)
+	env[CSI_REQ_PARAMETERS_JSON] = string(out)
+}
+
+// topologyJSON renders topologies as a JSON list of their segments.
+func topologyJSON(topologies []*csi.Topology) string {
+	segments := make([]map[string]string, 0, len(topologies))
+	for _, t := range topologies {
+		segment := t.GetSegments()
+		if segment == nil {
+			segment = map[string]string{}
+		}
+		segments = append(segments, segment)
+	}
+	out, _ := json.Marshal(segments)
+	return string(out)
+}
@@ -0,0 +1,101 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestAddCreateVolumeEnv(t *testing.T) {
+	env := map[string]string{}
+	addCreateVolumeEnv(env, &csi.CreateVolumeRequest{
+		Name:          "pvc-1",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 20, LimitBytes: 2 << 20},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "nfs", MountFlags: []string{"nfsvers=4.1", "noatime"}}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+			},
+			{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"noatime", "hard"}}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+		},
+		Parameters: map[string]string{
+			PARAM_PVC_NAME:      "data",
+			PARAM_PVC_NAMESPACE: "team-a",
+			PARAM_PV_NAME:       "pvc-1",
+		},
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{{Segments: map[string]string{"topology.kubernetes.io/zone": "a"}}, {}},
+		},
+	})
+	expected := map[string]string{
+		CSI_REQ_LIMIT_BYTES:             "2097152",
+		CSI_REQ_ACCESS_MODES:            "MULTI_NODE_MULTI_WRITER,SINGLE_NODE_WRITER",
+		CSI_REQ_FS_TYPE:                 "nfs",
+		CSI_REQ_MOUNT_FLAGS:             "nfsvers=4.1,noatime,hard",
+		CSI_REQ_PVC_NAME:                "data",
+		CSI_REQ_PVC_NAMESPACE:           "team-a",
+		CSI_REQ_PV_NAME:                 "pvc-1",
+		CSI_REQ_TOPOLOGY_REQUISITE_JSON: `[{"topology.kubernetes.io/zone":"a"},{}]`,
+		CSI_REQ_TOPOLOGY_PREFERRED_JSON: `[]`,
+		CSI_REQ_PARAMETERS_JSON:         `{"csi.storage.k8s.io/pv/name":"pvc-1","csi.storage.k8s.io/pvc/name":"data","csi.storage.k8s.io/pvc/namespace":"team-a"}`,
+	}
+	for k, v := range expected {
+		if env[k] != v {
+			t.Errorf("expected %s=%q, got %q", k, v, env[k])
+		}
+	}
+	if len(env) != len(expected) {
+		t.Errorf("unexpected env %v", env)
+	}
+}
+
+func TestCreateVolumeContextEnv(t *testing.T) {
+	driver := NewOfflineController(ControllerCfg{
+		CreateCmd: `echo "csi-shell-output:volume_id=$CSI_PVC_NAMESPACE-$CSI_PVC_NAME"
+echo "csi-shell-output:capacity_bytes=$CSI_LIMIT_BYTES"
+echo "csi-shell-output:nfs_server=127.0.0.1"
+echo "csi-shell-output:nfs_path=/data/$CSI_ACCESS_MODES"`,
+	}, true)
+	resp, err := driver.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "pvc-1",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024, LimitBytes: 4096},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+		Parameters: map[string]string{PARAM_PVC_NAME: "data", PARAM_PVC_NAMESPACE: "team-a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Volume.VolumeId != CSI_VOLUME_ID_PREFIX+"team-a-data" || resp.Volume.CapacityBytes != 4096 ||
+		resp.Volume.VolumeContext[NFS_SHARE_PATH_KEY] != "/data/SINGLE_NODE_WRITER" {
+		t.Errorf("unexpected volume %+v", resp.Volume)
+	}
+}
+
+func TestCreateVolumeEnvVerbatim(t *testing.T) {
+	env := map[string]string{}
+	addCreateVolumeEnv(env, &csi.CreateVolumeRequest{
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"context=\"system_u:object_r\"", "a b;echo injected", "it's $HOME"}}},
+		}},
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{{Segments: map[string]string{"topology.kubernetes.io/zone": "a"}}, {}},
+			Preferred: []*csi.Topology{{Segments: map[string]string{"zone": "b c"}}},
+		},
+	})
+	for _, key := range []string{CSI_REQ_TOPOLOGY_REQUISITE_JSON, CSI_REQ_TOPOLOGY_PREFERRED_JSON, CSI_REQ_MOUNT_FLAGS} {
+		out, err := (&LocalExecuter{}).ExecuteCommand(context.Background(), `printf %s "$`+key+`"`, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != env[key] {
+			t.Errorf("%s: expected %q, the hook read %q", key, env[key], out)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// CSI_REQ_OPERATION tells a hook which operation it runs for
+	CSI_REQ_OPERATION = CSI_REQ_PREFIX + "OPERATION"
+	// OP_CAPABILITIES is the handshake asking the dispatcher for the
+	// operations it implements
+	OP_CAPABILITIES = "csi_capabilities"
+	// OP_DISPATCHER names the dispatcher hook in logs and the hook loader
+	OP_DISPATCHER      = "dispatcher"
+	CSI_REP_OPERATIONS = "operations"
+)
+
+// handshakeRetry is how long a failed handshake is returned before it runs
+// again, so that every request does not wait for a broken dispatcher.
+const handshakeRetry = 10 * time.Second
+
+// dispatcher is a single hook run for every operation without a hook of its
+// own, CSI_OPERATION tells them apart. Which operations it implements comes
+// from the csi_capabilities handshake, run again when the hook changes or
+// retry after it failed.
+type dispatcher struct {
+	configured string
+	hooks      *HookLoader
+	retry      time.Duration
+
+	mu   sync.Mutex
+	hash string
+	// operations are the ones of the last successful handshake, kept while a
+	// failed one waits for its retry
+	operations []string
+	lastErr    error
+	failed     time.Time
+	// running is closed when the handshake in flight ends
+	running chan struct{}
+}
+
+func newDispatcher(configured string, hooks *HookLoader) *dispatcher {
+	return &dispatcher{configured: configured, hooks: hooks, retry: handshakeRetry}
+}
+
+func (p *dispatcher) Load() (Hook, error) {
+	return p.hooks.Load(OP_DISPATCHER, p.configured)
+}
+
+// Operations returns the operations the dispatcher implements, as printed by
+// the handshake: csi-shell-output:operations=create_volume,delete_volume,...
+// The handshake runs through executer, once for concurrent callers. A failed
+// handshake returns its error with the operations of the last successful one.
+func (p *dispatcher) Operations(ctx context.Context, executer Executer) ([]string, error) {
+	hook, err := p.Load()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.mu.Lock()
+		if p.hash == hook.Hash && (p.lastErr == nil || time.Since(p.failed) < p.retry) {
+			operations, err := p.operations, p.lastErr
+			p.mu.Unlock()
+			return operations, err
+		}
+		running := p.running
+		if running == nil {
+			p.running = make(chan struct{})
+			p.mu.Unlock()
+			break
+		}
+		p.mu.Unlock()
+		select {
+		case <-running:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	operations, err := p.handshake(ctx, executer, hook)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	close(p.running)
+	p.running = nil
+	p.hash = hook.Hash
+	if err != nil {
+		p.lastErr, p.failed = err, time.Now()
+		return p.operations, err
+	}
+	p.operations, p.lastErr = operations, nil
+	return operations, nil
+}
+
+func (p *dispatcher) handshake(ctx context.Context, executer Executer, hook Hook) ([]string, error) {
+	out, err := executer.ExecuteCommand(ctx, hook.Script, map[string]string{CSI_REQ_OPERATION: OP_CAPABILITIES})
+	if err != nil {
+		return nil, fmt.Errorf("dispatcher %s handshake failed: %w, output: %s", OP_CAPABILITIES, err, strings.TrimSpace(string(out)))
+	}
+	output, err := parseShellResponse(out)
+	if err != nil {
+		return nil, fmt.Errorf("dispatcher %s handshake: %w", OP_CAPABILITIES, err)
+	}
+	var operations []string
+	for _, operation := range strings.Split(output[CSI_REP_OPERATIONS], ",") {
+		operation = strings.TrimSpace(operation)
+		if operation == "" {
+			continue
+		}
+		if _, ok := hookContracts[operation]; !ok {
+			slog.Warn("Dispatcher declares an unknown operation", "operation", operation, "hook_hash", hook.Hash)
+			continue
+		}
+		operations = append(operations, operation)
+	}
+	slices.Sort(operations)
+	slog.Info("Dispatcher capabilities", "operations", operations, "hook", hook.String(), "hook_hash", hook.Hash)
+	return operations, nil
+}
+
+// dispatches reports whether the dispatcher runs the operation, a hook
+// configured for the operation takes precedence. executer runs the handshake
+// when it is due, after a failed one the last known operations are used.
+func (d *SshController) dispatches(ctx context.Context, operation string, executer Executer) (bool, error) {
+	if d.dispatcher == nil || d.hooks.Has(operation, d.configuredHook(operation)) {
+		return false, nil
+	}
+	operations, err := d.dispatcher.Operations(ctx, executer)
+	if err != nil && operations == nil {
+		return false, err
+	}
+	return slices.Contains(operations, operation), nil
+}
+
+// loadHook returns the script run for an operation, its own hook or the
+// dispatcher.
+func (d *SshController) loadHook(ctx context.Context, operation string, executer Executer) (Hook, error) {
+	dispatched, err := d.dispatches(ctx, operation, executer)
+	if err != nil {
+		return Hook{}, err
+	}
+	if dispatched {
+		return d.dispatcher.Load()
+	}
+	return d.hooks.Load(operation, d.configuredHook(operation))
+}
@@ -0,0 +1,221 @@
+package pkg
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testDispatcher = `case "$CSI_OPERATION" in
+csi_capabilities) echo "csi-shell-output:operations=create_volume, delete_volume,expand_volume,resize_volume" ;;
+create_volume)
+	echo "csi-shell-output:volume_id=$CSI_VOLUME_ID"
+	echo "csi-shell-output:capacity_bytes=$CSI_CAPACITY_BYTES"
+	echo "csi-shell-output:nfs_server=127.0.0.1"
+	echo "csi-shell-output:nfs_path=/data/$CSI_VOLUME_ID" ;;
+expand_volume) echo "csi-shell-output:capacity_bytes=$CSI_CAPACITY_BYTES" ;;
+*) exit 1 ;;
+esac`
+
+func newDispatcherDriver(dispatcherCmd string) *SshController {
+	return NewOfflineController(ControllerCfg{DispatcherCmd: dispatcherCmd}, true)
+}
+
+func TestDispatcherHandshake(t *testing.T) {
+	driver := newDispatcherDriver(testDispatcher)
+	operations, err := driver.dispatcher.Operations(context.Background(), driver.executer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(operations, ",") != "create_volume,delete_volume,expand_volume" {
+		t.Errorf("unknown operations should be dropped, got %v", operations)
+	}
+
+	caps, err := driver.ControllerGetCapabilities(context.Background(), &csi.ControllerGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, c := range caps.Capabilities {
+		names = append(names, c.GetRpc().GetType().String())
+	}
+	if !slices.Contains(names, "EXPAND_VOLUME") || slices.Contains(names, "CREATE_DELETE_SNAPSHOT") {
+		t.Errorf("capabilities should follow the handshake, got %v", names)
+	}
+	if _, err := driver.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snap", SourceVolumeId: "v1:pvc-1"}); status.Code(err) != codes.Unimplemented {
+		t.Errorf("expected Unimplemented for an operation the dispatcher lacks, got %v", err)
+	}
+}
+
+func TestDispatcherRunsOperations(t *testing.T) {
+	driver := newDispatcherDriver(testDispatcher)
+	resp, err := driver.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "pvc-1",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Volume.VolumeId != CSI_VOLUME_ID_PREFIX+"pvc-1" || resp.Volume.VolumeContext[NFS_SHARE_PATH_KEY] != "/data/pvc-1" {
+		t.Errorf("unexpected volume %+v", resp.Volume)
+	}
+
+	// a hook of its own takes precedence over the dispatcher
+	driver.config.ExpandCmd = `echo "csi-shell-output:capacity_bytes=4096"`
+	expanded, err := driver.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      CSI_VOLUME_ID_PREFIX + "pvc-1",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 2048},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expanded.CapacityBytes != 4096 {
+		t.Errorf("expected the expand hook to run, got %d", expanded.CapacityBytes)
+	}
+}
+
+func TestDispatcherHandshakeReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dispatcher.sh")
+	writeHook(t, file, `echo "csi-shell-output:operations=create_volume"`, time.Now().Add(-time.Minute))
+	driver := newDispatcherDriver("@" + file)
+	if driver.hasHook(context.Background(), OP_CREATE_SNAPSHOT) {
+		t.Error("create_snapshot should not be dispatched")
+	}
+	writeHook(t, file, `echo "csi-shell-output:operations=create_volume,create_snapshot"`, time.Now())
+	if !driver.hasHook(context.Background(), OP_CREATE_SNAPSHOT) {
+		t.Error("the handshake should run again when the dispatcher changes")
+	}
+}
+
+func TestDispatcherHandshakeFailure(t *testing.T) {
+	driver := newDispatcherDriver("exit 3")
+	caps, err := driver.ControllerGetCapabilities(context.Background(), &csi.ControllerGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("a failed handshake should not fail the capabilities, got %v", err)
+	}
+	if len(caps.Capabilities) == 0 {
+		t.Error("without a successful handshake every operation should be advertised")
+	}
+	if _, err := driver.execCmd(context.Background(), OP_CREATE_VOLUME, map[string]string{}, nil); err == nil || !strings.Contains(err.Error(), OP_CAPABILITIES) {
+		t.Errorf("expected the handshake error, got %v", err)
+	}
+}
+
+func TestDispatcherVolumeCapabilities(t *testing.T) {
+	driver := newDispatcherDriver(`echo "csi-shell-output:operations=expand_volume"`)
+	caps, err := driver.ControllerGetCapabilities(context.Background(), &csi.ControllerGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, c := range caps.Capabilities {
+		names = append(names, c.GetRpc().GetType().String())
+	}
+	if strings.Join(names, ",") != "EXPAND_VOLUME" {
+		t.Errorf("a dispatcher without create_volume should not advertise volumes or clones, got %v", names)
+	}
+}
+
+func TestDispatcherHandshakeRetry(t *testing.T) {
+	driver := newDispatcherDriver("exit 3")
+	executer := (&scriptedExecuter{}).on("exit 3", "", errExit1)
+	for range 2 {
+		if _, err := driver.dispatcher.Operations(context.Background(), executer); err == nil {
+			t.Fatal("expected the handshake to fail")
+		}
+	}
+	if len(executer.commands) != 1 {
+		t.Errorf("a failed handshake should not run again before the retry period, ran %v", executer.commands)
+	}
+	driver.dispatcher.retry = 0
+	if _, err := driver.dispatcher.Operations(context.Background(), executer); err == nil || len(executer.commands) != 2 {
+		t.Errorf("the handshake should run again after the retry period, got %v, ran %v", err, executer.commands)
+	}
+}
+
+func TestDispatcherHandshakeLastKnown(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dispatcher.sh")
+	writeHook(t, file, `echo "csi-shell-output:operations=expand_volume"`, time.Now().Add(-time.Minute))
+	driver := newDispatcherDriver("@" + file)
+	if !driver.hasHook(context.Background(), OP_EXPAND_VOLUME) {
+		t.Fatal("expand_volume should be dispatched")
+	}
+	writeHook(t, file, `exit 3`, time.Now())
+	operations, err := driver.dispatcher.Operations(context.Background(), driver.executer)
+	if err == nil || strings.Join(operations, ",") != OP_EXPAND_VOLUME {
+		t.Errorf("a failed handshake should return the last known operations, got %v, %v", operations, err)
+	}
+	if dispatched, err := driver.dispatches(context.Background(), OP_EXPAND_VOLUME, driver.executer); !dispatched || err != nil {
+		t.Errorf("the last known operations should be dispatched, got %v, %v", dispatched, err)
+	}
+	if driver.hasHook(context.Background(), OP_CREATE_SNAPSHOT) {
+		t.Error("an operation the last handshake did not list should not be dispatched")
+	}
+}
+
+// blockingExecuter answers the handshake once release is closed.
+type blockingExecuter struct {
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (e *blockingExecuter) ExecuteCommand(ctx context.Context, cmd string, env map[string]string) ([]byte, error) {
+	e.calls.Add(1)
+	<-e.release
+	return []byte("csi-shell-output:operations=create_volume\n"), nil
+}
+
+func TestDispatcherHandshakeOnce(t *testing.T) {
+	driver := newDispatcherDriver(testDispatcher)
+	executer := &blockingExecuter{release: make(chan struct{})}
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if operations, err := driver.dispatcher.Operations(context.Background(), executer); err != nil || len(operations) != 1 {
+				t.Errorf("expected the operations of the handshake, got %v, %v", operations, err)
+			}
+		}()
+	}
+	for executer.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if !driver.dispatcher.mu.TryLock() {
+		t.Fatal("the handshake should not hold the lock")
+	}
+	driver.dispatcher.mu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := driver.dispatcher.Operations(ctx, executer); err == nil {
+		t.Error("a caller waiting for the handshake should give up with its context")
+	}
+	close(executer.release)
+	wg.Wait()
+	if calls := executer.calls.Load(); calls != 1 {
+		t.Errorf("concurrent callers should share one handshake, ran %d", calls)
+	}
+}
+
+func TestControllerCfgValidateDispatcher(t *testing.T) {
+	cfg := ControllerCfg{Endpoint: "unix:///tmp/csi.sock", DispatcherCmd: testDispatcher}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("a dispatcher should replace the required hooks, got %v", err)
+	}
+	cfg.DispatcherCmd = "@" + filepath.Join(t.TempDir(), "missing.sh")
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "dispatcherCmd") {
+		t.Errorf("expected a missing dispatcher file error, got %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// EXPORT_PATH_KEY is the directory on the storage server a create hook asks
+	// the driver to export, nfs_path is exported when it is not printed
+	EXPORT_PATH_KEY = "export_path"
+
+	// EXPORT_CLIENTS_KEY and EXPORT_OPTIONS_KEY are StorageClass parameters
+	// overriding the clients and options of the managed exports
+	EXPORT_CLIENTS_KEY = "exportClients"
+	EXPORT_OPTIONS_KEY = "exportOptions"
+)
+
+// ExportsConfig makes the controller write one exports(5) file per volume on
+// the storage server, so a volume is only visible to the clients it is
+// exported to instead of every client of a parent share.
+type ExportsConfig struct {
+	Managed bool `yaml:"managed"`
+	// Dir holds the csi-<volume>.exports files, read by exportfs -r
+	Dir string `yaml:"dir"`
+	// Clients are the hosts or networks a volume is exported to
+	Clients []string `yaml:"clients"`
+	// Options of every client, fsid= is derived from the volume ID when not set
+	Options string `yaml:"options"`
+}
+
+func (c ExportsConfig) Validate() error {
+	if !c.Managed {
+		return nil
+	}
+	if !filepath.IsAbs(c.Dir) {
+		return fmt.Errorf("dir (--exports-dir) must be an absolute path")
+	}
+	if len(c.Clients) == 0 {
+		return fmt.Errorf("clients (--export-clients) is required with managed exports")
+	}
+	if err := checkExportClients(c.Clients); err != nil {
+		return fmt.Errorf("clients: %w", err)
+	}
+	if err := checkExportOptions(c.Options); err != nil {
+		return fmt.Errorf("options: %w", err)
+	}
+	return nil
+}
+
+func checkExportClients(clients []string) error {
+	for _, client := range clients {
+		if client == "" || strings.ContainsAny(client, " \t\n\"()") {
+			return fmt.Errorf("invalid export client %q", client)
+		}
+	}
+	return nil
+}
+
+func checkExportOptions(options string) error {
+	if strings.ContainsAny(options, " \t\n\"()") {
+		return fmt.Errorf("invalid export options %q", options)
+	}
+	return nil
+}
+
+// exportManager adds and removes the exports of volumes, one at a time so
+// every exportfs -r sees a consistent set of files.
+type exportManager struct {
+	config ExportsConfig
+	mu     sync.Mutex
+}
+
+func (m *exportManager) file(volumeID string) string {
+	return m.config.Dir + "/csi-" + volumeID + ".exports"
+}
+
+// exportFsid derives the fsid of the export of a volume from its ID, so it is
+// stable across retries and restarts of the server.
+func exportFsid(volumeID string) string {
+	sum := sha256.Sum256([]byte(volumeID))
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// exportEntry renders the exports(5) line of path.
+func exportEntry(volumeID string, path string, clients []string, options string) string {
+	if !strings.Contains(","+options, ",fsid=") {
+		options = strings.TrimPrefix(options+",fsid="+exportFsid(volumeID), ",")
+	}
+	entries := make([]string, len(clients))
+	for i, client := range clients {
+		entries[i] = client + "(" + options + ")"
+	}
+	return path + " " + strings.Join(entries, " ") + "\n"
+}
+
+// Export exports path for a volume, the clients and options of the config are
+// overridden by the StorageClass parameters. The file is removed again when
+// exportfs rejects it, so a bad entry does not break the other exports.
+func (m *exportManager) Export(ctx context.Context, executer Executer, volumeID string, path string, params map[string]string) error {
+	if err := checkBackendName("volume ID", volumeID); err != nil {
+		return err
+	}
+	if !filepath.IsAbs(path) || strings.ContainsAny(path, " \t\n\"") {
+		return fmt.Errorf("invalid export path %q", path)
+	}
+	clients, options := m.config.Clients, m.config.Options
+	if value := params[EXPORT_CLIENTS_KEY]; value != "" {
+		clients = strings.Split(value, ",")
+		if err := checkExportClients(clients); err != nil {
+			return err
+		}
+	}
+	if value, ok := params[EXPORT_OPTIONS_KEY]; ok {
+		if err := checkExportOptions(value); err != nil {
+			return err
+		}
+		options = value
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	file := m.file(volumeID)
+	if err := writeFileAtomic(ctx, executer, file, exportEntry(volumeID, path, clients, options)); err != nil {
+		return err
+	}
+	if _, err := runCommand(ctx, executer, shellCommand("exportfs", "-ra")); err != nil {
+		runCommand(ctx, executer, shellCommand("rm", "-f", file)+" && "+shellCommand("exportfs", "-ra"))
+		return err
+	}
+	return nil
+}
+
+// Unexport removes the export of a volume, it succeeds when there is none.
+func (m *exportManager) Unexport(ctx context.Context, executer Executer, volumeID string) error {
+	if err := checkBackendName("volume ID", volumeID); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := runCommand(ctx, executer, shellCommand("rm", "-f", m.file(volumeID))+" && "+shellCommand("exportfs", "-ra"))
+	return err
+}
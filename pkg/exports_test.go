@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func newTestExportManager() *exportManager {
+	return &exportManager{config: ExportsConfig{
+		Managed: true,
+		Dir:     "/etc/exports.d",
+		Clients: []string{"10.0.0.0/8", "node-1"},
+		Options: "rw,sync,root_squash",
+	}}
+}
+
+func TestExportEntry(t *testing.T) {
+	entry := exportEntry("pvc-1", "/data/pvc-1", []string{"10.0.0.0/8", "node-1"}, "rw,sync")
+	fsid := exportFsid("pvc-1")
+	if entry != "/data/pvc-1 10.0.0.0/8(rw,sync,fsid="+fsid+") node-1(rw,sync,fsid="+fsid+")\n" {
+		t.Errorf("unexpected entry %q", entry)
+	}
+	if fsid == exportFsid("pvc-2") || len(strings.ReplaceAll(fsid, "-", "")) != 32 {
+		t.Errorf("fsid %q should be a UUID unique to the volume", fsid)
+	}
+	if entry := exportEntry("pvc-1", "/data/pvc-1", []string{"*"}, "ro,fsid=7"); entry != "/data/pvc-1 *(ro,fsid=7)\n" {
+		t.Errorf("a configured fsid should be kept, got %q", entry)
+	}
+	if entry := exportEntry("pvc-1", "/data/pvc-1", []string{"*"}, ""); entry != "/data/pvc-1 *(fsid="+fsid+")\n" {
+		t.Errorf("unexpected entry without options %q", entry)
+	}
+}
+
+func TestExport(t *testing.T) {
+	m := newTestExportManager()
+	executer := &scriptedExecuter{}
+	err := m.Export(context.Background(), executer, "pvc-1", "/data/pvc-1", map[string]string{EXPORT_CLIENTS_KEY: "node-2,node-3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !executer.ran("'/etc/exports.d/csi-pvc-1.exports.tmp'", "node-2(rw,sync,root_squash,fsid=", "node-3(", "'mv'") || !executer.ran("'exportfs' '-ra'") {
+		t.Errorf("expected the export file to be written and reexported, ran %v", executer.commands)
+	}
+	if executer.ran("10.0.0.0/8") {
+		t.Error("the exportClients parameter should replace the configured clients")
+	}
+
+	executer = (&scriptedExecuter{}).once("'exportfs' '-ra'", "exportfs: Failed to stat /data/pvc-1", errExit1)
+	if err := m.Export(context.Background(), executer, "pvc-1", "/data/pvc-1", nil); err == nil {
+		t.Fatal("expected exportfs to fail")
+	}
+	if !executer.ran("'rm' '-f' '/etc/exports.d/csi-pvc-1.exports' && 'exportfs' '-ra'") {
+		t.Errorf("a rejected export file should be removed, ran %v", executer.commands)
+	}
+
+	for _, params := range []map[string]string{
+		{EXPORT_CLIENTS_KEY: "a b"},
+		{EXPORT_OPTIONS_KEY: "rw) *(rw"},
+	} {
+		if err := m.Export(context.Background(), executer, "pvc-1", "/data/pvc-1", params); err == nil {
+			t.Errorf("parameters %v should be rejected", params)
+		}
+	}
+	if err := m.Export(context.Background(), executer, "pvc-1", "data/pvc 1", nil); err == nil {
+		t.Error("a relative path should be rejected")
+	}
+}
+
+func TestControllerManagedExports(t *testing.T) {
+	driver := newTestDriver()
+	driver.exports = newTestExportManager()
+	executer := &scriptedExecuter{}
+	driver.executer = &exportRecorder{LocalExecuter: &LocalExecuter{}, exports: executer}
+
+	resp, err := driver.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "pvc-1",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := resp.Volume.VolumeContext[NFS_SHARE_PATH_KEY]
+	if !executer.ran("'printf' '%s' '" + path + " 10.0.0.0/8(") {
+		t.Errorf("expected %s to be exported, ran %v", path, executer.commands)
+	}
+
+	if _, err := driver.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: resp.Volume.VolumeId}); err != nil {
+		t.Fatal(err)
+	}
+	if !executer.ran("'rm' '-f' '/etc/exports.d/csi-pvc-1.exports'") {
+		t.Errorf("expected the export to be removed, ran %v", executer.commands)
+	}
+}
+
+func TestControllerManagedExportsPaths(t *testing.T) {
+	driver := newTestDriver()
+	driver.exports = newTestExportManager()
+	executer := &scriptedExecuter{}
+	driver.executer = &exportRecorder{LocalExecuter: &LocalExecuter{}, exports: executer}
+	create := func(name string, paths string) (*csi.CreateVolumeResponse, error) {
+		driver.config.CreateCmd = `echo "csi-shell-output:volume_id=$CSI_VOLUME_ID"
+echo "csi-shell-output:capacity_bytes=$CSI_CAPACITY_BYTES"
+echo "csi-shell-output:nfs_server=127.0.0.1"
+` + paths
+		return driver.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:          name,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 1024},
+		})
+	}
+
+	// nfs_path is relative to the NFSv4 root at /data/nfs
+	resp, err := create("pvc-1", `echo "csi-shell-output:nfs_path=/pvc-1"
+echo "csi-shell-output:export_path=/data/nfs/pvc-1"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path := resp.Volume.VolumeContext[NFS_SHARE_PATH_KEY]; path != "/pvc-1" {
+		t.Errorf("expected the nfs_path of the hook, got %s", path)
+	}
+	if !executer.ran("'printf' '%s' '/data/nfs/pvc-1 10.0.0.0/8(") {
+		t.Errorf("expected the export_path to be exported, ran %v", executer.commands)
+	}
+
+	resp, err = create("pvc-2", `echo "csi-shell-output:export_path=/data/nfs/pvc-2"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path := resp.Volume.VolumeContext[NFS_SHARE_PATH_KEY]; path != "/data/nfs/pvc-2" {
+		t.Errorf("a hook without nfs_path should be mounted at its export_path, got %s", path)
+	}
+}
+
+// exportRecorder runs the hooks locally and sends the export commands to a
+// scriptedExecuter.
+type exportRecorder struct {
+	*LocalExecuter
+	exports *scriptedExecuter
+}
+
+func (e *exportRecorder) ExecuteCommand(ctx context.Context, cmd string, env map[string]string) ([]byte, error) {
+	if strings.Contains(cmd, "'exportfs'") || strings.Contains(cmd, "/etc/exports.d") {
+		return e.exports.ExecuteCommand(ctx, cmd, env)
+	}
+	return e.LocalExecuter.ExecuteCommand(ctx, cmd, env)
+}
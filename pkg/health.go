@@ -0,0 +1,256 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var errProbeTimeout = errors.New("probe timed out")
+
+// PublishedVolume is a volume mounted by this node plugin.
+type PublishedVolume struct {
+	VolumeID   string
+	Source     string
+	TargetPath string
+	Options    []string
+	// ShareDir is the private share mount of a block volume, probed instead
+	// of the device at the target path
+	ShareDir string
+	// MountTimeout bounds a remount of the volume
+	MountTimeout time.Duration
+	Abnormal     bool
+	Message      string
+	// Remounted is set once the health monitor replaced the mount, the
+	// containers running since then still see the stale one
+	Remounted bool
+	// generation counts the remounts, a probe hanging on a replaced mount
+	// does not hold back the probes of the new one
+	generation int
+	probing    bool
+}
+
+// VolumeRegistry tracks the volumes published on this node, keyed by target path.
+type VolumeRegistry struct {
+	mu      sync.Mutex
+	volumes map[string]*PublishedVolume
+}
+
+func NewVolumeRegistry() *VolumeRegistry {
+	return &VolumeRegistry{
+		volumes: make(map[string]*PublishedVolume),
+	}
+}
+
+func (r *VolumeRegistry) Add(vol PublishedVolume) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.volumes[vol.TargetPath] = &vol
+}
+
+func (r *VolumeRegistry) Remove(targetPath string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.volumes, targetPath)
+}
+
+// Get returns a copy of the volume published at targetPath.
+func (r *VolumeRegistry) Get(targetPath string) (PublishedVolume, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	vol, ok := r.volumes[targetPath]
+	if !ok {
+		return PublishedVolume{}, false
+	}
+	return *vol, true
+}
+
+func (r *VolumeRegistry) List() []PublishedVolume {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	vols := make([]PublishedVolume, 0, len(r.volumes))
+	for _, vol := range r.volumes {
+		vols = append(vols, *vol)
+	}
+	return vols
+}
+
+func (r *VolumeRegistry) SetCondition(targetPath string, abnormal bool, message string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if vol, ok := r.volumes[targetPath]; ok {
+		vol.Abnormal = abnormal
+		vol.Message = message
+	}
+}
+
+// SetRemounted keeps the volume abnormal after a remount until it is published
+// again, which a new pod does.
+func (r *VolumeRegistry) SetRemounted(targetPath string, message string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if vol, ok := r.volumes[targetPath]; ok {
+		vol.Remounted = true
+		vol.Abnormal = true
+		vol.Message = message
+		vol.generation++
+		vol.probing = false
+	}
+}
+
+// startProbe marks the current mount of the volume as being probed and
+// returns its generation, it returns false if a previous probe of the mount
+// is still hanging.
+func (r *VolumeRegistry) startProbe(targetPath string) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	vol, ok := r.volumes[targetPath]
+	if !ok || vol.probing {
+		return 0, false
+	}
+	vol.probing = true
+	return vol.generation, true
+}
+
+func (r *VolumeRegistry) endProbe(targetPath string, generation int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if vol, ok := r.volumes[targetPath]; ok && vol.generation == generation {
+		vol.probing = false
+	}
+}
+
+// probePath runs statfs on path in a goroutine so that a hung NFS server can
+// not block the caller longer than timeout. release, if not nil, is called
+// once statfs really returns.
+func probePath(path string, timeout time.Duration, release func()) (*unix.Statfs_t, error) {
+	type result struct {
+		stat *unix.Statfs_t
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var stat unix.Statfs_t
+		err := unix.Statfs(path, &stat)
+		if release != nil {
+			release()
+		}
+		done <- result{&stat, err}
+	}()
+	select {
+	case r := <-done:
+		return r.stat, r.err
+	case <-time.After(timeout):
+		return nil, errProbeTimeout
+	}
+}
+
+func isStaleOrUnreachable(err error) bool {
+	return errors.Is(err, syscall.ESTALE) || errors.Is(err, errProbeTimeout) ||
+		errors.Is(err, syscall.EIO) || errors.Is(err, syscall.ENOTCONN)
+}
+
+func lazyUnmount(target string) error {
+	out, err := exec.Command("umount", "-l", target).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("lazy unmount %s failed: %w, output: %s", target, err, string(out))
+	}
+	return nil
+}
+
+// runHealthMonitor periodically probes every published volume and remounts
+// the ones that went stale until ctx is done.
+func (d *SshNodeServer) runHealthMonitor(ctx context.Context) {
+	ticker := time.NewTicker(d.config.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.checkVolumes()
+		}
+	}
+}
+
+func (d *SshNodeServer) checkVolumes() {
+	for _, vol := range d.volumes.List() {
+		d.checkVolume(vol)
+	}
+}
+
+func (d *SshNodeServer) checkVolume(vol PublishedVolume) {
+	generation, ok := d.volumes.startProbe(vol.TargetPath)
+	if !ok {
+		slog.Warn("previous probe still hanging", "volumeID", vol.VolumeID, "targetPath", vol.TargetPath)
+		if !vol.Remounted {
+			d.volumes.SetCondition(vol.TargetPath, true, "volume is unreachable: probe is hanging")
+		}
+		return
+	}
+	probed := vol.TargetPath
+	if vol.ShareDir != "" {
+		probed = vol.ShareDir
+	}
+	_, err := probePath(probed, d.config.HealthCheckTimeout, func() {
+		d.volumes.endProbe(vol.TargetPath, generation)
+	})
+	if err == nil {
+		if vol.Remounted {
+			// the probe sees the new mount, not the one of the containers
+			return
+		}
+		if vol.Abnormal {
+			slog.Info("volume recovered", "volumeID", vol.VolumeID, "targetPath", vol.TargetPath)
+		}
+		d.volumes.SetCondition(vol.TargetPath, false, "volume is healthy")
+		return
+	}
+	if vol.ShareDir != "" {
+		// the loop device keeps the image of the stale share open, a new
+		// share mount would not reach it
+		slog.Warn("block volume share probe failed", "volumeID", vol.VolumeID, "shareDir", vol.ShareDir, "err", err)
+		d.volumes.SetCondition(vol.TargetPath, true, fmt.Sprintf("block volume share probe failed: %v", err))
+		return
+	}
+	if !isStaleOrUnreachable(err) {
+		slog.Warn("volume probe failed", "volumeID", vol.VolumeID, "targetPath", vol.TargetPath, "err", err)
+		d.volumes.SetCondition(vol.TargetPath, true, fmt.Sprintf("volume probe failed: %v", err))
+		return
+	}
+
+	slog.Warn("stale or unreachable volume, remounting", "volumeID", vol.VolumeID, "source", vol.Source, "targetPath", vol.TargetPath, "err", err)
+	if err := d.remountVolume(vol); err != nil {
+		slog.Error("failed to remount volume", "volumeID", vol.VolumeID, "targetPath", vol.TargetPath, "err", err)
+		d.volumes.SetCondition(vol.TargetPath, true, fmt.Sprintf("volume is stale and remount failed: %v", err))
+		return
+	}
+	slog.Warn("volume remounted, running containers keep the stale mount until the pod restarts", "volumeID", vol.VolumeID, "targetPath", vol.TargetPath)
+	d.volumes.SetRemounted(vol.TargetPath, fmt.Sprintf("volume was remounted after: %v, restart the pod to use the new mount", err))
+}
+
+// remountVolume replaces a stale mount at the target path. Only new bind
+// mounts of the target path see the new mount: a container keeps the mount it
+// started with, so the pod has to restart to recover.
+func (d *SshNodeServer) remountVolume(vol PublishedVolume) error {
+	mutexKey := fmt.Sprintf("%s-%s", vol.VolumeID, vol.TargetPath)
+	if acquired := d.mutex.TryLock(mutexKey); !acquired {
+		return fmt.Errorf("volume operation already exists: %s", vol.VolumeID)
+	}
+	defer d.mutex.UnLock(mutexKey)
+	if err := d.lazyUnmount(vol.TargetPath); err != nil {
+		return err
+	}
+	timeout := vol.MountTimeout
+	if timeout <= 0 {
+		timeout = d.config.MountTimeout
+	}
+	return d.mountNFS(context.Background(), vol.Source, vol.TargetPath, vol.Options, timeout)
+}
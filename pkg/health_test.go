@@ -0,0 +1,142 @@
+package pkg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	mount "k8s.io/mount-utils"
+)
+
+func TestProbePathTimeout(t *testing.T) {
+	if _, err := probePath(t.TempDir(), time.Second, nil); err != nil {
+		t.Fatalf("probePath failed: %v", err)
+	}
+	if !isStaleOrUnreachable(errProbeTimeout) {
+		t.Errorf("timeout should be treated as unreachable")
+	}
+}
+
+func TestRemountVolume(t *testing.T) {
+	target := t.TempDir()
+	mockMounter := mount.NewFakeMounter([]mount.MountPoint{})
+	driver := newTestNode(mockMounter)
+	var unmounted []string
+	driver.lazyUnmount = func(target string) error {
+		unmounted = append(unmounted, target)
+		return nil
+	}
+	vol := PublishedVolume{VolumeID: "test-volume", Source: "server:/path", TargetPath: target}
+	driver.volumes.Add(vol)
+	if err := driver.remountVolume(vol); err != nil {
+		t.Fatalf("remountVolume failed: %v", err)
+	}
+	if len(unmounted) != 1 || unmounted[0] != target {
+		t.Errorf("Expected lazy unmount of %s, got %v", target, unmounted)
+	}
+	logs := mockMounter.GetLog()
+	if len(logs) != 1 || logs[0].Source != "server:/path" {
+		t.Errorf("Expected remount, got %+v", logs)
+	}
+}
+
+func TestRemountedVolumeStaysAbnormal(t *testing.T) {
+	target := t.TempDir()
+	driver := newTestNode(mount.NewFakeMounter([]mount.MountPoint{}))
+	driver.volumes.Add(PublishedVolume{VolumeID: "test-volume", TargetPath: target})
+	driver.volumes.SetRemounted(target, "volume was remounted")
+	vol, _ := driver.volumes.Get(target)
+	driver.checkVolume(vol)
+	if vol, _ := driver.volumes.Get(target); !vol.Abnormal || vol.Message != "volume was remounted" {
+		t.Errorf("a remounted volume should stay abnormal until the pod restarts, got %+v", vol)
+	}
+
+	driver.volumes.Remove(target)
+	driver.volumes.Add(PublishedVolume{VolumeID: "test-volume", TargetPath: target})
+	vol, _ = driver.volumes.Get(target)
+	driver.checkVolume(vol)
+	if vol, _ := driver.volumes.Get(target); vol.Abnormal {
+		t.Errorf("a volume published again should be healthy, got %+v", vol)
+	}
+}
+
+func TestRemountAfterHangingProbe(t *testing.T) {
+	target := t.TempDir()
+	driver := newTestNode(mount.NewFakeMounter([]mount.MountPoint{}))
+	driver.volumes.Add(PublishedVolume{VolumeID: "test-volume", TargetPath: target})
+	// a probe of the first mount never returns
+	hanging, _ := driver.volumes.startProbe(target)
+	vol, _ := driver.volumes.Get(target)
+	driver.checkVolume(vol)
+	if vol, _ := driver.volumes.Get(target); !vol.Abnormal || vol.Message != "volume is unreachable: probe is hanging" {
+		t.Errorf("a hanging probe should make the volume abnormal, got %+v", vol)
+	}
+
+	driver.volumes.SetRemounted(target, "volume was remounted")
+	vol, _ = driver.volumes.Get(target)
+	generation, ok := driver.volumes.startProbe(target)
+	if !ok || generation == hanging {
+		t.Fatalf("the new mount should be probed, got generation %d, %v", generation, ok)
+	}
+	driver.volumes.endProbe(target, hanging)
+	if _, ok := driver.volumes.startProbe(target); ok {
+		t.Error("the hanging probe of the old mount should not end the probe of the new one")
+	}
+	driver.checkVolume(vol)
+	if vol, _ := driver.volumes.Get(target); !vol.Abnormal || vol.Message != "volume was remounted" {
+		t.Errorf("a hanging probe should keep the remount message, got %+v", vol)
+	}
+	driver.volumes.endProbe(target, generation)
+	driver.checkVolume(vol)
+	if vol, _ := driver.volumes.Get(target); vol.probing || vol.Message != "volume was remounted" {
+		t.Errorf("the new mount should be probed and keep the remount message, got %+v", vol)
+	}
+}
+
+func TestCheckBlockVolume(t *testing.T) {
+	shareDir := filepath.Join(t.TempDir(), "share")
+	driver := newTestNode(mount.NewFakeMounter([]mount.MountPoint{}))
+	driver.lazyUnmount = func(target string) error {
+		t.Errorf("a block volume should not be remounted, unmounted %s", target)
+		return nil
+	}
+	target := filepath.Join(t.TempDir(), "dev")
+	driver.volumes.Add(PublishedVolume{VolumeID: "test-volume", TargetPath: target, ShareDir: shareDir})
+	vol, _ := driver.volumes.Get(target)
+	driver.checkVolume(vol)
+	if vol, _ := driver.volumes.Get(target); !vol.Abnormal || !strings.Contains(vol.Message, "block volume share probe failed") {
+		t.Errorf("a block volume without its share should be abnormal, got %+v", vol)
+	}
+
+	if err := os.Mkdir(shareDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	driver.checkVolume(vol)
+	if vol, _ := driver.volumes.Get(target); vol.Abnormal {
+		t.Errorf("a block volume with a reachable share should be healthy, got %+v", vol)
+	}
+}
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	target := t.TempDir()
+	driver := newTestNode(mount.NewFakeMounter([]mount.MountPoint{}))
+	driver.volumes.Add(PublishedVolume{VolumeID: "test-volume", TargetPath: target})
+	driver.volumes.SetCondition(target, true, "stale file handle")
+	resp, err := driver.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   "test-volume",
+		VolumePath: target,
+	})
+	if err != nil {
+		t.Fatalf("NodeGetVolumeStats failed: %v", err)
+	}
+	if len(resp.Usage) != 2 {
+		t.Errorf("Expected bytes and inodes usage, got %+v", resp.Usage)
+	}
+	if !resp.VolumeCondition.Abnormal {
+		t.Errorf("Expected abnormal condition, got %+v", resp.VolumeCondition)
+	}
+}
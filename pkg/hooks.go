@@ -0,0 +1,109 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HOOK_FILE_PREFIX marks a hook configured as a file reference, e.g. @/etc/csi-ssh/hooks/create.sh
+const HOOK_FILE_PREFIX = "@"
+
+// Hook is the script of an operation as it was run.
+type Hook struct {
+	Script string
+	// Source is the file the script was read from, empty for inline scripts
+	Source string
+	// Hash identifies the version of the script in logs and traces
+	Hash string
+}
+
+func (h Hook) String() string {
+	if h.Source != "" {
+		return h.Source
+	}
+	return "inline"
+}
+
+func hashScript(script string) string {
+	sum := sha256.Sum256([]byte(script))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+type hookFile struct {
+	modTime time.Time
+	size    int64
+	hook    Hook
+}
+
+// HookLoader resolves the script of an operation from inline text, a "@path"
+// file reference or the <operation>.sh file of the hooks directory. Files are
+// read again when their modification time or size change, so an updated
+// ConfigMap takes effect without a restart.
+type HookLoader struct {
+	dir string
+
+	mu    sync.Mutex
+	files map[string]*hookFile
+}
+
+func NewHookLoader(dir string) *HookLoader {
+	return &HookLoader{dir: dir, files: map[string]*hookFile{}}
+}
+
+// path returns the file of the hook, empty for an inline script.
+func (l *HookLoader) path(operation string, configured string) string {
+	if strings.HasPrefix(configured, HOOK_FILE_PREFIX) {
+		return strings.TrimPrefix(configured, HOOK_FILE_PREFIX)
+	}
+	if configured == "" && l.dir != "" {
+		return filepath.Join(l.dir, operation+".sh")
+	}
+	return ""
+}
+
+// Has reports whether a hook is configured for the operation.
+func (l *HookLoader) Has(operation string, configured string) bool {
+	if path := l.path(operation, configured); path != "" {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	return configured != ""
+}
+
+func (l *HookLoader) Load(operation string, configured string) (Hook, error) {
+	path := l.path(operation, configured)
+	if path == "" {
+		if configured == "" {
+			return Hook{}, fmt.Errorf("no %s hook configured", operation)
+		}
+		return Hook{Script: configured, Hash: hashScript(configured)}, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return Hook{}, fmt.Errorf("failed to stat %s hook: %w", operation, err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cached := l.files[path]
+	if cached != nil && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.hook, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return Hook{}, fmt.Errorf("failed to read %s hook: %w", operation, err)
+	}
+	hook := Hook{Script: string(content), Source: path, Hash: hashScript(string(content))}
+	if cached == nil || cached.hook.Hash != hook.Hash {
+		slog.Info("Loaded hook", "operation", operation, "hook", path, "hook_hash", hook.Hash)
+	}
+	l.files[path] = &hookFile{modTime: info.ModTime(), size: info.Size(), hook: hook}
+	return hook, nil
+}
@@ -0,0 +1,119 @@
+package pkg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func writeHook(t *testing.T, path string, script string, modTime time.Time) {
+	if err := os.WriteFile(path, []byte(script), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHookLoaderSources(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "custom.sh")
+	writeHook(t, file, "echo file", time.Now())
+	writeHook(t, filepath.Join(dir, OP_DELETE_VOLUME+".sh"), "echo dir", time.Now())
+	loader := NewHookLoader(dir)
+
+	inline, err := loader.Load(OP_CREATE_VOLUME, "echo inline")
+	if err != nil || inline.Script != "echo inline" || inline.Source != "" || inline.Hash == "" {
+		t.Errorf("unexpected inline hook %+v, err %v", inline, err)
+	}
+	fromFile, err := loader.Load(OP_CREATE_VOLUME, "@"+file)
+	if err != nil || fromFile.Script != "echo file" || fromFile.Source != file {
+		t.Errorf("unexpected file hook %+v, err %v", fromFile, err)
+	}
+	fromDir, err := loader.Load(OP_DELETE_VOLUME, "")
+	if err != nil || fromDir.Script != "echo dir" {
+		t.Errorf("unexpected hooks dir hook %+v, err %v", fromDir, err)
+	}
+	if loader.Has(OP_EXPAND_VOLUME, "") {
+		t.Error("expand hook should not exist")
+	}
+	if _, err := loader.Load(OP_EXPAND_VOLUME, ""); err == nil {
+		t.Error("loading a missing hook should fail")
+	}
+	if NewHookLoader("").Has(OP_DELETE_VOLUME, "") {
+		t.Error("hook without hooks dir should not exist")
+	}
+}
+
+func TestHookLoaderReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "create.sh")
+	writeHook(t, file, "echo v1", time.Now().Add(-time.Minute))
+	loader := NewHookLoader("")
+	v1, err := loader.Load(OP_CREATE_VOLUME, "@"+file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeHook(t, file, "echo v2", time.Now())
+	v2, err := loader.Load(OP_CREATE_VOLUME, "@"+file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2.Script != "echo v2" || v2.Hash == v1.Hash {
+		t.Errorf("expected reloaded hook, got %+v after %+v", v2, v1)
+	}
+}
+
+func TestControllerHooksDir(t *testing.T) {
+	dir := t.TempDir()
+	writeHook(t, filepath.Join(dir, OP_EXPAND_VOLUME+".sh"), `echo "csi-shell-output:capacity_bytes=${CSI_CAPACITY_BYTES}"`, time.Now())
+	driver := newTestDriver()
+	driver.config.ExpandCmd = ""
+	driver.config.CreateSnapshotCmd = ""
+	driver.hooks = NewHookLoader(dir)
+
+	resp, err := driver.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      CSI_VOLUME_ID_PREFIX + "test-volume",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 2048},
+	})
+	if err != nil {
+		t.Fatalf("ControllerExpandVolume failed: %v", err)
+	}
+	if resp.CapacityBytes != 2048 {
+		t.Errorf("expected capacity 2048, got %d", resp.CapacityBytes)
+	}
+	caps, _ := driver.ControllerGetCapabilities(context.Background(), &csi.ControllerGetCapabilitiesRequest{})
+	var names []string
+	for _, c := range caps.Capabilities {
+		names = append(names, c.GetRpc().GetType().String())
+	}
+	if !strings.Contains(strings.Join(names, ","), "EXPAND_VOLUME") || strings.Contains(strings.Join(names, ","), "SNAPSHOT") {
+		t.Errorf("capabilities should follow the hooks dir, got %v", names)
+	}
+}
+
+func TestControllerCfgValidateHooks(t *testing.T) {
+	dir := t.TempDir()
+	writeHook(t, filepath.Join(dir, OP_CREATE_VOLUME+".sh"), "echo", time.Now())
+	cfg := ControllerCfg{
+		Endpoint:  "unix:///tmp/csi.sock",
+		HooksDir:  dir,
+		ExpandCmd: "@" + filepath.Join(dir, "missing.sh"),
+	}
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected validation error")
+	}
+	if strings.Contains(err.Error(), "createCmd") {
+		t.Errorf("create hook from hooks dir should be accepted, got %v", err)
+	}
+	for _, field := range []string{"deleteCmd", "delete_volume.sh", "expandCmd: hook file"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("expected error to name %s, got %v", field, err)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package pkg
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const redactedValue = "***"
+
+// DefaultSensitiveKeys are masked in logs and errors unless configured otherwise.
+var DefaultSensitiveKeys = []string{"password", "passwd", "secret", "token", "passphrase", "credential", "ssh_key", "private_key"}
+
+// Redactor masks the values of sensitive keys, a key is sensitive if it
+// contains one of the configured words, ignoring case.
+type Redactor struct {
+	keys []string
+}
+
+func NewRedactor(keys []string) *Redactor {
+	r := &Redactor{}
+	for _, k := range keys {
+		if k = strings.TrimSpace(k); k != "" {
+			r.keys = append(r.keys, strings.ToLower(k))
+		}
+	}
+	return r
+}
+
+func (r *Redactor) IsSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, k := range r.keys {
+		if strings.Contains(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactEnv returns a copy of env with the sensitive values masked.
+func (r *Redactor) RedactEnv(env map[string]string) map[string]string {
+	redacted := make(map[string]string, len(env))
+	for k, v := range env {
+		if r.IsSensitive(k) {
+			v = redactedValue
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
+
+// RedactValues masks every occurrence of a sensitive value of env in s.
+func (r *Redactor) RedactValues(s string, env map[string]string) string {
+	for k, v := range env {
+		if v != "" && r.IsSensitive(k) {
+			s = strings.ReplaceAll(s, v, redactedValue)
+		}
+	}
+	return s
+}
+
+// redactedError hides sensitive values in the message of err but keeps it unwrappable.
+type redactedError struct {
+	err error
+	msg string
+}
+
+func (e *redactedError) Error() string { return e.msg }
+func (e *redactedError) Unwrap() error { return e.err }
+
+func (r *Redactor) RedactError(err error, env map[string]string) error {
+	if err == nil {
+		return nil
+	}
+	msg := r.RedactValues(err.Error(), env)
+	if msg == err.Error() {
+		return err
+	}
+	return &redactedError{err: err, msg: msg}
+}
+
+var redactor = NewRedactor(DefaultSensitiveKeys)
+
+// redactingHandler masks the sensitive attributes of every record.
+type redactingHandler struct {
+	slog.Handler
+	redactor *Redactor
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	record.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(h.redactAttr(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, redacted)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, a := range attrs {
+		redacted = append(redacted, h.redactAttr(a))
+	}
+	return &redactingHandler{Handler: h.Handler.WithAttrs(redacted), redactor: h.redactor}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{Handler: h.Handler.WithGroup(name), redactor: h.redactor}
+}
+
+func (h *redactingHandler) redactAttr(a slog.Attr) slog.Attr {
+	if h.redactor.IsSensitive(a.Key) {
+		return slog.String(a.Key, redactedValue)
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		group := a.Value.Group()
+		redacted := make([]any, 0, len(group))
+		for _, g := range group {
+			redacted = append(redacted, h.redactAttr(g))
+		}
+		return slog.Group(a.Key, redacted...)
+	}
+	if env, ok := a.Value.Any().(map[string]string); ok {
+		return slog.Any(a.Key, h.redactor.RedactEnv(env))
+	}
+	return a
+}
+
+// SetupLogging installs the default logger writing text or json records to w,
+// masking the values of sensitiveKeys.
+func SetupLogging(w io.Writer, level string, format string, sensitiveKeys []string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level: %w", err)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	var handler slog.Handler
+	switch format {
+	case "text", "":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format %q, must be text or json", format)
+	}
+	redactor = NewRedactor(sensitiveKeys)
+	slog.SetDefault(slog.New(&redactingHandler{Handler: handler, redactor: redactor}))
+	return nil
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx carrying logger.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// Logger returns the request logger of ctx, or the default logger.
+func Logger(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// LoggingInterceptor attaches a logger carrying a request ID, the method and the
+// volume and snapshot IDs of the request to the context of every unary RPC.
+func LoggingInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	attrs := []any{"request_id", newRequestID(), "method", info.FullMethod}
+	if r, ok := req.(interface{ GetVolumeId() string }); ok && r.GetVolumeId() != "" {
+		attrs = append(attrs, "volume_id", r.GetVolumeId())
+	}
+	if r, ok := req.(interface{ GetSourceVolumeId() string }); ok && r.GetSourceVolumeId() != "" {
+		attrs = append(attrs, "volume_id", r.GetSourceVolumeId())
+	}
+	if r, ok := req.(interface{ GetSnapshotId() string }); ok && r.GetSnapshotId() != "" {
+		attrs = append(attrs, "snapshot_id", r.GetSnapshotId())
+	}
+	if id := traceID(ctx); id != "" {
+		attrs = append(attrs, "trace_id", id)
+	}
+	logger := slog.Default().With(attrs...)
+	start := time.Now()
+	resp, err := handler(WithLogger(ctx, logger), req)
+	if err != nil {
+		logger.Warn("request failed", "code", status.Code(err).String(), "duration", time.Since(start), "err", err)
+	} else {
+		logger.Debug("request finished", "duration", time.Since(start))
+	}
+	return resp, err
+}
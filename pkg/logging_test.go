@@ -0,0 +1,65 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+)
+
+func TestRedactor(t *testing.T) {
+	r := NewRedactor([]string{"password", "token"})
+	env := map[string]string{
+		"CSI_PARAM_dbPassword": "hunter2",
+		"CSI_PARAM_apiToken":   "abc123",
+		CSI_REQ_VOLUME_ID:      "pvc-1",
+	}
+	redacted := r.RedactEnv(env)
+	if redacted["CSI_PARAM_dbPassword"] != redactedValue || redacted["CSI_PARAM_apiToken"] != redactedValue {
+		t.Errorf("Expected sensitive values masked, got %v", redacted)
+	}
+	if redacted[CSI_REQ_VOLUME_ID] != "pvc-1" {
+		t.Errorf("Expected volume id kept, got %v", redacted)
+	}
+	err := r.RedactError(errors.New("mount failed: password hunter2 rejected"), env)
+	if strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("Expected secret masked in error, got %q", err)
+	}
+}
+
+func TestLoggingInterceptor(t *testing.T) {
+	var buf bytes.Buffer
+	if err := SetupLogging(&buf, "info", "json", []string{"password"}); err != nil {
+		t.Fatalf("SetupLogging failed: %v", err)
+	}
+	defer func() {
+		slog.SetDefault(slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil)))
+		redactor = NewRedactor(DefaultSensitiveKeys)
+	}()
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/DeleteVolume"}
+	req := &csi.DeleteVolumeRequest{VolumeId: "v1:pvc-1"}
+	_, err := LoggingInterceptor(context.Background(), req, info, func(ctx context.Context, req any) (any, error) {
+		Logger(ctx).Info("deleting", "password", "hunter2")
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("interceptor failed: %v", err)
+	}
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a json record, got %q: %v", buf.String(), err)
+	}
+	if record["volume_id"] != "v1:pvc-1" || record["method"] != info.FullMethod || record["request_id"] == "" {
+		t.Errorf("Expected request attributes, got %v", record)
+	}
+	if record["password"] != redactedValue {
+		t.Errorf("Expected password masked, got %v", record["password"])
+	}
+}
@@ -0,0 +1,521 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+const (
+	LVM_THIN_BACKEND = "lvm-thin"
+
+	// FS_TYPE_KEY is the StorageClass parameter choosing the filesystem of a new volume
+	FS_TYPE_KEY = "fsType"
+
+	lvmSnapshotPrefix = "snap_"
+	// lvmSourceTag records the volume of a snapshot, which outlives its origin
+	lvmSourceTag = "csi_source="
+
+	// lvmMountUnitDir holds the mount units restoring the mounts at boot
+	lvmMountUnitDir = "/etc/systemd/system"
+)
+
+func init() {
+	registerBackend(LVM_THIN_BACKEND, newLvmThinBackend)
+}
+
+// lvmThinBackend creates a thin LV per volume in a thin pool, formats it,
+// mounts it at <exportRoot>/<volume> and exports it in an exports.d file.
+// The mount is persisted by a systemd mount unit, so a rebooted server mounts
+// the volume again before exportfs reads the file. Snapshots are read-only
+// thin snapshots named snap_<name>, their IDs are <volume>@<name>.
+type lvmThinBackend struct {
+	volumeGroup string
+	thinPool    string
+	exportRoot  string
+	nfsServer   string
+	fsType      string
+	exports     *exportManager
+}
+
+func newLvmThinBackend(config map[string]string) (Backend, error) {
+	if err := checkConfigKeys(LVM_THIN_BACKEND, config, "volumeGroup", "thinPool", "exportRoot", "nfsServer", "fsType", "exportClients", "exportOptions", "exportsDir"); err != nil {
+		return nil, err
+	}
+	b := &lvmThinBackend{
+		fsType: "ext4",
+		exports: &exportManager{config: ExportsConfig{
+			Managed: true,
+			Dir:     "/etc/exports.d",
+			Clients: []string{"*"},
+			Options: "rw,sync,no_subtree_check,no_root_squash",
+		}},
+	}
+	var err error
+	if b.volumeGroup, err = requiredConfig(LVM_THIN_BACKEND, config, "volumeGroup"); err != nil {
+		return nil, err
+	}
+	if b.thinPool, err = requiredConfig(LVM_THIN_BACKEND, config, "thinPool"); err != nil {
+		return nil, err
+	}
+	if b.exportRoot, err = requiredConfig(LVM_THIN_BACKEND, config, "exportRoot"); err != nil {
+		return nil, err
+	}
+	if b.nfsServer, err = requiredConfig(LVM_THIN_BACKEND, config, "nfsServer"); err != nil {
+		return nil, err
+	}
+	b.exportRoot = strings.TrimSuffix(b.exportRoot, "/")
+	if !strings.HasPrefix(b.exportRoot, "/") {
+		return nil, fmt.Errorf("exportRoot of backend %s must be an absolute path", LVM_THIN_BACKEND)
+	}
+	if fsType := config["fsType"]; fsType != "" {
+		if err := checkLvmFsType(fsType); err != nil {
+			return nil, err
+		}
+		b.fsType = fsType
+	}
+	// the clients are separated like in exports(5), or by commas
+	if clients := strings.FieldsFunc(config["exportClients"], func(r rune) bool { return r == ' ' || r == ',' }); len(clients) > 0 {
+		b.exports.config.Clients = clients
+	}
+	if options := config["exportOptions"]; options != "" {
+		b.exports.config.Options = options
+	}
+	if dir := config["exportsDir"]; dir != "" {
+		b.exports.config.Dir = strings.TrimSuffix(dir, "/")
+	}
+	if err := b.exports.config.Validate(); err != nil {
+		return nil, fmt.Errorf("backend %s: %w", LVM_THIN_BACKEND, err)
+	}
+	return b, nil
+}
+
+func checkLvmFsType(fsType string) error {
+	if fsType != "ext4" && fsType != "xfs" {
+		return fmt.Errorf("invalid %s %q, must be ext4 or xfs", FS_TYPE_KEY, fsType)
+	}
+	return nil
+}
+
+func (b *lvmThinBackend) Name() string {
+	return LVM_THIN_BACKEND
+}
+
+func (b *lvmThinBackend) Supports(operation string) bool {
+	switch operation {
+	case OP_CREATE_VOLUME, OP_DELETE_VOLUME, OP_EXPAND_VOLUME, OP_CREATE_SNAPSHOT, OP_DELETE_SNAPSHOT, OP_LIST_SNAPSHOTS:
+		return true
+	}
+	return false
+}
+
+// AllocationUnit is the default extent size of a volume group, lvcreate and
+// lvextend round up to the extent size anyway.
+func (b *lvmThinBackend) AllocationUnit() int64 {
+	return 4 << 20
+}
+
+func (b *lvmThinBackend) Run(ctx context.Context, executer Executer, operation string, env map[string]string) ([]byte, error) {
+	switch operation {
+	case OP_CREATE_VOLUME:
+		return b.createVolume(ctx, executer, env)
+	case OP_DELETE_VOLUME:
+		return b.deleteVolume(ctx, executer, env)
+	case OP_EXPAND_VOLUME:
+		return b.expandVolume(ctx, executer, env)
+	case OP_CREATE_SNAPSHOT:
+		return b.createSnapshot(ctx, executer, env)
+	case OP_DELETE_SNAPSHOT:
+		return b.deleteSnapshot(ctx, executer, env)
+	case OP_LIST_SNAPSHOTS:
+		return b.listSnapshots(ctx, executer, env)
+	}
+	return nil, fmt.Errorf("lvm-thin backend does not support %s", operation)
+}
+
+// checkLvName rejects the IDs backendNamePattern allows that LVM does not.
+func checkLvName(kind string, name string) error {
+	if err := checkBackendName(kind, name); err != nil {
+		return err
+	}
+	if strings.Contains(name, ":") || strings.HasPrefix(name, lvmSnapshotPrefix) {
+		return fmt.Errorf("invalid %s %q", kind, name)
+	}
+	return nil
+}
+
+// volumeLv returns the vg/lv name of a volume.
+func (b *lvmThinBackend) volumeLv(volumeID string) (string, error) {
+	if err := checkLvName("volume ID", volumeID); err != nil {
+		return "", err
+	}
+	return b.volumeGroup + "/" + volumeID, nil
+}
+
+// snapshotLv returns the vg/lv name of a <volume>@<name> snapshot ID.
+func (b *lvmThinBackend) snapshotLv(snapshotID string) (string, error) {
+	volumeID, name, ok := strings.Cut(snapshotID, "@")
+	if !ok {
+		return "", fmt.Errorf("invalid snapshot ID %q, expected <volume>@<name>", snapshotID)
+	}
+	if err := checkLvName("volume ID", volumeID); err != nil {
+		return "", err
+	}
+	if err := checkLvName("snapshot name", name); err != nil {
+		return "", err
+	}
+	return b.volumeGroup + "/" + lvmSnapshotPrefix + name, nil
+}
+
+func lvDevice(lv string) string {
+	return "/dev/" + lv
+}
+
+// lvSize returns the size of lv in bytes, and false when it does not exist.
+func lvSize(ctx context.Context, executer Executer, lv string) (int64, bool, error) {
+	out, err := executer.ExecuteCommand(ctx, shellCommand("lvs", "--noheadings", "--units", "b", "--nosuffix", "-o", "lv_size", lv), nil)
+	if err != nil {
+		if strings.Contains(string(out), "Failed to find logical volume") {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("lvs %s failed: %w, output: %s", lv, err, strings.TrimSpace(string(out)))
+	}
+	// lvs prints warnings to the same output
+	for _, line := range strings.Split(string(out), "\n") {
+		if size, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64); err == nil {
+			return size, true, nil
+		}
+	}
+	return 0, false, fmt.Errorf("unexpected lvs output %q", strings.TrimSpace(string(out)))
+}
+
+// fsTypeOf returns the filesystem on device, empty when it is not formatted.
+func fsTypeOf(ctx context.Context, executer Executer, device string) (string, error) {
+	// blkid exits with 2 when it finds nothing
+	return runCommand(ctx, executer, shellCommand("blkid", "-o", "value", "-s", "TYPE", device)+" || true")
+}
+
+func (b *lvmThinBackend) mountpoint(volumeID string) string {
+	return b.exportRoot + "/" + volumeID
+}
+
+// mountUnit returns the file of the systemd mount unit of mountpoint, named
+// like systemd-escape --path --suffix=mount names it.
+func mountUnit(mountpoint string) string {
+	var name strings.Builder
+	for i, c := range []byte(strings.Trim(mountpoint, "/")) {
+		switch {
+		case c == '/':
+			name.WriteByte('-')
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == ':', c == '_', c == '.' && i > 0:
+			name.WriteByte(c)
+		default:
+			fmt.Fprintf(&name, "\\x%02x", c)
+		}
+	}
+	return lvmMountUnitDir + "/" + name.String() + ".mount"
+}
+
+// mountUnitContent mounts lv at boot, before the NFS server exports it.
+func mountUnitContent(lv string, fsType string, mountpoint string) string {
+	unit := "[Unit]\nDescription=CSI volume " + mountpoint + "\nBefore=nfs-server.service\n\n" +
+		"[Mount]\nWhat=" + lvDevice(lv) + "\nWhere=" + mountpoint + "\nType=" + fsType + "\n"
+	if fsType == "xfs" {
+		unit += "Options=nouuid\n"
+	}
+	return unit + "\n[Install]\nWantedBy=local-fs.target\n"
+}
+
+// mountAndExport activates lv, mounts it and exports the mountpoint, doing
+// only what was not done before. The mount unit and the exports file keep
+// both across reboots and exportfs -ra.
+func (b *lvmThinBackend) mountAndExport(ctx context.Context, executer Executer, lv string, fsType string, volumeID string, mountpoint string) error {
+	mount := []string{"mount"}
+	if fsType == "xfs" {
+		// clones share the filesystem UUID of their origin
+		mount = append(mount, "-o", "nouuid")
+	}
+	mount = append(mount, lvDevice(lv), mountpoint)
+	unit := mountUnit(mountpoint)
+	if err := writeFileAtomic(ctx, executer, unit, mountUnitContent(lv, fsType, mountpoint)); err != nil {
+		return err
+	}
+	cmds := []string{
+		shellCommand("lvchange", "-ay", "-K", lv),
+		shellCommand("mkdir", "-p", mountpoint),
+		"{ " + shellCommand("mountpoint", "-q", mountpoint) + " || " + shellCommand(mount...) + "; }",
+		shellCommand("systemctl", "daemon-reload"),
+		shellCommand("systemctl", "enable", filepath.Base(unit)),
+	}
+	if _, err := runCommand(ctx, executer, strings.Join(cmds, " && ")); err != nil {
+		return err
+	}
+	return b.exports.Export(ctx, executer, volumeID, mountpoint, nil)
+}
+
+// growFilesystem grows the filesystem of a mounted volume to the size of its LV.
+func growFilesystem(ctx context.Context, executer Executer, lv string, mountpoint string) error {
+	fsType, err := fsTypeOf(ctx, executer, lvDevice(lv))
+	if err != nil {
+		return err
+	}
+	switch fsType {
+	case "ext4":
+		_, err = runCommand(ctx, executer, shellCommand("resize2fs", lvDevice(lv)))
+	case "xfs":
+		_, err = runCommand(ctx, executer, shellCommand("xfs_growfs", mountpoint))
+	default:
+		err = fmt.Errorf("can not grow %q filesystem of %s", fsType, lv)
+	}
+	return err
+}
+
+func (b *lvmThinBackend) createVolume(ctx context.Context, executer Executer, env map[string]string) ([]byte, error) {
+	if env[CSI_REQ_VOLUME_MODE] == VOLUME_MODE_BLOCK {
+		return nil, fmt.Errorf("lvm-thin backend does not support block volumes")
+	}
+	volumeID := env[CSI_REQ_VOLUME_ID]
+	lv, err := b.volumeLv(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	capacity, err := strconv.ParseInt(env[CSI_REQ_CAPACITY_BYTES], 10, 64)
+	if err != nil || capacity <= 0 {
+		return nil, fmt.Errorf("invalid capacity %q", env[CSI_REQ_CAPACITY_BYTES])
+	}
+	fsType := b.fsType
+	if param := env[CSI_REQ_PARAM_PREFIX+FS_TYPE_KEY]; param != "" {
+		if err := checkLvmFsType(param); err != nil {
+			return nil, err
+		}
+		fsType = param
+	}
+
+	size, exists, err := lvSize(ctx, executer, lv)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		var origin string
+		switch env[CSI_REQ_DATA_SOURCE] {
+		case "snapshot":
+			origin, err = b.snapshotLv(env[CSI_REQ_SRC_SNAPSHOT_ID])
+		case "volume":
+			origin, err = b.volumeLv(env[CSI_REQ_SRC_VOLUME_ID])
+		}
+		if err != nil {
+			return nil, err
+		}
+		var cmd string
+		if origin != "" {
+			// a writable thin snapshot, activated like any volume
+			cmd = shellCommand("lvcreate", "-s", "-kn", "-prw", "-n", volumeID, origin)
+		} else {
+			cmd = shellCommand("lvcreate", "-T", b.volumeGroup+"/"+b.thinPool, "-V", fmt.Sprintf("%db", capacity), "-n", volumeID)
+		}
+		if _, err := runCommand(ctx, executer, cmd); err != nil {
+			return nil, err
+		}
+		if size, _, err = lvSize(ctx, executer, lv); err != nil {
+			return nil, err
+		}
+	}
+	if env[CSI_REQ_DATA_SOURCE] == "" {
+		// a retry may find the LV created but not formatted
+		current, err := fsTypeOf(ctx, executer, lvDevice(lv))
+		if err != nil {
+			return nil, err
+		}
+		if current == "" {
+			if _, err := runCommand(ctx, executer, shellCommand("mkfs."+fsType, lvDevice(lv))); err != nil {
+				return nil, err
+			}
+		}
+	} else if fsType, err = fsTypeOf(ctx, executer, lvDevice(lv)); err != nil {
+		return nil, err
+	}
+	mountpoint := b.mountpoint(volumeID)
+	if err := b.mountAndExport(ctx, executer, lv, fsType, volumeID, mountpoint); err != nil {
+		return nil, err
+	}
+	// a clone starts with the size of its origin
+	if size < capacity {
+		if size, err = b.extend(ctx, executer, lv, capacity, mountpoint); err != nil {
+			return nil, err
+		}
+	}
+
+	output := map[string]string{
+		CSI_REP_VOLUME_ID:      volumeID,
+		CSI_REP_CAPACITY_BYTES: strconv.FormatInt(size, 10),
+		NFS_SHARE_SERVER_KEY:   b.nfsServer,
+		NFS_SHARE_PATH_KEY:     mountpoint,
+		EXPORT_PATH_KEY:        mountpoint,
+	}
+	if env[CSI_REQ_DATA_SOURCE] != "" {
+		output[CSI_REP_DATA_SOURCE] = env[CSI_REQ_DATA_SOURCE]
+	}
+	return formatHookOutput(output), nil
+}
+
+// extend grows lv and its mounted filesystem to capacity and returns the new size.
+func (b *lvmThinBackend) extend(ctx context.Context, executer Executer, lv string, capacity int64, mountpoint string) (int64, error) {
+	if _, err := runCommand(ctx, executer, shellCommand("lvextend", "-L", fmt.Sprintf("%db", capacity), lv)); err != nil {
+		return 0, err
+	}
+	if err := growFilesystem(ctx, executer, lv, mountpoint); err != nil {
+		return 0, err
+	}
+	size, _, err := lvSize(ctx, executer, lv)
+	return size, err
+}
+
+func (b *lvmThinBackend) deleteVolume(ctx context.Context, executer Executer, env map[string]string) ([]byte, error) {
+	volumeID := env[CSI_REQ_VOLUME_ID]
+	lv, err := b.volumeLv(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.exports.Unexport(ctx, executer, volumeID); err != nil {
+		return nil, err
+	}
+	mountpoint := b.mountpoint(volumeID)
+	unit := mountUnit(mountpoint)
+	cmds := []string{
+		"{ ! " + shellCommand("mountpoint", "-q", mountpoint) + " || " + shellCommand("umount", mountpoint) + "; }",
+		// disable fails for a unit that is already gone
+		shellCommand("systemctl", "disable", filepath.Base(unit)) + " 2>/dev/null || true",
+		shellCommand("rm", "-f", unit),
+		shellCommand("systemctl", "daemon-reload"),
+		"{ ! " + shellCommand("test", "-d", mountpoint) + " || " + shellCommand("rmdir", mountpoint) + "; }",
+	}
+	if _, err := runCommand(ctx, executer, strings.Join(cmds, " && ")); err != nil {
+		return nil, err
+	}
+	if err := removeLv(ctx, executer, lv); err != nil {
+		return nil, err
+	}
+	return formatHookOutput(map[string]string{CSI_REP_VOLUME_ID: volumeID}), nil
+}
+
+func removeLv(ctx context.Context, executer Executer, lv string) error {
+	_, exists, err := lvSize(ctx, executer, lv)
+	if err != nil || !exists {
+		return err
+	}
+	_, err = runCommand(ctx, executer, shellCommand("lvremove", "-y", lv))
+	return err
+}
+
+func (b *lvmThinBackend) expandVolume(ctx context.Context, executer Executer, env map[string]string) ([]byte, error) {
+	if env[CSI_REQ_VOLUME_MODE] == VOLUME_MODE_BLOCK {
+		return nil, fmt.Errorf("lvm-thin backend does not support block volumes")
+	}
+	volumeID := env[CSI_REQ_VOLUME_ID]
+	lv, err := b.volumeLv(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	capacity, err := strconv.ParseInt(env[CSI_REQ_CAPACITY_BYTES], 10, 64)
+	if err != nil || capacity <= 0 {
+		return nil, fmt.Errorf("invalid capacity %q", env[CSI_REQ_CAPACITY_BYTES])
+	}
+	size, exists, err := lvSize(ctx, executer, lv)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("volume %s does not exist", lv)
+	}
+	if size < capacity {
+		if size, err = b.extend(ctx, executer, lv, capacity, b.mountpoint(volumeID)); err != nil {
+			return nil, err
+		}
+	}
+	return formatHookOutput(map[string]string{CSI_REP_CAPACITY_BYTES: strconv.FormatInt(size, 10)}), nil
+}
+
+func (b *lvmThinBackend) createSnapshot(ctx context.Context, executer Executer, env map[string]string) ([]byte, error) {
+	volumeID := env[CSI_REQ_SRC_VOLUME_ID]
+	snapshotID := volumeID + "@" + env[CSI_REQ_SNAPSHOT_NAME]
+	lv, err := b.snapshotLv(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	size, exists, err := lvSize(ctx, executer, lv)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		source, _ := b.volumeLv(volumeID)
+		// flush the mounted filesystem so the snapshot has the data written before
+		cmd := shellCommand("sync", "-f", b.mountpoint(volumeID)) + " && " +
+			shellCommand("lvcreate", "-s", "-pr", "--addtag", lvmSourceTag+volumeID, "-n", strings.TrimPrefix(lv, b.volumeGroup+"/"), source)
+		if _, err := runCommand(ctx, executer, cmd); err != nil {
+			return nil, err
+		}
+		if size, _, err = lvSize(ctx, executer, lv); err != nil {
+			return nil, err
+		}
+	}
+	return formatHookOutput(map[string]string{
+		CSI_REP_SNAPSHOT_ID:    snapshotID,
+		CSI_REP_CAPACITY_BYTES: strconv.FormatInt(size, 10),
+	}), nil
+}
+
+func (b *lvmThinBackend) deleteSnapshot(ctx context.Context, executer Executer, env map[string]string) ([]byte, error) {
+	lv, err := b.snapshotLv(env[CSI_REQ_SNAPSHOT_ID])
+	if err != nil {
+		return nil, err
+	}
+	if err := removeLv(ctx, executer, lv); err != nil {
+		return nil, err
+	}
+	return formatHookOutput(map[string]string{CSI_REP_SNAPSHOT_ID: env[CSI_REQ_SNAPSHOT_ID]}), nil
+}
+
+func (b *lvmThinBackend) listSnapshots(ctx context.Context, executer Executer, env map[string]string) ([]byte, error) {
+	out, err := runCommand(ctx, executer, shellCommand("lvs", "--noheadings", "--units", "b", "--nosuffix", "--separator", "|",
+		"-o", "lv_name,lv_size,lv_tags", b.volumeGroup))
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []*csi.Snapshot
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "|")
+		if len(fields) != 3 {
+			continue
+		}
+		name, ok := strings.CutPrefix(fields[0], lvmSnapshotPrefix)
+		if !ok {
+			continue
+		}
+		var volumeID string
+		for _, tag := range strings.Split(fields[2], ",") {
+			if v, ok := strings.CutPrefix(tag, lvmSourceTag); ok {
+				volumeID = v
+			}
+		}
+		if volumeID == "" {
+			continue
+		}
+		snapshotID := volumeID + "@" + name
+		if v := env[CSI_REQ_SRC_VOLUME_ID]; v != "" && v != volumeID {
+			continue
+		}
+		if s := env[CSI_REQ_SNAPSHOT_ID]; s != "" && s != snapshotID {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size of snapshot %s: %w", fields[0], err)
+		}
+		snapshots = append(snapshots, &csi.Snapshot{SnapshotId: snapshotID, SourceVolumeId: volumeID, SizeBytes: size})
+	}
+	return formatSnapshotList(snapshots), nil
+}
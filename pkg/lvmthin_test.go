@@ -0,0 +1,206 @@
+package pkg
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func newTestLvmThinBackend(t *testing.T, config map[string]string) Backend {
+	t.Helper()
+	cfg := map[string]string{"volumeGroup": "vg0", "thinPool": "pool", "exportRoot": "/export/", "nfsServer": "nas"}
+	for k, v := range config {
+		cfg[k] = v
+	}
+	b, err := NewBackend(LVM_THIN_BACKEND, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+const lvMissing = `  Failed to find logical volume "vg0/pvc-1"`
+
+func TestLvmThinCreateVolume(t *testing.T) {
+	b := newTestLvmThinBackend(t, nil)
+	executer := (&scriptedExecuter{}).
+		once("'lvs'", lvMissing, errExit1).
+		on("'lvs'", "  1073741824\n", nil).
+		on("'blkid'", "", nil)
+	runBackend(t, b, executer, OP_CREATE_VOLUME, map[string]string{
+		CSI_REQ_VOLUME_ID:      "pvc-1",
+		CSI_REQ_CAPACITY_BYTES: "1073741824",
+	})
+	if !executer.ran("'lvcreate' '-T' 'vg0/pool' '-V' '1073741824b' '-n' 'pvc-1'") || !executer.ran("'mkfs.ext4' '/dev/vg0/pvc-1'") {
+		t.Errorf("expected a formatted thin LV, ran %v", executer.commands)
+	}
+
+	// a retry finds the LV and formats it if needed
+	executer = (&scriptedExecuter{}).
+		on("'lvs'", "  1073741824\n", nil).
+		on("'blkid'", "", nil)
+	output := runBackend(t, b, executer, OP_CREATE_VOLUME, map[string]string{
+		CSI_REQ_VOLUME_ID:                  "pvc-1",
+		CSI_REQ_CAPACITY_BYTES:             "1073741824",
+		CSI_REQ_PARAM_PREFIX + FS_TYPE_KEY: "xfs",
+	})
+	for _, cmd := range []string{
+		"'mkfs.xfs' '/dev/vg0/pvc-1'",
+		"'mount' '-o' 'nouuid' '/dev/vg0/pvc-1' '/export/pvc-1'",
+		"Where=/export/pvc-1\nType=xfs\nOptions=nouuid\n",
+		"'/etc/systemd/system/export-pvc\\x2d1.mount.tmp'",
+		"'systemctl' 'enable' 'export-pvc\\x2d1.mount'",
+		"'/export/pvc-1 *(rw,sync,no_subtree_check,no_root_squash,fsid=",
+		"'/etc/exports.d/csi-pvc-1.exports.tmp'",
+		"'exportfs' '-ra'",
+	} {
+		if !executer.ran(cmd) {
+			t.Errorf("expected %s, ran %v", cmd, executer.commands)
+		}
+	}
+	if executer.ran("'lvcreate'") || executer.ran("'lvextend'") {
+		t.Errorf("existing LV should not be created or extended, ran %v", executer.commands)
+	}
+	if output[CSI_REP_CAPACITY_BYTES] != "1073741824" || output[NFS_SHARE_PATH_KEY] != "/export/pvc-1" {
+		t.Errorf("unexpected output %v", output)
+	}
+
+	if _, err := b.Run(context.Background(), executer, OP_CREATE_VOLUME, map[string]string{
+		CSI_REQ_VOLUME_ID:                  "pvc-1",
+		CSI_REQ_CAPACITY_BYTES:             "1",
+		CSI_REQ_PARAM_PREFIX + FS_TYPE_KEY: "btrfs",
+	}); err == nil {
+		t.Error("unsupported fsType should be rejected")
+	}
+}
+
+func TestLvmThinExportClients(t *testing.T) {
+	b := newTestLvmThinBackend(t, map[string]string{"exportClients": "10.0.0.1 10.0.1.0/24", "exportOptions": "rw,sync"})
+	executer := (&scriptedExecuter{}).
+		on("'lvs'", "1073741824\n", nil).
+		on("'blkid'", "ext4\n", nil)
+	runBackend(t, b, executer, OP_CREATE_VOLUME, map[string]string{
+		CSI_REQ_VOLUME_ID:      "pvc-1",
+		CSI_REQ_CAPACITY_BYTES: "1073741824",
+	})
+	if !executer.ran("'/export/pvc-1 10.0.0.1(rw,sync,fsid=", ") 10.0.1.0/24(rw,sync,fsid=") {
+		t.Errorf("expected an entry per client, ran %v", executer.commands)
+	}
+
+	for _, config := range []map[string]string{
+		{"exportClients": "10.0.0.1(rw)"},
+		{"exportsDir": "exports.d"},
+		{"exportRoot": "export"},
+	} {
+		cfg := map[string]string{"volumeGroup": "vg0", "thinPool": "pool", "exportRoot": "/export", "nfsServer": "nas"}
+		for k, v := range config {
+			cfg[k] = v
+		}
+		if _, err := NewBackend(LVM_THIN_BACKEND, cfg); err == nil {
+			t.Errorf("config %v should be rejected", config)
+		}
+	}
+}
+
+func TestMountUnit(t *testing.T) {
+	for mountpoint, unit := range map[string]string{
+		"/export/pvc-1":        "export-pvc\\x2d1.mount",
+		"/srv/nfs/.csi/v1:a_b": "srv-nfs-.csi-v1:a_b.mount",
+		"/srv/my share/":       "srv-my\\x20share.mount",
+	} {
+		if got := mountUnit(mountpoint); got != "/etc/systemd/system/"+unit {
+			t.Errorf("expected unit %s of %s, got %s", unit, mountpoint, got)
+		}
+	}
+}
+
+func TestLvmThinCloneGrows(t *testing.T) {
+	executer := (&scriptedExecuter{}).
+		on("'lvs'", "536870912\n", nil).
+		on("'blkid'", "ext4\n", nil)
+	runBackend(t, newTestLvmThinBackend(t, nil), executer, OP_CREATE_VOLUME, map[string]string{
+		CSI_REQ_VOLUME_ID:       "pvc-2",
+		CSI_REQ_CAPACITY_BYTES:  "1073741824",
+		CSI_REQ_DATA_SOURCE:     "snapshot",
+		CSI_REQ_SRC_SNAPSHOT_ID: "pvc-1@snap-1",
+	})
+	for _, cmd := range []string{
+		"'lvextend' '-L' '1073741824b' 'vg0/pvc-2'",
+		"'resize2fs' '/dev/vg0/pvc-2'",
+	} {
+		if !executer.ran(cmd) {
+			t.Errorf("expected %s, ran %v", cmd, executer.commands)
+		}
+	}
+	if executer.ran("'mkfs") {
+		t.Error("a clone should not be formatted")
+	}
+}
+
+func TestLvmThinExpandVolume(t *testing.T) {
+	executer := (&scriptedExecuter{}).
+		on("'lvs'", "1073741824\n", nil).
+		on("'blkid'", "xfs\n", nil)
+	runBackend(t, newTestLvmThinBackend(t, nil), executer, OP_EXPAND_VOLUME, map[string]string{
+		CSI_REQ_VOLUME_ID:      "pvc-1",
+		CSI_REQ_CAPACITY_BYTES: "2147483648",
+	})
+	if !executer.ran("'lvextend' '-L' '2147483648b' 'vg0/pvc-1'") || !executer.ran("'xfs_growfs' '/export/pvc-1'") {
+		t.Errorf("expected lvextend and xfs_growfs, ran %v", executer.commands)
+	}
+}
+
+func TestLvmThinDeleteVolume(t *testing.T) {
+	b := newTestLvmThinBackend(t, nil)
+	executer := (&scriptedExecuter{}).on("'lvs'", "1024\n", nil)
+	runBackend(t, b, executer, OP_DELETE_VOLUME, map[string]string{CSI_REQ_VOLUME_ID: "pvc-1"})
+	if !executer.ran("'rm' '-f' '/etc/exports.d/csi-pvc-1.exports' && 'exportfs' '-ra'") ||
+		!executer.ran("'umount' '/export/pvc-1'", "'systemctl' 'disable' 'export-pvc\\x2d1.mount'", "'rm' '-f' '/etc/systemd/system/export-pvc\\x2d1.mount'") ||
+		!executer.ran("'lvremove' '-y' 'vg0/pvc-1'") {
+		t.Errorf("expected unexport, umount, mount unit removal and lvremove, ran %v", executer.commands)
+	}
+
+	executer = (&scriptedExecuter{}).on("'lvs'", lvMissing, errExit1)
+	runBackend(t, b, executer, OP_DELETE_VOLUME, map[string]string{CSI_REQ_VOLUME_ID: "pvc-1"})
+	if executer.ran("'lvremove'") {
+		t.Error("deleting a missing LV should succeed without lvremove")
+	}
+
+	if _, err := b.Run(context.Background(), executer, OP_DELETE_VOLUME, map[string]string{CSI_REQ_VOLUME_ID: "snap_1"}); err == nil {
+		t.Error("volume IDs with the snapshot prefix should be rejected")
+	}
+}
+
+func TestLvmThinSnapshots(t *testing.T) {
+	b := newTestLvmThinBackend(t, nil)
+	executer := (&scriptedExecuter{}).
+		once("'lvs'", lvMissing, errExit1).
+		on("'lvs'", "1073741824\n", nil)
+	output := runBackend(t, b, executer, OP_CREATE_SNAPSHOT, map[string]string{
+		CSI_REQ_SRC_VOLUME_ID: "pvc-1",
+		CSI_REQ_SNAPSHOT_NAME: "snap-1",
+	})
+	if !executer.ran("'lvcreate' '-s' '-pr' '--addtag' 'csi_source=pvc-1' '-n' 'snap_snap-1' 'vg0/pvc-1'") {
+		t.Errorf("expected a read-only thin snapshot, ran %v", executer.commands)
+	}
+	if output[CSI_REP_SNAPSHOT_ID] != "pvc-1@snap-1" || output[CSI_REP_CAPACITY_BYTES] != "1073741824" {
+		t.Errorf("unexpected output %v", output)
+	}
+
+	executer = (&scriptedExecuter{}).on("'lvs'",
+		"  pvc-1|1073741824|\n  snap_snap-1|1073741824|csi_source=pvc-1\n  snap_snap-2|536870912|other,csi_source=pvc-2\n  snap_manual|1024|\n", nil)
+	out, err := b.Run(context.Background(), executer, OP_LIST_SNAPSHOTS, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := parseSnapshotList(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 || snapshots[1].SnapshotId != "v1:pvc-2@snap-2" || snapshots[1].SizeBytes != 536870912 {
+		t.Errorf("unexpected snapshots %v", snapshots)
+	}
+	if !strings.Contains(executer.commands[0], "'vg0'") {
+		t.Errorf("expected the volume group to be listed, ran %v", executer.commands)
+	}
+}
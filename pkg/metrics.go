@@ -0,0 +1,116 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const metricsNamespace = "csi_ssh"
+
+var (
+	rpcRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_requests_total",
+		Help:      "CSI RPCs handled, by method and gRPC code.",
+	}, []string{"method", "code"})
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "Latency of CSI RPCs.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 4, 10),
+	}, []string{"method"})
+	hookDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "hook_duration_seconds",
+		Help:      "Duration of hook executions, by operation, server and exit code.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"operation", "server", "exit_code"})
+	sshFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ssh_failures_total",
+		Help:      "SSH connection failures, by server and stage (dial, handshake, session).",
+	}, []string{"server", "stage"})
+	mountDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "mount_duration_seconds",
+		Help:      "Latency of node mount and unmount calls.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"operation", "success"})
+	mountTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mount_timeouts_total",
+		Help:      "Node mount and unmount calls that timed out.",
+	}, []string{"operation"})
+)
+
+var metricsRegistry = prometheus.NewRegistry()
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		rpcRequests, rpcDuration, hookDuration, sshFailures, mountDuration, mountTimeouts,
+	)
+}
+
+// ServeMetrics exposes the prometheus metrics on addr in the background.
+func ServeMetrics(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		slog.Info("Serving metrics", "address", addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("metrics server failed", "err", err)
+		}
+	}()
+	return server
+}
+
+// MetricsInterceptor counts every unary RPC and records its latency.
+func MetricsInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	rpcDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	rpcRequests.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	return resp, err
+}
+
+func observeHook(operation string, server string, start time.Time, err error) {
+	hookDuration.WithLabelValues(operation, server, strconv.Itoa(exitCodeOf(err))).Observe(time.Since(start).Seconds())
+}
+
+// exitCodeOf returns the exit code of a hook, -1 if it did not run to completion.
+func exitCodeOf(err error) int {
+	if err == nil {
+		return 0
+	}
+	var sshErr *ssh.ExitError
+	if errors.As(err, &sshErr) {
+		return sshErr.ExitStatus()
+	}
+	var execErr *exec.ExitError
+	if errors.As(err, &execErr) {
+		return execErr.ExitCode()
+	}
+	return -1
+}
+
+func observeMount(operation string, start time.Time, err error) {
+	mountDuration.WithLabelValues(operation, strconv.FormatBool(err == nil)).Observe(time.Since(start).Seconds())
+	if errors.Is(err, context.DeadlineExceeded) {
+		mountTimeouts.WithLabelValues(operation).Inc()
+	}
+}
@@ -0,0 +1,41 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMetricsInterceptor(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+	before := testutil.ToFloat64(rpcRequests.WithLabelValues(info.FullMethod, codes.Internal.String()))
+	_, err := MetricsInterceptor(context.Background(), nil, info, func(ctx context.Context, req any) (any, error) {
+		return nil, status.Error(codes.Internal, "boom")
+	})
+	if err == nil {
+		t.Fatal("Expected handler error to be returned")
+	}
+	after := testutil.ToFloat64(rpcRequests.WithLabelValues(info.FullMethod, codes.Internal.String()))
+	if after != before+1 {
+		t.Errorf("Expected counter to increase by 1, got %v -> %v", before, after)
+	}
+}
+
+func TestExitCodeOf(t *testing.T) {
+	_, err := exec.Command("sh", "-c", "exit 3").CombinedOutput()
+	if code := exitCodeOf(err); code != 3 {
+		t.Errorf("Expected exit code 3, got %d", code)
+	}
+	if code := exitCodeOf(nil); code != 0 {
+		t.Errorf("Expected exit code 0, got %d", code)
+	}
+	if code := exitCodeOf(errors.New("dial failed")); code != -1 {
+		t.Errorf("Expected exit code -1, got %d", code)
+	}
+}
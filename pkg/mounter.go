@@ -0,0 +1,77 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	mount "k8s.io/mount-utils"
+)
+
+// ContextMounter mounts a filesystem and gives up as soon as ctx is done.
+type ContextMounter interface {
+	MountContext(ctx context.Context, source string, target string, fstype string, options []string) error
+}
+
+var _ ContextMounter = &ExecMounter{}
+
+// ExecMounter runs the mount helper in its own process group, so that a mount
+// hanging on an unreachable server is killed together with its children.
+type ExecMounter struct {
+	*mount.Mounter
+}
+
+func NewExecMounter() *ExecMounter {
+	return &ExecMounter{Mounter: mount.New("").(*mount.Mounter)}
+}
+
+func (m *ExecMounter) MountContext(ctx context.Context, source string, target string, fstype string, options []string) error {
+	cmd := exec.CommandContext(ctx, "mount", mountArgs(source, target, fstype, options)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 5 * time.Second
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return fmt.Errorf("mount %s on %s: %w", source, target, ctx.Err())
+	}
+	if err != nil {
+		return fmt.Errorf("mount %s on %s failed: %w, output: %s", source, target, err, string(out))
+	}
+	return nil
+}
+
+func mountArgs(source string, target string, fstype string, options []string) []string {
+	var args []string
+	if fstype != "" {
+		args = append(args, "-t", fstype)
+	}
+	if len(options) > 0 {
+		args = append(args, "-o", strings.Join(options, ","))
+	}
+	return append(args, source, target)
+}
+
+// mountWithContext uses the mounter's MountContext if it has one. Other mounters
+// run in a goroutine that is abandoned when ctx is done: the mount keeps
+// running after the timeout and may still mount the target later, only the
+// ExecMounter kills it.
+func mountWithContext(ctx context.Context, mounter mount.Interface, source string, target string, fstype string, options []string) error {
+	if cm, ok := mounter.(ContextMounter); ok {
+		return cm.MountContext(ctx, source, target, fstype, options)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- mounter.Mount(source, target, fstype, options)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("mount %s on %s: %w", source, target, ctx.Err())
+	}
+}
@@ -0,0 +1,48 @@
+package pkg
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+)
+
+// hangingMounter never finishes a mount until its context is done.
+type hangingMounter struct {
+	*mount.FakeMounter
+}
+
+func (m *hangingMounter) MountContext(ctx context.Context, source string, target string, fstype string, options []string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestMountArgs(t *testing.T) {
+	args := mountArgs("server:/path", "/mnt", "nfs", []string{"vers=4", "ro"})
+	expected := []string{"-t", "nfs", "-o", "vers=4,ro", "server:/path", "/mnt"}
+	if !slices.Equal(args, expected) {
+		t.Errorf("unexpected args %v, want %v", args, expected)
+	}
+}
+
+func TestNodePublishVolumeMountTimeout(t *testing.T) {
+	driver := newTestNode(&hangingMounter{mount.NewFakeMounter([]mount.MountPoint{})})
+	start := time.Now()
+	_, err := driver.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "test-volume",
+		TargetPath:       t.TempDir(),
+		VolumeCapability: &csi.VolumeCapability{},
+		VolumeContext:    map[string]string{"nfs_server": "test-server", "nfs_path": "/test/path", "mountTimeout": "100ms"},
+	})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("Expected DeadlineExceeded, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("mount timeout was not honored")
+	}
+}
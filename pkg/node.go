@@ -2,24 +2,51 @@ package pkg
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	mount "k8s.io/mount-utils"
 )
 
+const unmountTimeout = 30 * time.Second
+
 type NodeCfg struct {
-	Endpoint        string
-	MountPermission uint64
-	NodeID          string
+	Endpoint        string `yaml:"endpoint"`
+	MountPermission uint64 `yaml:"mountPermission"`
+	NodeID          string `yaml:"nodeID"`
+	// MountTimeout is the default timeout of a NFS mount, StorageClass parameter
+	// mountTimeout overrides it
+	MountTimeout time.Duration `yaml:"mountTimeout"`
+	// BlockStateDir holds the private NFS mounts backing raw block volumes
+	BlockStateDir string `yaml:"blockStateDir"`
+	// HealthCheckInterval is how often published volumes are probed, 0 disables it
+	HealthCheckInterval time.Duration `yaml:"healthCheckInterval"`
+	HealthCheckTimeout  time.Duration `yaml:"healthCheckTimeout"`
+	// KubeletDir is scanned for mounts of pods deleted from the API server,
+	// empty disables it
+	KubeletDir        string        `yaml:"kubeletDir"`
+	ReconcileInterval time.Duration `yaml:"reconcileInterval"`
+	ReconcileDryRun   bool          `yaml:"reconcileDryRun"`
+	// ProbeBinaries are the mount helpers Probe requires to be installed
+	ProbeBinaries []string `yaml:"probeBinaries"`
+	// DrainTimeout is how long running mounts may finish on shutdown
+	DrainTimeout time.Duration `yaml:"drainTimeout"`
+	// TLS secures a tcp Endpoint
+	TLS TLSConfig `yaml:"tls"`
 }
 
 type SshNodeServer struct {
@@ -27,38 +54,65 @@ type SshNodeServer struct {
 	IdentityServer
 	config  NodeCfg
 	mounter mount.Interface
+	loop    LoopDevicer
 	server  *GrpcServer
 	mutex   *StringMutex
+	volumes *VolumeRegistry
+	// pods tells orphaned mounts apart, nil outside a cluster
+	pods PodLister
+	// lazyUnmount detaches a stale mount that can no longer be unmounted cleanly
+	lazyUnmount func(target string) error
 }
 
 func NewNodeServer(config NodeCfg) *SshNodeServer {
-	server, err := NewGrpcServer(config.Endpoint)
+	server, err := NewGrpcServer(config.Endpoint, config.TLS)
 	if err != nil {
 		log.Fatalf("failed to create gRPC server: %v", err)
 	}
-	mounter := mount.New("")
+	var mounter mount.Interface = NewExecMounter()
 	if runtime.GOOS == "linux" {
 		// MounterForceUnmounter is only implemented on Linux now
 		mounter = mounter.(mount.MounterForceUnmounter)
 	}
-	return &SshNodeServer{
-		config:  config,
-		server:  server,
-		mounter: mounter,
-		mutex:   NewStringMutex(),
+	d := &SshNodeServer{
+		config:      config,
+		server:      server,
+		mounter:     mounter,
+		loop:        &LosetupDevicer{},
+		mutex:       NewStringMutex(),
+		volumes:     NewVolumeRegistry(),
+		lazyUnmount: lazyUnmount,
+	}
+	if len(config.ProbeBinaries) > 0 {
+		d.prober = NewProber(binariesProbe(config.ProbeBinaries), 0, time.Minute)
+	}
+	if config.KubeletDir != "" {
+		if d.pods, err = newInClusterPodLister(config.NodeID); err != nil {
+			slog.Warn("orphaned mounts are not detected without the API server", "err", err)
+		}
 	}
+	return d
 }
 
 func (d *SshNodeServer) Run() error {
 	csi.RegisterIdentityServer(d.server.server, d)
 	csi.RegisterNodeServer(d.server.server, d)
+	d.server.DrainTimeout = d.config.DrainTimeout
 
 	slog.Info("Starting SSH Node CSI driver", "name", DriverName, "version", DriverVersion, "endpoint", d.config.Endpoint)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if d.config.KubeletDir != "" {
+		go d.runReconciler(ctx)
+	}
+	if d.config.HealthCheckInterval > 0 {
+		go d.runHealthMonitor(ctx)
+	}
 	return d.server.Run()
 }
 
 func (d *SshNodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	slog.Info("NodePublishVolume called", "volume_id", req.GetVolumeId())
+	Logger(ctx).Info("NodePublishVolume called", "volume_id", req.GetVolumeId())
 	volCap := req.GetVolumeCapability()
 	if volCap == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
@@ -96,6 +150,42 @@ func (d *SshNodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePubl
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%v is a required parameter", NFS_SHARE_PATH_KEY))
 	}
 	source := fmt.Sprintf("%s:%s", nfsServer, nfsPath)
+	mountGroup := -1
+	if group := volCap.GetMount().GetVolumeMountGroup(); group != "" {
+		gid, err := strconv.Atoi(group)
+		if err != nil || gid < 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid volume mount group %q", group)
+		}
+		mountGroup = gid
+	}
+	mountTimeout := d.config.MountTimeout
+	if timeout := params[MOUNT_TIMEOUT_KEY]; timeout != "" {
+		var err error
+		if mountTimeout, err = time.ParseDuration(timeout); err != nil || mountTimeout <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s %q", MOUNT_TIMEOUT_KEY, timeout)
+		}
+	}
+
+	if volCap.GetBlock() != nil {
+		image := params[BLOCK_IMAGE_KEY]
+		if image == "" {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%v is a required parameter for block volume", BLOCK_IMAGE_KEY))
+		}
+		if err := d.publishBlock(ctx, volumeID, source, image, targetPath, req.GetReadonly(), mountTimeout); err != nil {
+			return nil, err
+		}
+		if _, ok := d.volumes.Get(targetPath); !ok {
+			d.volumes.Add(PublishedVolume{
+				VolumeID:     volumeID,
+				Source:       source,
+				TargetPath:   targetPath,
+				ShareDir:     blockMountDir(d.config.BlockStateDir, volumeID),
+				MountTimeout: mountTimeout,
+			})
+		}
+		Logger(ctx).Info("block volume publish succeeded", "volumeID", volumeID, "source", source, "targetPath", targetPath)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
 
 	notMnt, err := d.mounter.IsLikelyNotMountPoint(targetPath)
 	if err != nil {
@@ -108,38 +198,183 @@ func (d *SshNodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePubl
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	}
-	if !notMnt {
-		return &csi.NodePublishVolumeResponse{}, nil
+	published := PublishedVolume{VolumeID: volumeID, Source: source, TargetPath: targetPath, Options: mountOptions, MountTimeout: mountTimeout}
+	if notMnt {
+		Logger(ctx).Info("NodePublishVolume", "volumeID", volumeID, "source", source, "targetPath", targetPath, "mountflags", mountOptions, "timeout", mountTimeout)
+		if err := d.mountNFS(ctx, source, targetPath, mountOptions, mountTimeout); err != nil {
+			return nil, err
+		}
+		d.volumes.Add(published)
+	} else if _, ok := d.volumes.Get(targetPath); !ok {
+		d.volumes.Add(published)
 	}
 
-	slog.InfoContext(ctx, "NodePublishVolume", "volumeID", volumeID, "source", source, "targetPath", targetPath, "mountflags", mountOptions)
-	execFunc := func() error {
-		return d.mounter.Mount(source, targetPath, "nfs", mountOptions)
+	// a retry after a failed chmod or chown finds the target mounted, the
+	// permissions are applied again rather than taken for granted
+	if mountPermission > 0 {
+		mode := os.FileMode(mountPermission)
+		if mountGroup >= 0 {
+			mode |= os.ModeSetgid
+		}
+		if err := chmodIfPermissionMismatch(targetPath, mode); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	} else {
+		Logger(ctx).Warn("skip chmod on targetPath", "targetPath", targetPath, "mountPermissions", mountPermission)
+	}
+	if mountGroup >= 0 {
+		if err := applyMountGroup(targetPath, mountGroup); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to apply volume mount group: %v", err)
+		}
 	}
-	timeoutFunc := func() error { return fmt.Errorf("time out") }
-	if err := WaitUntilTimeout(90*time.Second, execFunc, timeoutFunc); err != nil {
-		if os.IsPermission(err) {
-			return nil, status.Error(codes.PermissionDenied, err.Error())
+	Logger(ctx).Info("volume mount succeeded", "volumeID", volumeID, "source", source, "targetPath", targetPath)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+func (d *SshNodeServer) mountNFS(ctx context.Context, source string, targetPath string, mountOptions []string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ctx, span := tracer.Start(ctx, "mount", trace.WithAttributes(
+		attribute.String("mount.source", source),
+		attribute.String("mount.target", targetPath),
+	))
+	start := time.Now()
+	err := mountWithContext(ctx, d.mounter, source, targetPath, "nfs", mountOptions)
+	observeMount("mount", start, err)
+	endSpan(span, err)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return status.Error(codes.DeadlineExceeded, err.Error())
+		}
+		if errors.Is(err, context.Canceled) {
+			return status.Error(codes.Canceled, err.Error())
+		}
+		if os.IsPermission(err) || strings.Contains(err.Error(), "access denied") {
+			return status.Error(codes.PermissionDenied, err.Error())
 		}
 		if strings.Contains(err.Error(), "invalid argument") {
-			return nil, status.Error(codes.InvalidArgument, err.Error())
+			return status.Error(codes.InvalidArgument, err.Error())
 		}
-		return nil, status.Error(codes.Internal, err.Error())
+		return status.Error(codes.Internal, err.Error())
 	}
+	return nil
+}
 
-	if mountPermission > 0 {
-		if err := chmodIfPermissionMismatch(targetPath, os.FileMode(mountPermission)); err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
+// publishBlock mounts the NFS share privately, attaches the image file as a loop
+// device and bind mounts the device node to targetPath. The share and the loop
+// device are set up once per volume and shared by its target paths, two loop
+// devices on one image would cache its blocks apart.
+func (d *SshNodeServer) publishBlock(ctx context.Context, volumeID string, source string, image string, targetPath string, readonly bool, mountTimeout time.Duration) error {
+	mutexKey := "block-" + volumeID
+	if acquired := d.mutex.TryLock(mutexKey); !acquired {
+		return status.Errorf(codes.Aborted, "block volume operation already exists: %s", volumeID)
+	}
+	defer d.mutex.UnLock(mutexKey)
+	mountDir := blockMountDir(d.config.BlockStateDir, volumeID)
+	if err := os.MkdirAll(mountDir, 0750); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	notMnt, err := d.mounter.IsLikelyNotMountPoint(mountDir)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if notMnt {
+		Logger(ctx).Info("mounting block volume share", "source", source, "mountDir", mountDir)
+		if err := d.mountNFS(ctx, source, mountDir, nil, mountTimeout); err != nil {
+			return err
 		}
-	} else {
-		slog.WarnContext(ctx, "skip chmod on targetPath", "targetPath", targetPath, "mountPermissions", mountPermission)
 	}
-	slog.InfoContext(ctx, "volume mount succeeded", "volumeID", volumeID, "source", source, "targetPath", targetPath)
-	return &csi.NodePublishVolumeResponse{}, nil
+
+	imagePath := filepath.Join(mountDir, image)
+	if !strings.HasPrefix(imagePath, mountDir+string(os.PathSeparator)) {
+		return status.Errorf(codes.InvalidArgument, "%s escapes the volume share", BLOCK_IMAGE_KEY)
+	}
+	devices, err := d.loop.List()
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	device := ""
+	for dev, backing := range devices {
+		if backing == imagePath {
+			device = dev
+			break
+		}
+	}
+	if device == "" {
+		device, err = d.loop.Attach(imagePath)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		Logger(ctx).Info("attached loop device", "device", device, "image", imagePath)
+	}
+	if err := addBlockTarget(mountDir, targetPath); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0750); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	f, err := os.OpenFile(targetPath, os.O_CREATE, 0660)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	f.Close()
+	notMnt, err = d.mounter.IsLikelyNotMountPoint(targetPath)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if !notMnt {
+		return nil
+	}
+	options := []string{"bind"}
+	if readonly {
+		options = append(options, "ro")
+	}
+	if err := d.mounter.Mount(device, targetPath, "", options); err != nil {
+		return status.Errorf(codes.Internal, "failed to bind mount %s to %s: %v", device, targetPath, err)
+	}
+	return nil
+}
+
+// unpublishBlock detaches the loop devices and releases the private share mount
+// of a block volume once no target path uses them. It is a no-op for
+// filesystem volumes.
+func (d *SshNodeServer) unpublishBlock(ctx context.Context, volumeID string, targetPath string) error {
+	mountDir := blockMountDir(d.config.BlockStateDir, volumeID)
+	if _, err := os.Stat(mountDir); os.IsNotExist(err) {
+		return nil
+	}
+	mutexKey := "block-" + volumeID
+	if acquired := d.mutex.TryLock(mutexKey); !acquired {
+		return status.Errorf(codes.Aborted, "block volume operation already exists: %s", volumeID)
+	}
+	defer d.mutex.UnLock(mutexKey)
+	remaining, err := removeBlockTarget(mountDir, targetPath)
+	if err != nil {
+		return err
+	}
+	if remaining > 0 {
+		Logger(ctx).Info("keeping loop device for other targets", "volumeID", volumeID, "targets", remaining)
+		return nil
+	}
+	devices, err := loopDevicesUnder(d.loop, mountDir)
+	if err != nil {
+		return err
+	}
+	for _, dev := range devices {
+		Logger(ctx).Info("detaching loop device", "device", dev, "targetPath", targetPath)
+		if err := d.loop.Detach(dev); err != nil {
+			return err
+		}
+	}
+	if err := mount.CleanupMountPoint(mountDir, d.mounter, true); err != nil {
+		return err
+	}
+	return os.RemoveAll(blockTargetsDir(mountDir))
 }
 
 func (d *SshNodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	slog.Info("NodeUnpublishVolume called", "volume_id", req.GetVolumeId())
+	Logger(ctx).Info("NodeUnpublishVolume called", "volume_id", req.GetVolumeId())
 	volumeID := req.GetVolumeId()
 	if volumeID == "" {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
@@ -155,26 +390,38 @@ func (d *SshNodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUn
 	}
 	defer d.mutex.UnLock(mutexKey)
 
-	slog.InfoContext(ctx, "NodeUnpublishVolume: unmounting volume", "volumeID", volumeID, "targetPath", targetPath)
+	Logger(ctx).Info("NodeUnpublishVolume: unmounting volume", "volumeID", volumeID, "targetPath", targetPath)
 	var err error
 	extensiveMountPointCheck := true
+	_, span := tracer.Start(ctx, "unmount", trace.WithAttributes(attribute.String("mount.target", targetPath)))
+	start := time.Now()
 	forceUnmounter, ok := d.mounter.(mount.MounterForceUnmounter)
 	if ok {
-		slog.Info("force unmount", "volumeID", volumeID, "targetPath", targetPath)
-		err = mount.CleanupMountWithForce(targetPath, forceUnmounter, extensiveMountPointCheck, 30*time.Second)
+		Logger(ctx).Info("force unmount", "volumeID", volumeID, "targetPath", targetPath)
+		err = mount.CleanupMountWithForce(targetPath, forceUnmounter, extensiveMountPointCheck, unmountTimeout)
+		if time.Since(start) >= unmountTimeout {
+			// the plain umount timed out and had to be forced
+			mountTimeouts.WithLabelValues("unmount").Inc()
+		}
 	} else {
 		err = mount.CleanupMountPoint(targetPath, d.mounter, extensiveMountPointCheck)
 	}
+	observeMount("unmount", start, err)
+	endSpan(span, err)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to unmount target %q: %v", targetPath, err)
 	}
-	slog.Info("NodeUnpublishVolume: unmount volume", "volumeID", volumeID, "targetPath", targetPath)
+	d.volumes.Remove(targetPath)
+	if err := d.unpublishBlock(ctx, volumeID, targetPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to release block volume at %q: %v", targetPath, err)
+	}
+	Logger(ctx).Info("NodeUnpublishVolume: unmount volume", "volumeID", volumeID, "targetPath", targetPath)
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
 func (d *SshNodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	slog.DebugContext(ctx, "NodeGetCapabilities called")
+	Logger(ctx).Debug("NodeGetCapabilities called")
 	return &csi.NodeGetCapabilitiesResponse{
 		Capabilities: []*csi.NodeServiceCapability{
 			{
@@ -191,10 +438,136 @@ func (d *SshNodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGe
 					},
 				},
 			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+					},
+				},
+			},
 		},
 	}, nil
 }
 
+func (d *SshNodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	Logger(ctx).Debug("NodeGetVolumeStats called", "volume_id", req.GetVolumeId(), "volume_path", req.GetVolumePath())
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	volumePath := req.GetVolumePath()
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
+	}
+	stat, err := probePath(volumePath, d.config.HealthCheckTimeout, nil)
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "volume path %s does not exist", volumePath)
+	}
+	condition := &csi.VolumeCondition{Message: "volume is healthy"}
+	if vol, ok := d.volumes.Get(volumePath); ok && vol.Abnormal {
+		condition = &csi.VolumeCondition{Abnormal: true, Message: vol.Message}
+	}
+	if err != nil {
+		condition = &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("volume probe failed: %v", err)}
+		return &csi.NodeGetVolumeStatsResponse{VolumeCondition: condition}, nil
+	}
+	// the probe answered, so stat does not hang on the volume path
+	isBlock, err := isBlockTarget(volumePath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if isBlock {
+		// the device file tells nothing, the share holding the image does
+		mountDir := blockMountDir(d.config.BlockStateDir, req.GetVolumeId())
+		if _, err := probePath(mountDir, d.config.HealthCheckTimeout, nil); err != nil && !condition.Abnormal {
+			condition = &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("block volume share probe failed: %v", err)}
+		}
+		return &csi.NodeGetVolumeStatsResponse{VolumeCondition: condition}, nil
+	}
+	bsize := int64(stat.Bsize)
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     int64(stat.Blocks) * bsize,
+				Available: int64(stat.Bavail) * bsize,
+				Used:      int64(stat.Blocks-stat.Bfree) * bsize,
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Total:     int64(stat.Files),
+				Available: int64(stat.Ffree),
+				Used:      int64(stat.Files - stat.Ffree),
+			},
+		},
+		VolumeCondition: condition,
+	}, nil
+}
+
+func (d *SshNodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	Logger(ctx).Info("NodeExpandVolume called", "volume_id", req.GetVolumeId(), "volume_path", req.GetVolumePath())
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	volumePath := req.GetVolumePath()
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
+	}
+	isBlock := req.GetVolumeCapability().GetBlock() != nil
+	if req.GetVolumeCapability() == nil {
+		var err error
+		if isBlock, err = isBlockTarget(volumePath); os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume path %s does not exist", volumePath)
+		} else if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if !isBlock {
+		// filesystem volumes grow on the server, nothing to do on the node
+		return &csi.NodeExpandVolumeResponse{}, nil
+	}
+	mountDir := blockMountDir(d.config.BlockStateDir, req.GetVolumeId())
+	if _, err := os.Stat(mountDir); os.IsNotExist(err) {
+		return nil, status.Errorf(codes.FailedPrecondition, "block volume %s is not published on this node, %s is missing", req.GetVolumeId(), mountDir)
+	}
+	devices, err := loopDevicesUnder(d.loop, mountDir)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if len(devices) == 0 {
+		return nil, status.Errorf(codes.NotFound, "no loop device found for %s", volumePath)
+	}
+	for _, dev := range devices {
+		if err := d.loop.Resize(dev); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		Logger(ctx).Info("resized loop device", "device", dev, "volume_path", volumePath)
+	}
+	return &csi.NodeExpandVolumeResponse{
+		CapacityBytes: req.GetCapacityRange().GetRequiredBytes(),
+	}, nil
+}
+
 func (d *SshNodeServer) NodeGetInfo(_ context.Context, _ *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
 	return &csi.NodeGetInfoResponse{
 		NodeId: d.config.NodeID,
@@ -203,12 +576,15 @@ func (d *SshNodeServer) NodeGetInfo(_ context.Context, _ *csi.NodeGetInfoRequest
 
 var _ csi.NodeServer = &SshNodeServer{}
 
+// chmodIfPermissionMismatch sets the permissions and setgid bit of target to
+// mode, a setgid bit set on the server is kept.
 func chmodIfPermissionMismatch(target string, mode os.FileMode) error {
 	info, err := os.Lstat(target)
 	if err != nil {
 		return err
 	}
-	perm := info.Mode() & os.ModePerm
+	perm := info.Mode() & (os.ModePerm | os.ModeSetgid)
+	mode |= info.Mode() & os.ModeSetgid
 	if perm != mode {
 		slog.Info("chmod", "targetPath", target, "mode", fmt.Sprintf("0%o", mode), "permissions", fmt.Sprintf("0%o", info.Mode()))
 		if err := os.Chmod(target, mode); err != nil {
@@ -219,3 +595,29 @@ func chmodIfPermissionMismatch(target string, mode os.FileMode) error {
 	}
 	return nil
 }
+
+// applyMountGroup hands the volume root to gid and sets the setgid bit, so new
+// files inherit the group. It replaces kubelet's recursive fsGroup chown.
+func applyMountGroup(target string, gid int) error {
+	info, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || int(stat.Gid) != gid {
+		slog.Info("chown volume root", "targetPath", target, "gid", gid)
+		if err := os.Chown(target, -1, gid); err != nil {
+			if errors.Is(err, syscall.EPERM) {
+				return fmt.Errorf("%w, the server squashes root: set the %s StorageClass parameter to assign the group on the server", err, MOUNT_GROUP_KEY)
+			}
+			return err
+		}
+	}
+	mode := info.Mode()&(os.ModePerm|os.ModeSetgid) | 0070 | os.ModeSetgid
+	if mode != info.Mode()&(os.ModePerm|os.ModeSetgid) {
+		slog.Info("chmod volume root for group", "targetPath", target, "mode", fmt.Sprintf("0%o", mode.Perm()))
+		if err := os.Chmod(target, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -3,20 +3,29 @@ package pkg
 import (
 	"context"
 	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	mount "k8s.io/mount-utils"
 )
 
 func newTestNode(mounter mount.Interface) *SshNodeServer {
 	cfg := NodeCfg{
-		Endpoint:        "unix:///tmp/csi.sock",
-		MountPermission: 0755,
-		NodeID:          "test-node",
+		Endpoint:           "unix:///tmp/csi.sock",
+		MountPermission:    0755,
+		NodeID:             "test-node",
+		BlockStateDir:      os.TempDir(),
+		HealthCheckTimeout: 5 * time.Second,
+		MountTimeout:       5 * time.Second,
 	}
 	server := NewNodeServer(cfg)
 	server.mounter = mounter
+	server.loop = newFakeLoopDevicer()
 	return server
 }
 
@@ -38,6 +47,37 @@ func TestNodePublishVolume(t *testing.T) {
 	}
 }
 
+func TestNodePublishVolumeRetryAppliesPermissions(t *testing.T) {
+	// the first attempt mounted the share and failed before the chmod
+	target := t.TempDir()
+	if err := os.Chmod(target, 0700); err != nil {
+		t.Fatal(err)
+	}
+	mockMounter := mount.NewFakeMounter([]mount.MountPoint{{Device: "test-server:/test/path", Path: target, Type: "nfs"}})
+	driver := newTestNode(mockMounter)
+	_, err := driver.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:   "test-volume",
+		TargetPath: target,
+		VolumeCapability: &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{VolumeMountGroup: strconv.Itoa(os.Getgid())},
+		}},
+		VolumeContext: map[string]string{"nfs_server": "test-server", "nfs_path": "/test/path"},
+	})
+	if err != nil {
+		t.Fatalf("NodePublishVolume failed: %v", err)
+	}
+	if logs := mockMounter.GetLog(); len(logs) != 0 {
+		t.Errorf("a mounted target should not be mounted again, got %+v", logs)
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModePerm != 0775 || info.Mode()&os.ModeSetgid == 0 {
+		t.Errorf("expected the permissions and mount group applied on retry, got %v", info.Mode())
+	}
+}
+
 func TestNodeUnpublishVolume(t *testing.T) {
 	temp_mount_dir, err := os.MkdirTemp(os.TempDir(), "test-")
 	defer os.RemoveAll(temp_mount_dir)
@@ -65,7 +105,168 @@ func TestNodeGetCapabilities(t *testing.T) {
 	if err != nil {
 		t.Fatalf("NodeGetCapabilities failed: %v", err)
 	}
-	if len(resp.Capabilities) != 2 {
-		t.Fatalf("Expected 2 capabilities, got %d: %+v", len(resp.Capabilities), resp.Capabilities)
+	if len(resp.Capabilities) != 6 {
+		t.Fatalf("Expected 6 capabilities, got %d: %+v", len(resp.Capabilities), resp.Capabilities)
+	}
+}
+
+func TestNodePublishBlockVolume(t *testing.T) {
+	stateDir := t.TempDir()
+	targetPath := filepath.Join(t.TempDir(), "dev", "pod-uid")
+	mockMounter := mount.NewFakeMounter([]mount.MountPoint{})
+	driver := newTestNode(mockMounter)
+	driver.config.BlockStateDir = stateDir
+	loop := driver.loop.(*fakeLoopDevicer)
+	_, err := driver.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:   "test-volume",
+		TargetPath: targetPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		},
+		VolumeContext: map[string]string{"nfs_server": "test-server", "nfs_path": "/test/path", "block_image": "disk.img"},
+	})
+	if err != nil {
+		t.Fatalf("NodePublishVolume failed: %v", err)
+	}
+	if len(loop.devices) != 1 {
+		t.Fatalf("Expected 1 loop device, got %v", loop.devices)
+	}
+	logs := mockMounter.GetLog()
+	if len(logs) != 2 {
+		t.Fatalf("Expected nfs mount and bind mount, got %d: %+v", len(logs), logs)
+	}
+	if logs[1].Source != "/dev/loop0" || logs[1].Target != targetPath {
+		t.Errorf("unexpected bind mount %+v", logs[1])
+	}
+	if vol, ok := driver.volumes.Get(targetPath); !ok || vol.ShareDir != blockMountDir(stateDir, "test-volume") {
+		t.Errorf("expected the block volume registered with its share, got %+v", vol)
+	}
+
+	_, err = driver.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+		VolumeId:   "test-volume",
+		VolumePath: targetPath,
+	})
+	if err != nil {
+		t.Fatalf("NodeExpandVolume failed: %v", err)
+	}
+	if len(loop.resized) != 1 {
+		t.Errorf("Expected loop device resized, got %v", loop.resized)
+	}
+
+	_, err = driver.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   "test-volume",
+		TargetPath: targetPath,
+	})
+	if err != nil {
+		t.Fatalf("NodeUnpublishVolume failed: %v", err)
+	}
+	if len(loop.devices) != 0 {
+		t.Errorf("Expected loop device detached, got %v", loop.devices)
+	}
+	if _, ok := driver.volumes.Get(targetPath); ok {
+		t.Errorf("the block volume should leave the registry")
+	}
+}
+
+func TestNodePublishBlockVolumeTwice(t *testing.T) {
+	mockMounter := mount.NewFakeMounter([]mount.MountPoint{})
+	driver := newTestNode(mockMounter)
+	driver.config.BlockStateDir = t.TempDir()
+	loop := driver.loop.(*fakeLoopDevicer)
+	targets := []string{filepath.Join(t.TempDir(), "pod-1"), filepath.Join(t.TempDir(), "pod-2")}
+	for _, targetPath := range targets {
+		_, err := driver.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:   "test-volume",
+			TargetPath: targetPath,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			},
+			VolumeContext: map[string]string{"nfs_server": "test-server", "nfs_path": "/test/path", "block_image": "disk.img"},
+		})
+		if err != nil {
+			t.Fatalf("NodePublishVolume failed: %v", err)
+		}
+	}
+	if len(loop.devices) != 1 {
+		t.Fatalf("the targets of a volume should share its loop device, got %v", loop.devices)
+	}
+	if logs := mockMounter.GetLog(); len(logs) != 3 || logs[2].Source != "/dev/loop0" {
+		t.Fatalf("expected one share mount and two bind mounts of /dev/loop0, got %+v", logs)
+	}
+
+	unpublish := func(targetPath string) {
+		if _, err := driver.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   "test-volume",
+			TargetPath: targetPath,
+		}); err != nil {
+			t.Fatalf("NodeUnpublishVolume failed: %v", err)
+		}
+	}
+	unpublish(targets[0])
+	if len(loop.devices) != 1 {
+		t.Errorf("the loop device should stay attached for the other target, got %v", loop.devices)
+	}
+	unpublish(targets[1])
+	if len(loop.devices) != 0 {
+		t.Errorf("expected the loop device detached with the last target, got %v", loop.devices)
+	}
+}
+
+func TestBlockVolumeWithoutState(t *testing.T) {
+	driver := newTestNode(mount.NewFakeMounter([]mount.MountPoint{}))
+	driver.config.BlockStateDir = t.TempDir()
+	// the device file kubelet publishes a block volume at
+	target := filepath.Join(t.TempDir(), "pod-uid")
+	if err := os.WriteFile(target, nil, 0660); err != nil {
+		t.Fatal(err)
+	}
+	_, err := driver.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+		VolumeId:         "test-volume",
+		VolumePath:       target,
+		VolumeCapability: &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}},
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expanding a block volume without its loop device should fail, got %v", err)
+	}
+	resp, err := driver.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "test-volume", VolumePath: target})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.VolumeCondition.GetAbnormal() || len(resp.Usage) != 0 {
+		t.Errorf("a block volume without its share should be abnormal, got %+v", resp)
+	}
+}
+
+func TestApplyMountGroup(t *testing.T) {
+	target := t.TempDir()
+	if err := os.Chmod(target, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyMountGroup(target, os.Getgid()); err != nil {
+		t.Fatalf("applyMountGroup failed: %v", err)
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSetgid == 0 || info.Mode().Perm() != 0770 {
+		t.Errorf("Expected setgid and group rwx, got %v", info.Mode())
+	}
+}
+
+func TestChmodKeepsSetgid(t *testing.T) {
+	target := t.TempDir()
+	if err := os.Chmod(target, 0770|os.ModeSetgid); err != nil {
+		t.Fatal(err)
+	}
+	if err := chmodIfPermissionMismatch(target, 0775); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0775 || info.Mode()&os.ModeSetgid == 0 {
+		t.Errorf("expected 0775 with the setgid bit of the server, got %v", info.Mode())
 	}
 }
@@ -0,0 +1,128 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// HookOutput is the parsed response of an operation run by an Operator, Hook
+// names the operation.
+type HookOutput struct {
+	Hook   string            `json:"hook"`
+	Output map[string]string `json:"output"`
+}
+
+// hookRecorder keeps the parsed response of every operation run through the
+// controller, the outputs are already redacted.
+type hookRecorder struct {
+	mu      sync.Mutex
+	outputs []HookOutput
+}
+
+// record is a no-op on a nil recorder, so the driver does not keep outputs.
+func (r *hookRecorder) record(operation string, out []byte) {
+	if r == nil {
+		return
+	}
+	output, _ := parseShellResponse(out)
+	r.mu.Lock()
+	r.outputs = append(r.outputs, HookOutput{Hook: operation, Output: redactor.RedactEnv(output)})
+	r.mu.Unlock()
+}
+
+// Operator invokes controller operations for the operator command line, either
+// in process through the configured hooks or as a client of a running driver.
+type Operator struct {
+	csi.ControllerClient
+	recorder *hookRecorder
+	close    func()
+}
+
+// NewDirectOperator serves an offline controller over an in-memory connection,
+// so the requests go through the same interceptors and validation as the
+// driver.
+func NewDirectOperator(config ControllerCfg, local bool) (*Operator, error) {
+	d := NewOfflineController(config, local)
+	recorder := &hookRecorder{}
+	d.recorder = recorder
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(LoggingInterceptor))
+	csi.RegisterControllerServer(server, d)
+	go server.Serve(listener)
+	conn, err := grpc.NewClient("passthrough:///offline",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		server.Stop()
+		return nil, fmt.Errorf("failed to connect to the offline controller: %w", err)
+	}
+	return &Operator{
+		ControllerClient: csi.NewControllerClient(conn),
+		recorder:         recorder,
+		close: func() {
+			conn.Close()
+			server.Stop()
+		},
+	}, nil
+}
+
+// NewClientOperator connects to the controller of a running driver listening on
+// endpoint, a unix socket or a tcp address, secured with TLS if tlsConfig is
+// enabled.
+func NewClientOperator(endpoint string, tlsConfig ClientTLSConfig) (*Operator, error) {
+	scheme, addr, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse endpoint: %w", err)
+	}
+	target := addr
+	if scheme == "unix" {
+		target = "unix://" + addr
+	}
+	creds := insecure.NewCredentials()
+	if tlsConfig.Enabled() {
+		if scheme == "unix" {
+			return nil, fmt.Errorf("TLS is only supported on tcp endpoints, got %s", endpoint)
+		}
+		config, err := newClientTLSConfig(tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		creds = credentials.NewTLS(config)
+	}
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", endpoint, err)
+	}
+	return &Operator{
+		ControllerClient: csi.NewControllerClient(conn),
+		close:            func() { conn.Close() },
+	}, nil
+}
+
+// HookOutputs returns the responses of the hooks run since the last call, it
+// is always empty for a client of a running driver.
+func (o *Operator) HookOutputs() []HookOutput {
+	if o.recorder == nil {
+		return nil
+	}
+	o.recorder.mu.Lock()
+	defer o.recorder.mu.Unlock()
+	outputs := o.recorder.outputs
+	o.recorder.outputs = nil
+	return outputs
+}
+
+func (o *Operator) Close() {
+	o.close()
+}
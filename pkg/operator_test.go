@@ -0,0 +1,118 @@
+package pkg
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestDirectOperator(t *testing.T) {
+	op, err := NewDirectOperator(ControllerCfg{
+		CreateCmd: "sh ../test/create_volume.sh",
+	}, true)
+	if err != nil {
+		t.Fatalf("NewDirectOperator failed: %v", err)
+	}
+	defer op.Close()
+
+	resp, err := op.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "test-volume",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	if resp.Volume.VolumeId != CSI_VOLUME_ID_PREFIX+"test-volume" {
+		t.Errorf("unexpected volume %v", resp.Volume)
+	}
+	hooks := op.HookOutputs()
+	if len(hooks) != 1 || hooks[0].Hook != OP_CREATE_VOLUME || hooks[0].Output[NFS_SHARE_PATH_KEY] != "/export/test-volume" {
+		t.Errorf("expected the create hook output, got %v", hooks)
+	}
+	if len(op.HookOutputs()) != 0 {
+		t.Error("hook outputs should be reset after they are read")
+	}
+}
+
+func TestClientOperator(t *testing.T) {
+	endpoint := "unix://" + filepath.Join(t.TempDir(), "csi.sock")
+	driver := NewController(ControllerCfg{
+		Endpoint:         endpoint,
+		ListSnapshotsCmd: "sh ../test/list_snapshots.sh",
+	})
+	driver.executer = &LocalExecuter{}
+	csi.RegisterControllerServer(driver.server.server, driver)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go driver.server.RunContext(ctx)
+
+	op, err := NewClientOperator(endpoint, ClientTLSConfig{})
+	if err != nil {
+		t.Fatalf("NewClientOperator failed: %v", err)
+	}
+	defer op.Close()
+	resp, err := op.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{})
+	if err != nil {
+		t.Fatalf("ListSnapshots failed: %v", err)
+	}
+	if len(resp.Entries) != 2 {
+		t.Errorf("expected 2 snapshots, got %v", resp.Entries)
+	}
+	if op.HookOutputs() != nil {
+		t.Error("a client operator does not see hook outputs")
+	}
+}
+
+func TestClientOperatorMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	config := TLSConfig{
+		CertFile:     filepath.Join(dir, "tls.crt"),
+		KeyFile:      filepath.Join(dir, "tls.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	}
+	ca := newTestCert(t, 1, nil, true)
+	ca.write(t, config.ClientCAFile, "", time.Now())
+	newTestCert(t, 2, ca, false).write(t, config.CertFile, config.KeyFile, time.Now())
+	driver := NewController(ControllerCfg{
+		Endpoint:         "tcp://127.0.0.1:0",
+		TLS:              config,
+		ListSnapshotsCmd: "sh ../test/list_snapshots.sh",
+	})
+	driver.executer = &LocalExecuter{}
+	csi.RegisterControllerServer(driver.server.server, driver)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go driver.server.RunContext(ctx)
+	endpoint := "tcp://" + driver.server.listener.Addr().String()
+
+	clientTLS := ClientTLSConfig{
+		CAFile:   config.ClientCAFile,
+		CertFile: filepath.Join(dir, "client.crt"),
+		KeyFile:  filepath.Join(dir, "client.key"),
+	}
+	newTestCert(t, 3, ca, false).write(t, clientTLS.CertFile, clientTLS.KeyFile, time.Now())
+
+	list := func(tlsConfig ClientTLSConfig) error {
+		op, err := NewClientOperator(endpoint, tlsConfig)
+		if err != nil {
+			t.Fatalf("NewClientOperator failed: %v", err)
+		}
+		defer op.Close()
+		callCtx, callCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer callCancel()
+		_, err = op.ListSnapshots(callCtx, &csi.ListSnapshotsRequest{})
+		return err
+	}
+	if err := list(ClientTLSConfig{CAFile: clientTLS.CAFile}); err == nil {
+		t.Fatal("client without certificate should be rejected")
+	}
+	if err := list(clientTLS); err != nil {
+		t.Fatalf("ListSnapshots over TLS failed: %v", err)
+	}
+	if _, err := NewClientOperator("unix://"+filepath.Join(dir, "csi.sock"), clientTLS); err == nil {
+		t.Fatal("TLS on a unix endpoint should be rejected")
+	}
+}
@@ -0,0 +1,117 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// PodLister returns the UIDs of the pods scheduled to this node. A pod whose
+// UID is missing has been deleted from the API server, its mounts are orphans.
+type PodLister interface {
+	PodUIDs(ctx context.Context) (map[string]bool, error)
+}
+
+// apiServerPodLister lists the pods of a node with the service account of the
+// node plugin, which needs to list pods.
+type apiServerPodLister struct {
+	client    *http.Client
+	server    string
+	tokenFile string
+	nodeName  string
+}
+
+// newInClusterPodLister returns a PodLister for the API server the pod runs
+// in, it fails outside a cluster.
+func newInClusterPodLister(nodeName string) (PodLister, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate found in %s/ca.crt", serviceAccountDir)
+	}
+	return &apiServerPodLister{
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}},
+		},
+		server:    "https://" + net.JoinHostPort(host, port),
+		tokenFile: serviceAccountDir + "/token",
+		nodeName:  nodeName,
+	}, nil
+}
+
+type podList struct {
+	Metadata struct {
+		Continue string `json:"continue"`
+	} `json:"metadata"`
+	Items []struct {
+		Metadata struct {
+			UID string `json:"uid"`
+		} `json:"metadata"`
+	} `json:"items"`
+}
+
+func (l *apiServerPodLister) PodUIDs(ctx context.Context) (map[string]bool, error) {
+	uids := map[string]bool{}
+	query := url.Values{"fieldSelector": {"spec.nodeName=" + l.nodeName}, "limit": {"500"}}
+	for {
+		list, err := l.list(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		for _, pod := range list.Items {
+			uids[pod.Metadata.UID] = true
+		}
+		if list.Metadata.Continue == "" {
+			return uids, nil
+		}
+		query.Set("continue", list.Metadata.Continue)
+	}
+}
+
+func (l *apiServerPodLister) list(ctx context.Context, query url.Values) (*podList, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.server+"/api/v1/pods?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// the token is read on every request, kubelet rotates it
+	if l.tokenFile != "" {
+		token, err := os.ReadFile(l.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("listing the pods of node %s failed: %w", l.nodeName, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("listing the pods of node %s failed: %s, %s", l.nodeName, resp.Status, strings.TrimSpace(string(body)))
+	}
+	list := &podList{}
+	if err := json.NewDecoder(resp.Body).Decode(list); err != nil {
+		return nil, fmt.Errorf("invalid pod list: %w", err)
+	}
+	return list, nil
+}
@@ -0,0 +1,38 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestApiServerPodLister(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/pods" || r.URL.Query().Get("fieldSelector") != "spec.nodeName=node-1" {
+			http.Error(w, "unexpected request "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("continue") == "" {
+			fmt.Fprint(w, `{"metadata":{"continue":"next"},"items":[{"metadata":{"uid":"pod-1"}}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"metadata":{},"items":[{"metadata":{"uid":"pod-2"}}]}`)
+	}))
+	defer server.Close()
+
+	lister := &apiServerPodLister{client: server.Client(), server: server.URL, nodeName: "node-1"}
+	uids, err := lister.PodUIDs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uids) != 2 || !uids["pod-1"] || !uids["pod-2"] {
+		t.Errorf("expected the pods of both pages, got %v", uids)
+	}
+
+	lister.nodeName = "node-2"
+	if _, err := lister.PodUIDs(context.Background()); err == nil {
+		t.Error("expected the error of the API server")
+	}
+}
@@ -0,0 +1,73 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+type ProbeFunc func(ctx context.Context) error
+
+// Prober runs a readiness check with a timeout and caches its result, so that
+// frequent liveness probes don't hammer the storage server.
+type Prober struct {
+	check   ProbeFunc
+	timeout time.Duration
+	ttl     time.Duration
+
+	mu      sync.Mutex
+	checked time.Time
+	lastErr error
+}
+
+func NewProber(check ProbeFunc, timeout time.Duration, ttl time.Duration) *Prober {
+	return &Prober{
+		check:   check,
+		timeout: timeout,
+		ttl:     ttl,
+	}
+}
+
+// Check returns the cached result if it is fresher than the ttl, it runs the
+// check otherwise.
+func (p *Prober) Check(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.checked.IsZero() && time.Since(p.checked) < p.ttl {
+		return p.lastErr
+	}
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+	p.lastErr = p.check(ctx)
+	p.checked = time.Now()
+	return p.lastErr
+}
+
+// executerProbe checks that cmd runs on the storage server, which includes the
+// SSH handshake for a SshExecuter.
+func executerProbe(executer Executer, cmd string) ProbeFunc {
+	return func(ctx context.Context) error {
+		out, err := executer.ExecuteCommand(ctx, cmd, map[string]string{})
+		if err != nil {
+			return fmt.Errorf("probe command failed: %w, output: %s", err, string(out))
+		}
+		return nil
+	}
+}
+
+// binariesProbe checks that the mount helpers the node plugin needs are installed.
+func binariesProbe(binaries []string) ProbeFunc {
+	return func(ctx context.Context) error {
+		for _, bin := range binaries {
+			if _, err := exec.LookPath(bin); err != nil {
+				return fmt.Errorf("mount helper %s not found: %w", bin, err)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,43 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestProberCachesResult(t *testing.T) {
+	calls := 0
+	prober := NewProber(func(ctx context.Context) error {
+		calls++
+		return errors.New("unreachable")
+	}, time.Second, time.Minute)
+	for i := 0; i < 3; i++ {
+		if err := prober.Check(context.Background()); err == nil {
+			t.Fatal("Expected probe error")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 check within ttl, got %d", calls)
+	}
+}
+
+func TestProberTimeout(t *testing.T) {
+	prober := NewProber(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, 10*time.Millisecond, 0)
+	if err := prober.Check(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestBinariesProbe(t *testing.T) {
+	if err := binariesProbe([]string{"sh"})(context.Background()); err != nil {
+		t.Errorf("Expected sh to be found: %v", err)
+	}
+	if err := binariesProbe([]string{"no-such-mount-helper"})(context.Background()); err == nil {
+		t.Error("Expected missing helper to fail")
+	}
+}
@@ -0,0 +1,165 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	mount "k8s.io/mount-utils"
+)
+
+const kubeletCSIPluginDir = "kubernetes.io~csi"
+
+// ReconcileReport describes what a reconciliation pass found and did.
+type ReconcileReport struct {
+	DryRun bool
+	// Adopted are mounts of live pods that were added to the health registry
+	Adopted []string
+	// Orphaned are mounts whose pod was deleted from the API server
+	Orphaned  []string
+	Unmounted []string
+	Errors    []string
+}
+
+type kubeletVolData struct {
+	DriverName   string `json:"driverName"`
+	VolumeHandle string `json:"volumeHandle"`
+}
+
+// csiPodMount is a mount at <kubelet>/pods/<uid>/volumes/kubernetes.io~csi/<pv>/mount
+type csiPodMount struct {
+	mount.MountPoint
+	PodUID    string
+	VolumeDir string
+}
+
+func parseCSIPodMount(kubeletDir string, mp mount.MountPoint) (*csiPodMount, bool) {
+	rel, err := filepath.Rel(filepath.Join(kubeletDir, "pods"), mp.Path)
+	if err != nil {
+		return nil, false
+	}
+	parts := strings.Split(rel, string(os.PathSeparator))
+	if len(parts) != 5 || parts[1] != "volumes" || parts[2] != kubeletCSIPluginDir || parts[4] != "mount" {
+		return nil, false
+	}
+	return &csiPodMount{
+		MountPoint: mp,
+		PodUID:     parts[0],
+		VolumeDir:  filepath.Join(kubeletDir, "pods", parts[0], "volumes", kubeletCSIPluginDir, parts[3]),
+	}, true
+}
+
+func isNFSMount(mp mount.MountPoint) bool {
+	return mp.Type == "nfs" || mp.Type == "nfs4"
+}
+
+// Reconcile scans the mount table for NFS mounts published by this driver under
+// the kubelet pods directory. Mounts of pods the API server still has are
+// adopted into the volume registry, mounts of deleted pods are unmounted unless
+// dryRun is set. The pod directory tells nothing, the mount keeps it in place.
+// Without a PodLister every mount is adopted.
+func (d *SshNodeServer) Reconcile(ctx context.Context, dryRun bool) (*ReconcileReport, error) {
+	mounts, err := d.mounter.List()
+	if err != nil {
+		return nil, err
+	}
+	// the pods are listed after the mounts, a pod published in between is
+	// in the list
+	var pods map[string]bool
+	if d.pods != nil {
+		if pods, err = d.pods.PodUIDs(ctx); err != nil {
+			return nil, err
+		}
+	}
+	report := &ReconcileReport{DryRun: dryRun}
+	for _, mp := range mounts {
+		if !isNFSMount(mp) {
+			continue
+		}
+		pm, ok := parseCSIPodMount(d.config.KubeletDir, mp)
+		if !ok {
+			continue
+		}
+		vol, known := d.volumes.Get(pm.Path)
+		volData := kubeletVolData{}
+		if data, err := os.ReadFile(filepath.Join(pm.VolumeDir, "vol_data.json")); err == nil {
+			if err := json.Unmarshal(data, &volData); err != nil {
+				slog.WarnContext(ctx, "invalid vol_data.json", "path", pm.VolumeDir, "err", err)
+			}
+		}
+		if volData.DriverName != DriverName && !known {
+			continue
+		}
+
+		if pods == nil || pods[pm.PodUID] {
+			if !known {
+				// the options of the mount table, a remount repeats them
+				d.volumes.Add(PublishedVolume{VolumeID: volData.VolumeHandle, Source: pm.Device, TargetPath: pm.Path, Options: pm.Opts})
+				report.Adopted = append(report.Adopted, pm.Path)
+			}
+			continue
+		}
+
+		report.Orphaned = append(report.Orphaned, pm.Path)
+		if dryRun {
+			continue
+		}
+		volumeID := volData.VolumeHandle
+		if known {
+			volumeID = vol.VolumeID
+		}
+		if err := d.unmountOrphan(volumeID, pm.Path); err != nil {
+			report.Errors = append(report.Errors, pm.Path+": "+err.Error())
+			continue
+		}
+		report.Unmounted = append(report.Unmounted, pm.Path)
+	}
+	return report, nil
+}
+
+func (d *SshNodeServer) unmountOrphan(volumeID string, targetPath string) error {
+	mutexKey := fmt.Sprintf("%s-%s", volumeID, targetPath)
+	if acquired := d.mutex.TryLock(mutexKey); !acquired {
+		return fmt.Errorf("volume operation already exists: %s", volumeID)
+	}
+	defer d.mutex.UnLock(mutexKey)
+	if err := mount.CleanupMountPoint(targetPath, d.mounter, true); err != nil {
+		return err
+	}
+	d.volumes.Remove(targetPath)
+	return nil
+}
+
+func (d *SshNodeServer) reconcileOnce(ctx context.Context, dryRun bool) {
+	report, err := d.Reconcile(ctx, dryRun)
+	if err != nil {
+		slog.ErrorContext(ctx, "mount reconciliation failed", "err", err)
+		return
+	}
+	slog.InfoContext(ctx, "mount reconciliation finished", "dryRun", report.DryRun,
+		"adopted", report.Adopted, "orphaned", report.Orphaned, "unmounted", report.Unmounted, "errors", report.Errors)
+}
+
+// runReconciler reconciles mounts at startup and then every ReconcileInterval
+// until ctx is done.
+func (d *SshNodeServer) runReconciler(ctx context.Context) {
+	d.reconcileOnce(ctx, d.config.ReconcileDryRun)
+	if d.config.ReconcileInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(d.config.ReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.reconcileOnce(ctx, d.config.ReconcileDryRun)
+		}
+	}
+}
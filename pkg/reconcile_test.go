@@ -0,0 +1,110 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	mount "k8s.io/mount-utils"
+)
+
+// newTestPodMount lays out a kubelet pod volume directory and returns its mount path.
+func newTestPodMount(t *testing.T, kubeletDir string, podUID string, driver string, live bool) string {
+	podDir := filepath.Join(kubeletDir, "pods", podUID)
+	volDir := filepath.Join(podDir, "volumes", kubeletCSIPluginDir, "pv-"+podUID)
+	if err := os.MkdirAll(filepath.Join(volDir, "mount"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	volData := `{"driverName":"` + driver + `","volumeHandle":"v1:` + podUID + `"}`
+	if err := os.WriteFile(filepath.Join(volDir, "vol_data.json"), []byte(volData), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if live {
+		if err := os.WriteFile(filepath.Join(podDir, "etc-hosts"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(volDir, "mount")
+}
+
+type fakePodLister struct {
+	uids map[string]bool
+	err  error
+}
+
+func (l *fakePodLister) PodUIDs(ctx context.Context) (map[string]bool, error) {
+	return l.uids, l.err
+}
+
+func TestReconcile(t *testing.T) {
+	kubeletDir := t.TempDir()
+	live := newTestPodMount(t, kubeletDir, "live", DriverName, true)
+	// a starting pod has only the volumes and plugins directories
+	starting := newTestPodMount(t, kubeletDir, "starting", DriverName, false)
+	// the mount of a deleted pod keeps its directory in place
+	orphan := newTestPodMount(t, kubeletDir, "orphan", DriverName, true)
+	other := newTestPodMount(t, kubeletDir, "other", "nfs.csi.k8s.io", false)
+	mockMounter := mount.NewFakeMounter([]mount.MountPoint{
+		{Device: "server:/live", Path: live, Type: "nfs4", Opts: []string{"rw", "vers=4.2", "hard"}},
+		{Device: "server:/starting", Path: starting, Type: "nfs4"},
+		{Device: "server:/orphan", Path: orphan, Type: "nfs4"},
+		{Device: "server:/other", Path: other, Type: "nfs4"},
+	})
+	driver := newTestNode(mockMounter)
+	driver.config.KubeletDir = kubeletDir
+	driver.pods = &fakePodLister{uids: map[string]bool{"live": true, "starting": true, "other": true}}
+	driver.volumes.Add(PublishedVolume{VolumeID: "v1:orphan", Source: "server:/orphan", TargetPath: orphan})
+
+	report, err := driver.Reconcile(context.Background(), true)
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if len(report.Adopted) != 2 || report.Adopted[0] != live || report.Adopted[1] != starting {
+		t.Errorf("Expected %s and %s adopted, got %v", live, starting, report.Adopted)
+	}
+	if len(report.Orphaned) != 1 || report.Orphaned[0] != orphan {
+		t.Errorf("Expected %s orphaned, got %v", orphan, report.Orphaned)
+	}
+	if len(report.Unmounted) != 0 || len(mockMounter.GetLog()) != 0 {
+		t.Errorf("dry run should not unmount, got %v", report.Unmounted)
+	}
+	if vol, ok := driver.volumes.Get(live); !ok || vol.Source != "server:/live" || strings.Join(vol.Options, ",") != "rw,vers=4.2,hard" {
+		t.Errorf("Expected live mount in registry with its options, got %+v", vol)
+	}
+
+	report, err = driver.Reconcile(context.Background(), false)
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if len(report.Unmounted) != 1 || report.Unmounted[0] != orphan {
+		t.Errorf("Expected %s unmounted, got %v", orphan, report.Unmounted)
+	}
+	if len(report.Adopted) != 0 {
+		t.Errorf("live mount should only be adopted once, got %v", report.Adopted)
+	}
+	if _, ok := driver.volumes.Get(orphan); ok {
+		t.Errorf("the orphan should leave the registry")
+	}
+}
+
+func TestReconcileWithoutPodList(t *testing.T) {
+	kubeletDir := t.TempDir()
+	target := newTestPodMount(t, kubeletDir, "pod", DriverName, true)
+	mockMounter := mount.NewFakeMounter([]mount.MountPoint{{Device: "server:/pod", Path: target, Type: "nfs4"}})
+	driver := newTestNode(mockMounter)
+	driver.config.KubeletDir = kubeletDir
+
+	driver.pods = &fakePodLister{err: errors.New("forbidden")}
+	if _, err := driver.Reconcile(context.Background(), false); err == nil || len(mockMounter.GetLog()) != 0 {
+		t.Errorf("a failed pod list should stop the pass, got %v, %v", err, mockMounter.GetLog())
+	}
+
+	driver.pods = nil
+	report, err := driver.Reconcile(context.Background(), false)
+	if err != nil || len(report.Orphaned) != 0 || len(report.Adopted) != 1 {
+		t.Errorf("without a pod list mounts should only be adopted, got %+v, %v", report, err)
+	}
+}
@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// SECRET_SSH_SERVER, SECRET_SSH_USER and SECRET_SSH_KEY in the provisioner,
+	// snapshotter or controller-expand secrets of a StorageClass override the
+	// SSH config of the controller for its requests
+	SECRET_SSH_SERVER = "ssh_server"
+	SECRET_SSH_USER   = "ssh_user"
+	SECRET_SSH_KEY    = "ssh_key"
+
+	// CSI_SECRET_PREFIX names the secrets a hook opted in to, e.g. CSI_SECRET_passphrase
+	CSI_SECRET_PREFIX = CSI_REQ_PREFIX + "SECRET_"
+)
+
+// executerFor returns the executer of a request, an SSH executer for the server
+// and credentials of its secrets, falling back to the controller config for
+// those not set. Hooks run in a local shell ignore them.
+func (d *SshController) executerFor(secrets map[string]string) (Executer, error) {
+	server, user, key := secrets[SECRET_SSH_SERVER], secrets[SECRET_SSH_USER], secrets[SECRET_SSH_KEY]
+	if server == "" && user == "" && key == "" {
+		return d.executer, nil
+	}
+	base, ok := d.executer.(*SshExecuter)
+	if !ok {
+		return d.executer, nil
+	}
+	executer := *base
+	if server != "" {
+		executer.SshServer = server
+	}
+	if user != "" {
+		executer.SshUser = user
+	}
+	if key != "" {
+		if _, err := ssh.ParsePrivateKey([]byte(key)); err != nil {
+			return nil, fmt.Errorf("invalid %s secret: %w", SECRET_SSH_KEY, err)
+		}
+		executer.SshKey = key
+	}
+	return &executer, nil
+}
+
+// secretExecuter runs commands with secrets delivered out of band, so they are
+// not on a command line visible in ps or in the logged env.
+type secretExecuter interface {
+	ExecuteCommandWithSecrets(ctx context.Context, cmd string, env map[string]string, secrets map[string]string) ([]byte, error)
+}
+
+// hookSecretEnv returns the CSI_SECRET_* variables of the request secrets the
+// hook of operation opted in to, a secret missing from the request is left out.
+func (d *SshController) hookSecretEnv(operation string, secrets map[string]string) map[string]string {
+	env := map[string]string{}
+	for _, key := range d.config.HookSecrets[operation] {
+		if value, ok := secrets[key]; ok {
+			env[CSI_SECRET_PREFIX+varToEnvName(key)] = value
+		}
+	}
+	return env
+}
+
+// secretsScript renders the exports of secrets for a shell to eval.
+func secretsScript(secrets map[string]string) string {
+	var b strings.Builder
+	for _, k := range slices.Sorted(maps.Keys(secrets)) {
+		fmt.Fprintf(&b, "export %s=%s\n", k, shellQuote(secrets[k]))
+	}
+	return b.String()
+}
+
+// hookSecretsValue is the pflag.Value of --hook-secret, each value gives a
+// hook secrets as operation=key1,key2.
+type hookSecretsValue struct {
+	secrets *map[string][]string
+}
+
+var _ pflag.SliceValue = &hookSecretsValue{}
+
+func NewHookSecretsValue(secrets *map[string][]string) pflag.Value {
+	return &hookSecretsValue{secrets: secrets}
+}
+
+func (v *hookSecretsValue) Set(value string) error {
+	return v.Append(value)
+}
+
+func (v *hookSecretsValue) Append(value string) error {
+	operation, keys, ok := strings.Cut(value, "=")
+	if !ok || operation == "" || keys == "" {
+		return fmt.Errorf("invalid hook secret %q, expected operation=key1,key2", value)
+	}
+	if *v.secrets == nil {
+		*v.secrets = map[string][]string{}
+	}
+	(*v.secrets)[operation] = append((*v.secrets)[operation], strings.Split(keys, ",")...)
+	return nil
+}
+
+func (v *hookSecretsValue) Replace(values []string) error {
+	*v.secrets = nil
+	for _, value := range values {
+		if err := v.Append(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *hookSecretsValue) GetSlice() []string {
+	values := []string{}
+	for _, operation := range slices.Sorted(maps.Keys(*v.secrets)) {
+		values = append(values, operation+"="+strings.Join((*v.secrets)[operation], ","))
+	}
+	return values
+}
+
+func (v *hookSecretsValue) String() string {
+	return "[" + strings.Join(v.GetSlice(), " ") + "]"
+}
+
+func (v *hookSecretsValue) Type() string {
+	return "operation=keys"
+}
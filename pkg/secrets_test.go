@@ -0,0 +1,112 @@
+package pkg
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestExecuterFor(t *testing.T) {
+	global := &SshExecuter{SshServer: "nas-1:22", SshUser: "csi", SshKey: "global-key"}
+	d := &SshController{executer: global}
+
+	if e, err := d.executerFor(nil); err != nil || e != global {
+		t.Errorf("expected the global executer without secrets, got %v, %v", e, err)
+	}
+	e, err := d.executerFor(map[string]string{SECRET_SSH_SERVER: "nas-2:22", "other": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ssh := e.(*SshExecuter); ssh.SshServer != "nas-2:22" || ssh.SshUser != "csi" || ssh.SshKey != "global-key" {
+		t.Errorf("expected the server of the secrets and the global credentials, got %+v", ssh)
+	}
+	if global.SshServer != "nas-1:22" {
+		t.Error("the global config should not change")
+	}
+	if _, err := d.executerFor(map[string]string{SECRET_SSH_KEY: "not a key"}); err == nil {
+		t.Error("an invalid key should be rejected")
+	}
+
+	local := &SshController{executer: &LocalExecuter{}}
+	if e, _ := local.executerFor(map[string]string{SECRET_SSH_SERVER: "nas-2:22"}); e != local.executer {
+		t.Error("local hooks should ignore the SSH secrets")
+	}
+}
+
+func TestRunHookWithSecrets(t *testing.T) {
+	global, other := newTestSSHServer(t), newTestSSHServer(t)
+	key := newTestSSHKey(t)
+	d := NewOfflineController(ControllerCfg{
+		DeleteCmd: "delete",
+		SSHConfig: SshExecuter{SshServer: global.addr, SshUser: "csi", SshKey: key},
+	}, false)
+
+	out, err := d.runHook(context.Background(), OP_DELETE_VOLUME, map[string]string{}, map[string]string{
+		SECRET_SSH_SERVER: other.addr,
+		SECRET_SSH_USER:   "tenant",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if global.accepted.Load() != 0 || other.accepted.Load() != 1 || string(out[:7]) != "tenant:" {
+		t.Errorf("expected the hook to run on the server of the secrets, got %q", out)
+	}
+}
+
+func TestHookSecretsValue(t *testing.T) {
+	var secrets map[string][]string
+	value := NewHookSecretsValue(&secrets)
+	for _, v := range []string{"create_volume=passphrase,token", "delete_volume=token", "create_volume=other"} {
+		if err := value.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if strings.Join(secrets[OP_CREATE_VOLUME], ",") != "passphrase,token,other" || len(secrets[OP_DELETE_VOLUME]) != 1 {
+		t.Errorf("unexpected secrets %v", secrets)
+	}
+	if value.String() != "[create_volume=passphrase,token,other delete_volume=token]" {
+		t.Errorf("unexpected string %s", value.String())
+	}
+	if err := value.Set("create_volume"); err == nil {
+		t.Error("a value without keys should be rejected")
+	}
+}
+
+func TestRunHookSecrets(t *testing.T) {
+	d := NewOfflineController(ControllerCfg{
+		CreateCmd: `echo "csi-shell-output:length=${#CSI_SECRET_passphrase}"
+echo "csi-shell-output:token=${CSI_SECRET_token:-unset}"
+echo "csi-shell-output:echo=$CSI_SECRET_passphrase"`,
+		HookSecrets: map[string][]string{OP_CREATE_VOLUME: {"passphrase"}},
+	}, true)
+	secrets := map[string]string{"passphrase": "s3cr3t phrase", "token": "t0ken"}
+	out, err := d.runHook(context.Background(), OP_CREATE_VOLUME, map[string]string{}, secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, _ := parseShellResponse(out)
+	if output["length"] != "13" || output["token"] != "unset" {
+		t.Errorf("expected only the opted in secret, got %v", output)
+	}
+	if output["echo"] != redactedValue {
+		t.Errorf("a printed secret should be masked, got %q", output["echo"])
+	}
+}
+
+func TestSSHSecretsOnStdin(t *testing.T) {
+	server := newTestSSHServer(t)
+	executer := &SshExecuter{SshServer: server.addr, SshUser: "csi", SshKey: newTestSSHKey(t)}
+	out, err := executer.ExecuteCommandWithSecrets(context.Background(), "true",
+		map[string]string{CSI_REQ_VOLUME_ID: "pvc-1"},
+		map[string]string{CSI_SECRET_PREFIX + "passphrase": "it's secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, stdin, _ := strings.Cut(string(out), "true")
+	if strings.Contains(cmd, "secret") || !strings.Contains(cmd, readSecretsCmd) {
+		t.Errorf("the secret should not be on the command line %q", cmd)
+	}
+	if stdin != `export CSI_SECRET_passphrase='it'\''s secret'`+"\n" {
+		t.Errorf("unexpected stdin %q", stdin)
+	}
+}
@@ -1,28 +1,56 @@
 package pkg
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"net"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 )
 
 type GrpcServer struct {
 	Endpoint string
-	server   *grpc.Server
-	listener net.Listener
+	// DrainTimeout is how long in-flight operations may run after a shutdown
+	// signal before they are canceled
+	DrainTimeout time.Duration
+	server       *grpc.Server
+	listener     net.Listener
+	socketPath   string
+
+	mu       sync.Mutex
+	draining bool
+	inflight sync.WaitGroup
 }
 
-func NewGrpcServer(endpoint string) (*GrpcServer, error) {
+func NewGrpcServer(endpoint string, tlsConfig TLSConfig) (*GrpcServer, error) {
 	scheme, addr, err := parseEndpoint(endpoint)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse endpoint: %w", err)
 	}
+	if err := tlsConfig.Validate(); err != nil {
+		return nil, err
+	}
+	opts := []grpc.ServerOption{}
+	if tlsConfig.Enabled() {
+		if scheme != "tcp" {
+			return nil, fmt.Errorf("TLS is only supported on tcp endpoints, got %s", scheme)
+		}
+		config, err := newServerTLSConfig(tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(config)))
+	}
 
 	if scheme == "unix" {
 		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
@@ -34,24 +62,78 @@ func NewGrpcServer(endpoint string) (*GrpcServer, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to listen on %s://%s: %w", scheme, addr, err)
 	}
-	d := &GrpcServer{}
-	d.server = grpc.NewServer()
+	d := &GrpcServer{Endpoint: endpoint}
+	if scheme == "unix" {
+		d.socketPath = addr
+	}
+	opts = append(opts, grpc.ChainUnaryInterceptor(d.drainInterceptor, TracingInterceptor, LoggingInterceptor, MetricsInterceptor))
+	d.server = grpc.NewServer(opts...)
 	d.listener = listener
 	return d, nil
 }
 
+// Run serves until SIGINT or SIGTERM, then drains the in-flight operations.
 func (d *GrpcServer) Run() error {
-	d.server.Serve(d.listener)
-	go d.handleShutdown()
-	return nil
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	return d.RunContext(ctx)
 }
 
-func (d *GrpcServer) handleShutdown() {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
-	slog.Warn("Received shutdown signal, gracefully stopping...")
-	d.server.GracefulStop()
+// RunContext serves until ctx is done, then stops accepting new operations and
+// waits up to DrainTimeout for the in-flight ones before stopping the server.
+func (d *GrpcServer) RunContext(ctx context.Context) error {
+	defer d.cleanup()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- d.server.Serve(d.listener)
+	}()
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Warn("Received shutdown signal, draining in-flight operations", "timeout", d.DrainTimeout)
+	d.mu.Lock()
+	d.draining = true
+	d.mu.Unlock()
+	drained := make(chan struct{})
+	go func() {
+		d.inflight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		slog.Info("In-flight operations drained, gracefully stopping")
+		d.server.GracefulStop()
+	case <-time.After(d.DrainTimeout):
+		slog.Warn("Drain timeout exceeded, canceling in-flight operations")
+		d.server.Stop()
+	}
+	return <-serveErr
+}
+
+// drainInterceptor rejects new operations once the server is shutting down and
+// tracks the in-flight ones.
+func (d *GrpcServer) drainInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	d.mu.Lock()
+	if d.draining {
+		d.mu.Unlock()
+		return nil, status.Error(codes.Unavailable, "server is shutting down")
+	}
+	d.inflight.Add(1)
+	d.mu.Unlock()
+	defer d.inflight.Done()
+	return handler(ctx, req)
+}
+
+func (d *GrpcServer) cleanup() {
+	if d.socketPath == "" {
+		return
+	}
+	if err := os.Remove(d.socketPath); err != nil && !os.IsNotExist(err) {
+		slog.Warn("failed to remove socket file", "path", d.socketPath, "err", err)
+	}
 }
 
 func parseEndpoint(endpoint string) (string, string, error) {
@@ -1,11 +1,21 @@
 package pkg
 
 import (
+	"context"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 func TestNewGrpcServer(t *testing.T) {
-	s, e := NewGrpcServer("unix:///tmp/csi.sock")
+	s, e := NewGrpcServer("unix:///tmp/csi.sock", TLSConfig{})
 	if e != nil {
 		t.Fatalf("failed to create gRPC server: %v", e)
 	}
@@ -13,3 +23,108 @@ func TestNewGrpcServer(t *testing.T) {
 		t.Fatal("gRPC server is nil")
 	}
 }
+
+// blockingIdentity holds GetPluginInfo until release is closed.
+type blockingIdentity struct {
+	csi.UnimplementedIdentityServer
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingIdentity) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	close(b.started)
+	select {
+	case <-b.release:
+		return &csi.GetPluginInfoResponse{Name: DriverName, VendorVersion: DriverVersion}, nil
+	case <-ctx.Done():
+		return nil, status.Error(codes.Canceled, "canceled")
+	}
+}
+
+func startTestServer(t *testing.T, drainTimeout time.Duration) (*blockingIdentity, csi.IdentityClient, string, context.CancelFunc, chan error) {
+	socket := filepath.Join(t.TempDir(), "csi.sock")
+	s, err := NewGrpcServer("unix://"+socket, TLSConfig{})
+	if err != nil {
+		t.Fatalf("failed to create gRPC server: %v", err)
+	}
+	s.DrainTimeout = drainTimeout
+	identity := &blockingIdentity{started: make(chan struct{}), release: make(chan struct{})}
+	csi.RegisterIdentityServer(s.server, identity)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.RunContext(ctx) }()
+
+	conn, err := grpc.NewClient("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return identity, csi.NewIdentityClient(conn), socket, cancel, done
+}
+
+func TestGrpcServerDrainsInflight(t *testing.T) {
+	identity, client, socket, cancel, done := startTestServer(t, 10*time.Second)
+
+	inflight := make(chan error, 1)
+	go func() {
+		_, err := client.GetPluginInfo(context.Background(), &csi.GetPluginInfoRequest{})
+		inflight <- err
+	}()
+	<-identity.started
+	cancel()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := client.Probe(context.Background(), &csi.ProbeRequest{})
+		if status.Code(err) == codes.Unavailable {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected new calls to be rejected during drain, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(identity.release)
+	if err := <-inflight; err != nil {
+		t.Fatalf("in-flight call should finish during drain, got %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("RunContext should return nil after a graceful stop, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunContext did not return after draining")
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Fatalf("socket should be removed, stat returned %v", err)
+	}
+}
+
+func TestGrpcServerDrainTimeout(t *testing.T) {
+	identity, client, _, cancel, done := startTestServer(t, 100*time.Millisecond)
+
+	inflight := make(chan error, 1)
+	go func() {
+		_, err := client.GetPluginInfo(context.Background(), &csi.GetPluginInfoRequest{})
+		inflight <- err
+	}()
+	<-identity.started
+	cancel()
+
+	select {
+	case err := <-inflight:
+		if err == nil {
+			t.Fatal("in-flight call should be canceled after the drain timeout")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("in-flight call was not canceled after the drain timeout")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunContext did not return after the drain timeout")
+	}
+}
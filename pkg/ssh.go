@@ -1,67 +1,185 @@
 package pkg
 
 import (
+	"context"
 	"fmt"
-	"log/slog"
+	"net"
 	"os"
 	"os/exec"
+	"sort"
+	"strings"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 )
 
 type Executer interface {
-	ExecuteCommand(cmd string, env map[string]string) ([]byte, error)
+	ExecuteCommand(ctx context.Context, cmd string, env map[string]string) ([]byte, error)
+}
+
+const sshDialTimeout = 30 * time.Second
+
+// executerTarget names the server an executer runs hooks on.
+func executerTarget(e Executer) string {
+	switch e := e.(type) {
+	case *SshExecuter:
+		return e.SshServer
+	case *LocalExecuter:
+		return "local"
+	default:
+		return "unknown"
+	}
 }
 
 var _ Executer = &SshExecuter{}
 
 type SshExecuter struct {
-	SshServer string
-	SshUser   string
-	SshKey    string
+	SshServer string `yaml:"server"`
+	SshUser   string `yaml:"user"`
+	SshKey    string `yaml:"key"`
 }
 
-func (config *SshExecuter) ExecuteCommand(cmd string, env map[string]string) ([]byte, error) {
+func (config *SshExecuter) ExecuteCommand(ctx context.Context, cmd string, env map[string]string) ([]byte, error) {
+	return config.ExecuteCommandWithSecrets(ctx, cmd, env, nil)
+}
+
+// ExecuteCommandWithSecrets sends the secrets on the stdin of the command, which
+// exports them before running cmd.
+func (config *SshExecuter) ExecuteCommandWithSecrets(ctx context.Context, cmd string, env map[string]string, secrets map[string]string) ([]byte, error) {
 	privateKey, err := ssh.ParsePrivateKey([]byte(config.SshKey))
 	if err != nil {
-		slog.Error("Failed to parse private key", "err", err)
+		Logger(ctx).Error("Failed to parse private key", "err", err)
 		return nil, fmt.Errorf("failed to parse private key: %w", err)
 	}
-	client, err := ssh.Dial("tcp", config.SshServer,
+	key := sshPoolKey(config)
+	dial := func(ctx context.Context) (*ssh.Client, error) {
+		return config.dial(ctx, privateKey)
+	}
+
+	ctx, span := tracer.Start(ctx, "ssh.session", trace.WithAttributes(hookAttributes(config.SshServer, cmd, env)...))
+	var conn *pooledConn
+	var session *ssh.Session
+	for {
+		var reused bool
+		conn, reused, err = defaultSSHPool.acquire(ctx, key, dial)
+		if err != nil {
+			endSpan(span, err)
+			return nil, err
+		}
+		span.SetAttributes(attribute.Bool("ssh.reused_connection", reused))
+		session, err = conn.client.NewSession()
+		if err == nil || !reused {
+			break
+		}
+		// the server may have closed an idle connection, retry on another one
+		defaultSSHPool.release(conn)
+		defaultSSHPool.discard(key, conn)
+	}
+	defer defaultSSHPool.release(conn)
+	if err != nil {
+		sshFailures.WithLabelValues(config.SshServer, "session").Inc()
+		err = fmt.Errorf("failed to create SSH session: %w", err)
+		endSpan(span, err)
+		return nil, err
+	}
+	defer session.Close()
+	stop := context.AfterFunc(ctx, func() {
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+	})
+	defer stop()
+	newCmd := generateCmdWithEnv(cmd, env)
+	if len(secrets) > 0 {
+		session.Stdin = strings.NewReader(secretsScript(secrets))
+		newCmd = readSecretsCmd + newCmd
+	}
+	result, err := session.CombinedOutput(newCmd)
+	Logger(ctx).Debug("SSH command executed", "cmd", cmd, "env", env, "output", redactor.RedactValues(redactor.RedactValues(string(result), env), secrets))
+	if ctx.Err() != nil {
+		err = fmt.Errorf("SSH command aborted: %w", ctx.Err())
+	}
+	span.SetAttributes(attribute.Int("hook.exit_code", exitCodeOf(err)))
+	endSpan(span, err)
+	return result, err
+}
+
+func (config *SshExecuter) dial(ctx context.Context, privateKey ssh.Signer) (*ssh.Client, error) {
+	ctx, span := tracer.Start(ctx, "ssh.dial", trace.WithAttributes(attribute.String("ssh.server", config.SshServer)))
+	dialer := net.Dialer{Timeout: sshDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", config.SshServer)
+	if err != nil {
+		sshFailures.WithLabelValues(config.SshServer, "dial").Inc()
+		err = fmt.Errorf("failed to dial SSH: %w", err)
+		endSpan(span, err)
+		return nil, err
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, config.SshServer,
 		&ssh.ClientConfig{
 			User:            config.SshUser,
 			Auth:            []ssh.AuthMethod{ssh.PublicKeys(privateKey)},
 			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         sshDialTimeout,
 		})
 	if err != nil {
-		return nil, fmt.Errorf("failed to dial SSH: %w", err)
+		conn.Close()
+		sshFailures.WithLabelValues(config.SshServer, "handshake").Inc()
+		err = fmt.Errorf("failed SSH handshake: %w", err)
+		endSpan(span, err)
+		return nil, err
 	}
-	defer client.Close()
-	session, err := client.NewSession()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create SSH session: %w", err)
+	span.End()
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// hookAttributes describes a hook execution for tracing. Env values are left
+// out, they may carry sensitive parameters.
+func hookAttributes(server string, cmd string, env map[string]string) []attribute.KeyValue {
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	script, _, _ := strings.Cut(cmd, "\n")
+	return []attribute.KeyValue{
+		attribute.String("hook.server", server),
+		attribute.String("hook.command", script),
+		attribute.StringSlice("hook.env_keys", keys),
 	}
-	defer session.Close()
-	newCmd := generateCmdWithEnv(cmd, env)
-	result, err := session.CombinedOutput(newCmd)
-	slog.Debug("SSH command executed", "cmd", newCmd, "output", string(result))
-	return result, err
 }
 
+// generateCmdWithEnv prefixes cmd with the exports of env, the values are
+// quoted so that hooks read them verbatim.
 func generateCmdWithEnv(cmd string, env map[string]string) string {
 	newCmd := "set -e;"
 	for k, v := range env {
-		newCmd += fmt.Sprintf("export %s=%s;", k, v)
+		newCmd += fmt.Sprintf("export %s=%s;", k, shellQuote(v))
 	}
 	newCmd += cmd
 	return newCmd
 }
 
+// readSecretsCmd exports the secrets a command gets on its stdin.
+const readSecretsCmd = `eval "$(cat)";`
+
 type LocalExecuter struct {
 }
 
-func (e *LocalExecuter) ExecuteCommand(cmd string, env map[string]string) ([]byte, error) {
-	command := exec.Command("bash", "-ec", generateCmdWithEnv(cmd, env))
+func (e *LocalExecuter) ExecuteCommand(ctx context.Context, cmd string, env map[string]string) ([]byte, error) {
+	return e.ExecuteCommandWithSecrets(ctx, cmd, env, nil)
+}
+
+// ExecuteCommandWithSecrets passes the secrets in the environment of the shell.
+func (e *LocalExecuter) ExecuteCommandWithSecrets(ctx context.Context, cmd string, env map[string]string, secrets map[string]string) ([]byte, error) {
+	ctx, span := tracer.Start(ctx, "local.exec", trace.WithAttributes(hookAttributes("local", cmd, env)...))
+	command := exec.CommandContext(ctx, "bash", "-ec", generateCmdWithEnv(cmd, env))
 	command.Env = os.Environ()
-	return command.CombinedOutput()
+	for k, v := range secrets {
+		command.Env = append(command.Env, k+"="+v)
+	}
+	out, err := command.CombinedOutput()
+	span.SetAttributes(attribute.Int("hook.exit_code", exitCodeOf(err)))
+	endSpan(span, err)
+	return out, err
 }
@@ -1,6 +1,7 @@
 package pkg
 
 import (
+	"context"
 	"os"
 	"testing"
 )
@@ -21,7 +22,7 @@ func TestExecSSHCommand(t *testing.T) {
 	env := map[string]string{
 		"VOLUME_ID": "test-volume-id",
 	}
-	stdout, err := config.ExecuteCommand("echo -n $VOLUME_ID", env)
+	stdout, err := config.ExecuteCommand(context.Background(), "echo -n $VOLUME_ID", env)
 	if err != nil {
 		t.Fatalf("ExecSSHCommand failed: %v", err)
 	}
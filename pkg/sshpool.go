@@ -0,0 +1,149 @@
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// sshMaxSessions stays below the MaxSessions default of OpenSSH, 10, so
+	// a pooled connection is not refused a session
+	sshMaxSessions = 8
+	// sshIdleTimeout closes the connections unused for that long
+	sshIdleTimeout = 5 * time.Minute
+)
+
+// pooledConn is a client connection and the number of sessions open on it.
+type pooledConn struct {
+	client   *ssh.Client
+	sessions int
+	lastUsed time.Time
+}
+
+// sshPool shares client connections between the hooks run on the same server
+// as the same user with the same key, instead of a handshake per hook.
+type sshPool struct {
+	idleTimeout time.Duration
+
+	mu    sync.Mutex
+	conns map[string][]*pooledConn
+	// sweep is the timer closing the idle connections, set while some are idle
+	sweep *time.Timer
+}
+
+func newSSHPool(idleTimeout time.Duration) *sshPool {
+	return &sshPool{idleTimeout: idleTimeout, conns: map[string][]*pooledConn{}}
+}
+
+var defaultSSHPool = newSSHPool(sshIdleTimeout)
+
+// sshPoolKey identifies the connections of an executer, by a digest so the
+// key does not keep the private key around.
+func sshPoolKey(config *SshExecuter) string {
+	sum := sha256.Sum256([]byte(config.SshServer + "\x00" + config.SshUser + "\x00" + config.SshKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// acquire returns a connection with a free session, dialing a new one when
+// every pooled connection is busy. reused is false for a new connection.
+func (p *sshPool) acquire(ctx context.Context, key string, dial func(ctx context.Context) (*ssh.Client, error)) (conn *pooledConn, reused bool, err error) {
+	p.mu.Lock()
+	p.closeIdle()
+	for _, c := range p.conns[key] {
+		if c.sessions < sshMaxSessions {
+			c.sessions++
+			p.mu.Unlock()
+			return c, true, nil
+		}
+	}
+	p.mu.Unlock()
+
+	client, err := dial(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	conn = &pooledConn{client: client, sessions: 1}
+	p.mu.Lock()
+	p.conns[key] = append(p.conns[key], conn)
+	p.mu.Unlock()
+	go func() {
+		client.Wait()
+		p.remove(key, conn)
+	}()
+	return conn, false, nil
+}
+
+func (p *sshPool) release(conn *pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn.sessions--
+	conn.lastUsed = time.Now()
+	if conn.sessions == 0 && p.sweep == nil {
+		p.sweep = time.AfterFunc(p.idleTimeout, p.sweepIdle)
+	}
+}
+
+// discard closes a broken connection, the sessions open on it fail.
+func (p *sshPool) discard(key string, conn *pooledConn) {
+	p.remove(key, conn)
+	conn.client.Close()
+}
+
+func (p *sshPool) remove(key string, conn *pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, c := range p.conns[key] {
+		if c == conn {
+			p.conns[key] = append(p.conns[key][:i:i], p.conns[key][i+1:]...)
+			break
+		}
+	}
+	if len(p.conns[key]) == 0 {
+		delete(p.conns, key)
+	}
+}
+
+// sweepIdle closes the idle connections of every key, so they are not kept
+// open when no more hooks run, and waits for the next one to expire.
+func (p *sshPool) sweepIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sweep = nil
+	p.closeIdle()
+	var next time.Time
+	for _, conns := range p.conns {
+		for _, c := range conns {
+			if c.sessions == 0 && (next.IsZero() || c.lastUsed.Before(next)) {
+				next = c.lastUsed
+			}
+		}
+	}
+	if !next.IsZero() {
+		p.sweep = time.AfterFunc(time.Until(next.Add(p.idleTimeout)), p.sweepIdle)
+	}
+}
+
+// closeIdle closes the connections without sessions for idleTimeout, p.mu
+// must be held.
+func (p *sshPool) closeIdle() {
+	for key := range p.conns {
+		conns := p.conns[key][:0]
+		for _, c := range p.conns[key] {
+			if c.sessions == 0 && time.Since(c.lastUsed) > p.idleTimeout {
+				go c.client.Close()
+				continue
+			}
+			conns = append(conns, c)
+		}
+		if len(conns) == 0 {
+			delete(p.conns, key)
+		} else {
+			p.conns[key] = conns
+		}
+	}
+}
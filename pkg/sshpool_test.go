@@ -0,0 +1,218 @@
+package pkg
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testSSHServer answers every exec request with the user, command and stdin
+// it got.
+type testSSHServer struct {
+	addr     string
+	accepted atomic.Int32
+
+	mu    sync.Mutex
+	conns []*ssh.ServerConn
+}
+
+func newTestSSHServer(t *testing.T) *testSSHServer {
+	t.Helper()
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) { return nil, nil },
+	}
+	config.AddHostKey(signer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	s := &testSSHServer{addr: listener.Addr().String()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+	return s
+}
+
+func (s *testSSHServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	serverConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	s.accepted.Add(1)
+	s.mu.Lock()
+	s.conns = append(s.conns, serverConn)
+	s.mu.Unlock()
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer channel.Close()
+			for req := range requests {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				var payload struct{ Command string }
+				ssh.Unmarshal(req.Payload, &payload)
+				req.Reply(true, nil)
+				stdin, _ := io.ReadAll(channel)
+				channel.Write([]byte(serverConn.User() + ":" + payload.Command + string(stdin)))
+				channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+				return
+			}
+		}()
+	}
+}
+
+// closeConns drops the connections as a restarted server would.
+func (s *testSSHServer) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+func newTestSSHKey(t *testing.T) string {
+	t.Helper()
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(block))
+}
+
+func TestSSHPoolReusesConnections(t *testing.T) {
+	server := newTestSSHServer(t)
+	key := newTestSSHKey(t)
+	executer := &SshExecuter{SshServer: server.addr, SshUser: "alice", SshKey: key}
+
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out, err := executer.ExecuteCommand(context.Background(), "true", nil)
+			if err != nil || string(out) != "alice:set -e;true" {
+				t.Errorf("unexpected output %q, %v", out, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := executer.ExecuteCommand(context.Background(), "true", nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.accepted.Load(); n < 1 || n > 3 {
+		t.Errorf("expected concurrent hooks to share connections, got %d connections", n)
+	}
+	before := server.accepted.Load()
+
+	// another user gets its own connection
+	other := &SshExecuter{SshServer: server.addr, SshUser: "bob", SshKey: key}
+	if out, err := other.ExecuteCommand(context.Background(), "true", nil); err != nil || string(out) != "bob:set -e;true" {
+		t.Fatalf("unexpected output %q, %v", out, err)
+	}
+	if server.accepted.Load() != before+1 {
+		t.Errorf("expected a connection for the other user")
+	}
+
+	// a dropped connection is replaced
+	server.closeConns()
+	if _, err := executer.ExecuteCommand(context.Background(), "true", nil); err != nil {
+		t.Fatalf("expected a new connection after the server dropped them: %v", err)
+	}
+}
+
+func TestSSHPoolLimitsSessions(t *testing.T) {
+	server := newTestSSHServer(t)
+	executer := &SshExecuter{SshServer: server.addr, SshUser: "alice", SshKey: newTestSSHKey(t)}
+	signer, err := ssh.ParsePrivateKey([]byte(executer.SshKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := newSSHPool(sshIdleTimeout)
+	dial := func(ctx context.Context) (*ssh.Client, error) {
+		return executer.dial(ctx, signer)
+	}
+	var conns []*pooledConn
+	for range sshMaxSessions + 1 {
+		conn, _, err := pool.acquire(context.Background(), "k", dial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	if n := server.accepted.Load(); n != 2 {
+		t.Errorf("expected a second connection once the first is full, got %d", n)
+	}
+	pool.release(conns[0])
+	if conn, reused, _ := pool.acquire(context.Background(), "k", dial); !reused || conn != conns[0] {
+		t.Error("expected the released session to be reused")
+	}
+}
+
+func TestSSHPoolSweepsIdleConnections(t *testing.T) {
+	server := newTestSSHServer(t)
+	executer := &SshExecuter{SshServer: server.addr, SshUser: "alice", SshKey: newTestSSHKey(t)}
+	signer, err := ssh.ParsePrivateKey([]byte(executer.SshKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := newSSHPool(50 * time.Millisecond)
+	dial := func(ctx context.Context) (*ssh.Client, error) {
+		return executer.dial(ctx, signer)
+	}
+	// the idle connections of every key are closed without another acquire
+	var conns []*pooledConn
+	for _, key := range []string{"a", "b"} {
+		conn, _, err := pool.acquire(context.Background(), key, dial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool.release(conn)
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		done := make(chan struct{})
+		go func() {
+			conn.client.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the idle connection to be closed")
+		}
+	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if len(pool.conns) != 0 {
+		t.Errorf("expected the idle connections to be removed, got %v", pool.conns)
+	}
+}
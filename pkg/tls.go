@@ -0,0 +1,172 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSConfig secures a tcp endpoint, the files are reloaded when they change.
+type TLSConfig struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// ClientCAFile enables client certificate verification against this CA bundle
+	ClientCAFile string `yaml:"clientCAFile"`
+}
+
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || c.ClientCAFile != ""
+}
+
+func (c TLSConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return fmt.Errorf("certFile (--tls-cert) and keyFile (--tls-key) are both required to enable TLS")
+	}
+	return nil
+}
+
+// certReloader serves the certificate and client CAs of a TLSConfig and loads
+// them again when the modification time of one of the files changes.
+type certReloader struct {
+	config TLSConfig
+
+	mu       sync.Mutex
+	modTimes [3]time.Time
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+}
+
+func newCertReloader(config TLSConfig) (*certReloader, error) {
+	r := &certReloader{config: config}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) files() [3]string {
+	return [3]string{r.config.CertFile, r.config.KeyFile, r.config.ClientCAFile}
+}
+
+func (r *certReloader) currentModTimes() ([3]time.Time, error) {
+	var modTimes [3]time.Time
+	for i, f := range r.files() {
+		if f == "" {
+			continue
+		}
+		info, err := os.Stat(f)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// reload loads the files if they changed since the last load, r.mu must be held
+// by the caller unless r is not shared yet.
+func (r *certReloader) reload() error {
+	modTimes, err := r.currentModTimes()
+	if err != nil {
+		return fmt.Errorf("failed to stat TLS files: %w", err)
+	}
+	if r.cert != nil && modTimes == r.modTimes {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS key pair: %w", err)
+	}
+	var clientCA *x509.CertPool
+	if r.config.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.config.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA: %w", err)
+		}
+		clientCA = x509.NewCertPool()
+		if !clientCA.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in client CA %s", r.config.ClientCAFile)
+		}
+	}
+	if r.cert != nil {
+		slog.Info("Reloaded TLS certificates", "cert", r.config.CertFile, "client_ca", r.config.ClientCAFile)
+	}
+	r.cert, r.clientCA, r.modTimes = &cert, clientCA, modTimes
+	return nil
+}
+
+// serverConfig returns the TLS config of a new connection, a failed reload
+// keeps serving the previous certificates.
+func (r *certReloader) serverConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.reload(); err != nil {
+		slog.Warn("Failed to reload TLS certificates, keep using the previous ones", "err", err)
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*r.cert},
+		NextProtos:   []string{"h2"},
+	}
+	if r.clientCA != nil {
+		config.ClientCAs = r.clientCA
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+func newServerTLSConfig(config TLSConfig) (*tls.Config, error) {
+	reloader, err := newCertReloader(config)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: reloader.serverConfig,
+	}, nil
+}
+
+// ClientTLSConfig secures the connection of a client to a tcp endpoint.
+type ClientTLSConfig struct {
+	// CAFile verifies the server certificate, the system roots are used if empty
+	CAFile string
+	// CertFile and KeyFile are the client certificate for a server verifying clients
+	CertFile string
+	KeyFile  string
+}
+
+func (c ClientTLSConfig) Enabled() bool {
+	return c.CAFile != "" || c.CertFile != "" || c.KeyFile != ""
+}
+
+func newClientTLSConfig(config ClientTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA %s", config.CAFile)
+		}
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		if config.CertFile == "" || config.KeyFile == "" {
+			return nil, fmt.Errorf("the client certificate (--tls-cert) and key (--tls-key) are both required")
+		}
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS key pair: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
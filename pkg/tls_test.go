@@ -0,0 +1,162 @@
+package pkg
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, serial int64, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "csi-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) write(t *testing.T, certFile, keyFile string, modTime time.Time) {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if keyFile != "" {
+		if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(keyFile, modTime, modTime)
+	}
+	os.Chtimes(certFile, modTime, modTime)
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func TestTLSConfigValidate(t *testing.T) {
+	if err := (TLSConfig{}).Validate(); err != nil {
+		t.Fatalf("empty TLS config should be valid, got %v", err)
+	}
+	if err := (TLSConfig{CertFile: "tls.crt"}).Validate(); err == nil {
+		t.Fatal("TLS config without key should be invalid")
+	}
+	if err := (TLSConfig{ClientCAFile: "ca.crt"}).Validate(); err == nil {
+		t.Fatal("TLS config with only a client CA should be invalid")
+	}
+	if _, err := NewGrpcServer("unix://"+filepath.Join(t.TempDir(), "csi.sock"), TLSConfig{CertFile: "tls.crt", KeyFile: "tls.key"}); err == nil {
+		t.Fatal("TLS on a unix endpoint should be rejected")
+	}
+}
+
+func TestGrpcServerMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	config := TLSConfig{
+		CertFile:     filepath.Join(dir, "tls.crt"),
+		KeyFile:      filepath.Join(dir, "tls.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	}
+	ca := newTestCert(t, 1, nil, true)
+	ca.write(t, config.ClientCAFile, "", time.Now())
+	newTestCert(t, 2, ca, false).write(t, config.CertFile, config.KeyFile, time.Now().Add(-time.Minute))
+
+	s, err := NewGrpcServer("tcp://127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("failed to create gRPC server: %v", err)
+	}
+	csi.RegisterIdentityServer(s.server, &IdentityServer{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.RunContext(ctx)
+	addr := s.listener.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := newTestCert(t, 3, ca, false)
+
+	// connect returns the serial of the server certificate
+	connect := func(certs []tls.Certificate) (int64, error) {
+		var serial int64
+		tlsConfig := &tls.Config{
+			RootCAs:      roots,
+			Certificates: certs,
+			VerifyConnection: func(cs tls.ConnectionState) error {
+				serial = cs.PeerCertificates[0].SerialNumber.Int64()
+				return nil
+			},
+		}
+		conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+		callCtx, callCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer callCancel()
+		_, err = csi.NewIdentityClient(conn).GetPluginInfo(callCtx, &csi.GetPluginInfoRequest{})
+		return serial, err
+	}
+
+	if _, err := connect(nil); err == nil {
+		t.Fatal("client without certificate should be rejected")
+	}
+	serial, err := connect([]tls.Certificate{client.tlsCertificate()})
+	if err != nil {
+		t.Fatalf("client with certificate should be accepted, got %v", err)
+	}
+	if serial != 2 {
+		t.Fatalf("expected server certificate 2, got %d", serial)
+	}
+
+	newTestCert(t, 4, ca, false).write(t, config.CertFile, config.KeyFile, time.Now())
+	serial, err = connect([]tls.Certificate{client.tlsCertificate()})
+	if err != nil {
+		t.Fatalf("client with certificate should be accepted after reload, got %v", err)
+	}
+	if serial != 4 {
+		t.Fatalf("expected reloaded server certificate 4, got %d", serial)
+	}
+}
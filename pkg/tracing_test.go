@@ -0,0 +1,79 @@
+package pkg
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"go.opentelemetry.io/otel"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+)
+
+var (
+	spanRecorder     = tracetest.NewSpanRecorder()
+	spanRecorderOnce sync.Once
+)
+
+// recordSpans installs the tracer provider of the tests once, the tracer of
+// the package only delegates to the first global provider.
+func recordSpans() *tracetest.SpanRecorder {
+	spanRecorderOnce.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	})
+	return spanRecorder
+}
+
+func TestTracingInjectsTraceID(t *testing.T) {
+	recorder := recordSpans()
+
+	driver := newTestDriver()
+	driver.config.ExpandCmd = `echo "csi-shell-output:capacity_bytes=${CSI_CAPACITY_BYTES}"; echo "csi-shell-output:trace=${CSI_TRACE_ID}"`
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/ControllerExpandVolume"}
+	_, err := TracingInterceptor(context.Background(), nil, info, func(ctx context.Context, req any) (any, error) {
+		result, err := driver.execCmd(ctx, OP_EXPAND_VOLUME, map[string]string{CSI_REQ_CAPACITY_BYTES: "1"}, nil)
+		if err != nil {
+			return nil, err
+		}
+		if result["trace"] != traceID(ctx) || result["trace"] == "" {
+			t.Errorf("Expected trace id %q passed to hook, got %q", traceID(ctx), result["trace"])
+		}
+		return &csi.ControllerExpandVolumeResponse{}, nil
+	})
+	if err != nil {
+		t.Fatalf("interceptor failed: %v", err)
+	}
+	var names []string
+	for _, span := range recorder.Ended() {
+		names = append(names, span.Name())
+	}
+	joined := strings.Join(names, ",")
+	for _, name := range []string{info.FullMethod, "hook.expand_volume", "local.exec", "hook.parse_output"} {
+		if !strings.Contains(joined, name) {
+			t.Errorf("Expected span %q, got %v", name, names)
+		}
+	}
+}
+
+func TestHookSpanRecordsError(t *testing.T) {
+	recorder := recordSpans()
+	ended := len(recorder.Ended())
+	driver := newTestDriver()
+	driver.config.ExpandCmd = `exit 3`
+	if _, err := driver.runHook(context.Background(), OP_EXPAND_VOLUME, map[string]string{}, nil); err == nil {
+		t.Fatal("expected the hook to fail")
+	}
+	var hookSpans []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended()[ended:] {
+		if span.Name() == "hook.expand_volume" {
+			hookSpans = append(hookSpans, span)
+		}
+	}
+	if len(hookSpans) != 1 || hookSpans[0].Status().Code != otelcodes.Error {
+		t.Errorf("expected one hook span with the error status, got %v", hookSpans)
+	}
+}
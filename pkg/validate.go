@@ -0,0 +1,188 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// hookContract lists the output keys the driver reads from the hook of an operation.
+type hookContract struct {
+	required []string
+	optional []string
+}
+
+var hookContracts = map[string]hookContract{
+	OP_CREATE_VOLUME: {
+		required: []string{CSI_REP_VOLUME_ID, CSI_REP_CAPACITY_BYTES, NFS_SHARE_SERVER_KEY, NFS_SHARE_PATH_KEY},
+		optional: []string{CSI_REP_DATA_SOURCE, BLOCK_IMAGE_KEY, EXPORT_PATH_KEY},
+	},
+	OP_DELETE_VOLUME:   {optional: []string{CSI_REP_VOLUME_ID}},
+	OP_EXPAND_VOLUME:   {required: []string{CSI_REP_CAPACITY_BYTES}},
+	OP_CREATE_SNAPSHOT: {required: []string{CSI_REP_SNAPSHOT_ID, CSI_REP_CAPACITY_BYTES}},
+	OP_DELETE_SNAPSHOT: {required: []string{CSI_REP_SNAPSHOT_ID}},
+	OP_LIST_SNAPSHOTS:  {optional: []string{CSI_REP_SNAPSHOT}},
+}
+
+// HookCheck is the result of running the hook of an operation with synthetic input.
+type HookCheck struct {
+	Operation string
+	Hook      string
+	Hash      string
+	Duration  time.Duration
+	Output    map[string]string
+	Errors    []string
+	Warnings  []string
+	// Skipped is set when no hook is configured for the operation
+	Skipped bool
+	// NotRun tells why a configured operation was not run
+	NotRun string
+}
+
+func (c *HookCheck) Failed() bool {
+	return len(c.Errors) > 0
+}
+
+// checkHookOutput verifies output against the contract of the operation.
+func (c *HookCheck) checkHookOutput(output map[string]string) {
+	contract := hookContracts[c.Operation]
+	for _, key := range contract.required {
+		if output[key] == "" {
+			c.Errors = append(c.Errors, fmt.Sprintf("missing required key %s", key))
+		}
+	}
+	keys := make([]string, 0, len(output))
+	for key := range output {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		if !slices.Contains(contract.required, key) && !slices.Contains(contract.optional, key) {
+			c.Warnings = append(c.Warnings, fmt.Sprintf("unknown key %s is ignored", key))
+		}
+	}
+	if capacity, ok := output[CSI_REP_CAPACITY_BYTES]; ok {
+		if n, err := strconv.ParseInt(capacity, 10, 64); err != nil || n < 0 {
+			c.Warnings = append(c.Warnings, fmt.Sprintf("%s %q is not a non-negative integer", CSI_REP_CAPACITY_BYTES, capacity))
+		}
+	}
+}
+
+// ValidateHooks runs every configured hook through the lifecycle of a synthetic
+// volume and snapshot, create before expand and delete, and checks what each
+// one prints. With dryRun, CSI_DRY_RUN=true asks the hooks not to change anything.
+// The built-in backends ignore CSI_DRY_RUN, they only run with runBackends.
+func (d *SshController) ValidateHooks(ctx context.Context, dryRun bool, runBackends bool) []*HookCheck {
+	name := "csi-validate-" + newRequestID()
+	volumeID, snapshotID := name, name
+	steps := []struct {
+		operation string
+		env       func() map[string]string
+	}{
+		{OP_CREATE_VOLUME, func() map[string]string {
+			env := map[string]string{
+				CSI_REQ_VOLUME_ID:      volumeID,
+				CSI_REQ_CAPACITY_BYTES: strconv.FormatInt(1<<30, 10),
+				CSI_REQ_VOLUME_MODE:    VOLUME_MODE_FILESYSTEM,
+			}
+			addCreateVolumeEnv(env, &csi.CreateVolumeRequest{
+				Name: volumeID,
+				VolumeCapabilities: []*csi.VolumeCapability{{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+				}},
+			})
+			return env
+		}},
+		{OP_EXPAND_VOLUME, func() map[string]string {
+			return map[string]string{
+				CSI_REQ_VOLUME_ID:      volumeID,
+				CSI_REQ_CAPACITY_BYTES: strconv.FormatInt(2<<30, 10),
+				CSI_REQ_VOLUME_MODE:    VOLUME_MODE_FILESYSTEM,
+			}
+		}},
+		{OP_CREATE_SNAPSHOT, func() map[string]string {
+			return map[string]string{
+				CSI_REQ_SNAPSHOT_NAME: name,
+				CSI_REQ_SRC_VOLUME_ID: volumeID,
+			}
+		}},
+		{OP_LIST_SNAPSHOTS, func() map[string]string {
+			return map[string]string{CSI_REQ_SRC_VOLUME_ID: volumeID}
+		}},
+		{OP_DELETE_SNAPSHOT, func() map[string]string {
+			return map[string]string{CSI_REQ_SNAPSHOT_ID: snapshotID}
+		}},
+		{OP_DELETE_VOLUME, func() map[string]string {
+			return map[string]string{CSI_REQ_VOLUME_ID: volumeID}
+		}},
+	}
+
+	checks := make([]*HookCheck, 0, len(steps))
+	for _, step := range steps {
+		check := &HookCheck{Operation: step.operation}
+		checks = append(checks, check)
+		if !d.hasHook(ctx, step.operation) {
+			check.Skipped = true
+			continue
+		}
+		if d.backendRuns(ctx, step.operation) {
+			check.Hook = "backend " + d.backend.Name()
+			if !runBackends {
+				check.NotRun = "the backend changes the storage server even in a dry run"
+				continue
+			}
+		} else {
+			hook, err := d.loadHook(ctx, step.operation, d.executer)
+			if err != nil {
+				check.Errors = append(check.Errors, err.Error())
+				continue
+			}
+			check.Hook, check.Hash = hook.String(), hook.Hash
+		}
+		env := step.env()
+		if dryRun {
+			env[CSI_REQ_DRY_RUN] = "true"
+		}
+		start := time.Now()
+		stdout, err := d.runHook(ctx, step.operation, env, nil)
+		check.Duration = time.Since(start)
+		if err != nil {
+			check.Errors = append(check.Errors, fmt.Sprintf("hook failed: %s, output: %s", err, redactor.RedactValues(string(stdout), env)))
+			continue
+		}
+		output, err := parseShellResponse(stdout)
+		if err != nil {
+			check.Errors = append(check.Errors, err.Error())
+		}
+		check.Output = output
+		check.checkHookOutput(output)
+		// later hooks get the IDs the create hooks returned, as the driver does
+		switch step.operation {
+		case OP_CREATE_VOLUME:
+			if id := output[CSI_REP_VOLUME_ID]; id != "" {
+				volumeID = id
+			}
+		case OP_CREATE_SNAPSHOT:
+			if id := output[CSI_REP_SNAPSHOT_ID]; id != "" {
+				snapshotID = id
+			}
+		case OP_LIST_SNAPSHOTS:
+			snapshots, err := parseSnapshotList(stdout)
+			if err != nil {
+				check.Errors = append(check.Errors, err.Error())
+			} else if !slices.ContainsFunc(snapshots, func(s *csi.Snapshot) bool { return s.SnapshotId == CSI_SNAPSHOT_ID_PREFIX+snapshotID }) {
+				check.Warnings = append(check.Warnings, fmt.Sprintf("created snapshot %s is not listed", snapshotID))
+			}
+		case OP_DELETE_SNAPSHOT:
+			if id := output[CSI_REP_SNAPSHOT_ID]; id != "" && id != snapshotID {
+				check.Errors = append(check.Errors, fmt.Sprintf("%s %q does not match the requested %q", CSI_REP_SNAPSHOT_ID, id, snapshotID))
+			}
+		}
+	}
+	return checks
+}
@@ -0,0 +1,88 @@
+package pkg
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestValidateHooks(t *testing.T) {
+	driver := NewOfflineController(ControllerCfg{
+		CreateCmd: `echo "csi-shell-output:volume_id=${CSI_VOLUME_ID}"
+echo "csi-shell-output:capacity_bytes=lots"
+echo "csi-shell-output:nfs_server=localhost"
+echo "csi-shell-output:nfs_path=/export/${CSI_VOLUME_ID}"
+echo "csi-shell-output:dry_run=${CSI_DRY_RUN}"`,
+		DeleteCmd:         `echo "csi-shell-output:volume_id=${CSI_VOLUME_ID}"`,
+		CreateSnapshotCmd: `echo "csi-shell-output:capacity_bytes=0"`,
+		DeleteSnapshotCmd: `exit 3`,
+	}, true)
+
+	checks := driver.ValidateHooks(context.Background(), true, false)
+	byOperation := map[string]*HookCheck{}
+	for _, c := range checks {
+		byOperation[c.Operation] = c
+	}
+	if len(checks) != 6 || checks[0].Operation != OP_CREATE_VOLUME || checks[5].Operation != OP_DELETE_VOLUME {
+		t.Fatalf("expected the six operations from create to delete, got %d", len(checks))
+	}
+
+	create := byOperation[OP_CREATE_VOLUME]
+	if create.Failed() || create.Output["dry_run"] != "true" || create.Hook != "inline" || create.Hash == "" {
+		t.Errorf("unexpected create check %+v", create)
+	}
+	warnings := strings.Join(create.Warnings, "\n")
+	if !strings.Contains(warnings, "unknown key dry_run") || !strings.Contains(warnings, "capacity_bytes \"lots\"") {
+		t.Errorf("expected unknown key and capacity warnings, got %v", create.Warnings)
+	}
+	if !byOperation[OP_EXPAND_VOLUME].Skipped {
+		t.Error("expand without hook should be skipped")
+	}
+	snapshot := byOperation[OP_CREATE_SNAPSHOT]
+	if !snapshot.Failed() || !strings.Contains(snapshot.Errors[0], "snapshot_id") {
+		t.Errorf("expected missing snapshot_id error, got %+v", snapshot)
+	}
+	if !byOperation[OP_DELETE_SNAPSHOT].Failed() {
+		t.Error("failing delete snapshot hook should fail")
+	}
+	deleteVolume := byOperation[OP_DELETE_VOLUME]
+	if deleteVolume.Failed() || len(deleteVolume.Warnings) != 0 || deleteVolume.Output[CSI_REP_VOLUME_ID] != create.Output[CSI_REP_VOLUME_ID] {
+		t.Errorf("delete should get the created volume id, got %+v", deleteVolume)
+	}
+}
+
+func TestParseShellResponseMalformed(t *testing.T) {
+	_, err := parseShellResponse([]byte("csi-shell-output:volume_id\n"))
+	if err == nil {
+		t.Fatal("expected error for output line without value")
+	}
+}
+
+func TestValidateHooksBackend(t *testing.T) {
+	driver := NewOfflineController(ControllerCfg{
+		Backend:       BTRFS_BACKEND,
+		BackendConfig: map[string]string{"volumesDir": "/data/nfs", "snapshotsDir": "/data/snapshots", "nfsServer": "10.0.0.2"},
+		DeleteCmd:     `echo "csi-shell-output:volume_id=${CSI_VOLUME_ID}"`,
+	}, true)
+	executer := &scriptedExecuter{}
+	driver.executer = executer
+
+	for _, check := range driver.ValidateHooks(context.Background(), true, false) {
+		if check.Operation == OP_DELETE_VOLUME {
+			if check.NotRun != "" || check.Failed() {
+				t.Errorf("the delete hook should run, got %+v", check)
+			}
+		} else if check.NotRun == "" || check.Hook != "backend "+BTRFS_BACKEND {
+			t.Errorf("backend operations should not run by default, got %+v", check)
+		}
+	}
+	if len(executer.commands) != 1 || !strings.Contains(executer.commands[0], "csi-shell-output:volume_id") {
+		t.Errorf("only the delete hook should reach the server, ran %v", executer.commands)
+	}
+
+	executer.commands = nil
+	driver.ValidateHooks(context.Background(), true, true)
+	if !executer.ran("'btrfs' 'subvolume' 'create'") {
+		t.Errorf("backends should run with runBackends, ran %v", executer.commands)
+	}
+}
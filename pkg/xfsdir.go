@@ -0,0 +1,477 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+const (
+	XFS_DIR_BACKEND = "xfs-dir"
+)
+
+func init() {
+	registerBackend(XFS_DIR_BACKEND, newXfsDirBackend)
+}
+
+// xfsDirBackend creates a directory per volume in volumesDir on an XFS
+// filesystem mounted with prjquota, limited by the hard block limit of its own
+// project. Snapshots are reflink copies in snapshotsDir, with their own project
+// to report their usage; their IDs are <volume>@<name>. The project of every
+// directory is kept in projectsFile, in the format of /etc/projects.
+type xfsDirBackend struct {
+	volumesDir     string
+	snapshotsDir   string
+	nfsServer      string
+	exportRoot     string
+	projectsFile   string
+	projectIDStart int64
+
+	// mu serializes the updates of projectsFile
+	mu sync.Mutex
+	// mountPoint of volumesDir, looked up on first use when not configured
+	mountMu    sync.Mutex
+	mountPoint string
+}
+
+func newXfsDirBackend(config map[string]string) (Backend, error) {
+	if err := checkConfigKeys(XFS_DIR_BACKEND, config, "volumesDir", "snapshotsDir", "nfsServer", "exportRoot", "projectsFile", "projectIDStart", "mountPoint"); err != nil {
+		return nil, err
+	}
+	b := &xfsDirBackend{
+		projectsFile:   "/etc/csi-ssh-projects",
+		projectIDStart: 10000,
+		mountPoint:     config["mountPoint"],
+	}
+	var err error
+	if b.volumesDir, err = requiredConfig(XFS_DIR_BACKEND, config, "volumesDir"); err != nil {
+		return nil, err
+	}
+	if b.snapshotsDir, err = requiredConfig(XFS_DIR_BACKEND, config, "snapshotsDir"); err != nil {
+		return nil, err
+	}
+	if b.nfsServer, err = requiredConfig(XFS_DIR_BACKEND, config, "nfsServer"); err != nil {
+		return nil, err
+	}
+	b.volumesDir = strings.TrimSuffix(b.volumesDir, "/")
+	b.snapshotsDir = strings.TrimSuffix(b.snapshotsDir, "/")
+	b.exportRoot = strings.TrimSuffix(config["exportRoot"], "/")
+	if b.exportRoot != "" && !strings.HasPrefix(b.volumesDir+"/", b.exportRoot+"/") {
+		return nil, fmt.Errorf("exportRoot %q must contain volumesDir %q", b.exportRoot, b.volumesDir)
+	}
+	if file := config["projectsFile"]; file != "" {
+		b.projectsFile = file
+	}
+	if start := config["projectIDStart"]; start != "" {
+		if b.projectIDStart, err = strconv.ParseInt(start, 10, 32); err != nil || b.projectIDStart <= 0 {
+			return nil, fmt.Errorf("invalid projectIDStart %q", start)
+		}
+	}
+	return b, nil
+}
+
+func (b *xfsDirBackend) Name() string {
+	return XFS_DIR_BACKEND
+}
+
+func (b *xfsDirBackend) Supports(operation string) bool {
+	switch operation {
+	case OP_CREATE_VOLUME, OP_DELETE_VOLUME, OP_EXPAND_VOLUME, OP_CREATE_SNAPSHOT, OP_DELETE_SNAPSHOT, OP_LIST_SNAPSHOTS:
+		return true
+	}
+	return false
+}
+
+// AllocationUnit is the KiB block of project quotas, xfs_quota reports the
+// limit in whole blocks.
+func (b *xfsDirBackend) AllocationUnit() int64 {
+	return 1024
+}
+
+// quotaLimit rounds a capacity up to whole quota blocks, so that the limit read
+// back is not below it when allocationUnit overrides the backend.
+func quotaLimit(capacity int64) int64 {
+	return (capacity + 1023) / 1024 * 1024
+}
+
+func (b *xfsDirBackend) Run(ctx context.Context, executer Executer, operation string, env map[string]string) ([]byte, error) {
+	switch operation {
+	case OP_CREATE_VOLUME:
+		return b.createVolume(ctx, executer, env)
+	case OP_DELETE_VOLUME:
+		return b.deleteVolume(ctx, executer, env)
+	case OP_EXPAND_VOLUME:
+		return b.expandVolume(ctx, executer, env)
+	case OP_CREATE_SNAPSHOT:
+		return b.createSnapshot(ctx, executer, env)
+	case OP_DELETE_SNAPSHOT:
+		return b.deleteSnapshot(ctx, executer, env)
+	case OP_LIST_SNAPSHOTS:
+		return b.listSnapshots(ctx, executer, env)
+	}
+	return nil, fmt.Errorf("xfs-dir backend does not support %s", operation)
+}
+
+func (b *xfsDirBackend) volumePath(volumeID string) (string, error) {
+	if err := checkBackendName("volume ID", volumeID); err != nil {
+		return "", err
+	}
+	return b.volumesDir + "/" + volumeID, nil
+}
+
+// snapshotPath returns the path of a <volume>@<name> snapshot ID.
+func (b *xfsDirBackend) snapshotPath(snapshotID string) (string, error) {
+	volumeID, name, ok := strings.Cut(snapshotID, "@")
+	if !ok {
+		return "", fmt.Errorf("invalid snapshot ID %q, expected <volume>@<name>", snapshotID)
+	}
+	if err := checkBackendName("volume ID", volumeID); err != nil {
+		return "", err
+	}
+	if err := checkBackendName("snapshot name", name); err != nil {
+		return "", err
+	}
+	return b.snapshotsDir + "/" + snapshotID, nil
+}
+
+func (b *xfsDirBackend) nfsPath(path string) string {
+	if b.exportRoot == "" {
+		return path
+	}
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(path, b.exportRoot), "/")
+}
+
+// xfsQuota runs an xfs_quota expert command on the filesystem of volumesDir.
+func (b *xfsDirBackend) xfsQuota(ctx context.Context, executer Executer, command string) (string, error) {
+	b.mountMu.Lock()
+	if b.mountPoint == "" {
+		mountPoint, err := runCommand(ctx, executer, shellCommand("stat", "-c", "%m", b.volumesDir))
+		if err != nil {
+			b.mountMu.Unlock()
+			return "", err
+		}
+		b.mountPoint = mountPoint
+	}
+	mountPoint := b.mountPoint
+	b.mountMu.Unlock()
+	return runCommand(ctx, executer, shellCommand("xfs_quota", "-x", "-c", command, mountPoint))
+}
+
+// projects reads projectsFile, mapping paths to project IDs.
+func (b *xfsDirBackend) projects(ctx context.Context, executer Executer) (map[string]int64, error) {
+	out, err := runCommand(ctx, executer, shellCommand("cat", b.projectsFile)+" 2>/dev/null || true")
+	if err != nil {
+		return nil, err
+	}
+	projects := map[string]int64{}
+	for _, line := range strings.Split(out, "\n") {
+		id, path, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok || strings.HasPrefix(id, "#") {
+			continue
+		}
+		n, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid line %q in %s", line, b.projectsFile)
+		}
+		projects[path] = n
+	}
+	return projects, nil
+}
+
+func (b *xfsDirBackend) writeProjects(ctx context.Context, executer Executer, projects map[string]int64) error {
+	lines := make([]string, 0, len(projects))
+	for path, id := range projects {
+		lines = append(lines, fmt.Sprintf("%d:%s\n", id, path))
+	}
+	slices.Sort(lines)
+	return writeFileAtomic(ctx, executer, b.projectsFile, strings.Join(lines, ""))
+}
+
+// assignProject returns the project of path, allocating a new one to it and
+// tagging its files when it has none.
+func (b *xfsDirBackend) assignProject(ctx context.Context, executer Executer, path string) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	projects, err := b.projects(ctx, executer)
+	if err != nil {
+		return 0, err
+	}
+	id, ok := projects[path]
+	if !ok {
+		id = b.projectIDStart
+		for _, used := range projects {
+			id = max(id, used+1)
+		}
+		projects[path] = id
+		if err := b.writeProjects(ctx, executer, projects); err != nil {
+			return 0, err
+		}
+	}
+	// sets the project inheritance flag, copied files get the project too
+	if _, err := b.xfsQuota(ctx, executer, fmt.Sprintf("project -s -p %s %d", path, id)); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// releaseProject removes the limit of the project of path and forgets it.
+func (b *xfsDirBackend) releaseProject(ctx context.Context, executer Executer, path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	projects, err := b.projects(ctx, executer)
+	if err != nil {
+		return err
+	}
+	id, ok := projects[path]
+	if !ok {
+		return nil
+	}
+	if _, err := b.xfsQuota(ctx, executer, fmt.Sprintf("limit -p bhard=0 %d", id)); err != nil {
+		return err
+	}
+	delete(projects, path)
+	return b.writeProjects(ctx, executer, projects)
+}
+
+// projectUsage is a line of the xfs_quota project report, in bytes.
+type projectUsage struct {
+	used int64
+	hard int64
+}
+
+// projectReport returns the usage of the projects with usage or limits.
+func (b *xfsDirBackend) projectReport(ctx context.Context, executer Executer) (map[int64]projectUsage, error) {
+	out, err := b.xfsQuota(ctx, executer, "report -p -b -n -N")
+	if err != nil {
+		return nil, err
+	}
+	report := map[int64]projectUsage{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		id, err1 := strconv.ParseInt(strings.TrimPrefix(fields[0], "#"), 10, 64)
+		used, err2 := strconv.ParseInt(fields[1], 10, 64)
+		hard, err3 := strconv.ParseInt(fields[3], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			return nil, fmt.Errorf("unexpected xfs_quota report line %q", line)
+		}
+		// the report is in KiB blocks
+		report[id] = projectUsage{used: used * 1024, hard: hard * 1024}
+	}
+	return report, nil
+}
+
+func (b *xfsDirBackend) volumeLimit(ctx context.Context, executer Executer, id int64) (int64, error) {
+	report, err := b.projectReport(ctx, executer)
+	if err != nil {
+		return 0, err
+	}
+	usage, ok := report[id]
+	if !ok || usage.hard == 0 {
+		return 0, fmt.Errorf("project %d has no limit, is %s mounted with prjquota?", id, b.volumesDir)
+	}
+	return usage.hard, nil
+}
+
+// copyDir copies source to target with reflinks, or rsync where the filesystem
+// does not support them. The copy is renamed to target once it is complete.
+func copyDir(ctx context.Context, executer Executer, source string, target string) error {
+	tmp := target + ".tmp"
+	cmd := shellCommand("rm", "-rf", tmp) + " && { " +
+		shellCommand("cp", "-a", "--reflink=always", source, tmp) + " 2>/dev/null || { " +
+		shellCommand("rm", "-rf", tmp) + " && " + shellCommand("rsync", "-a", source+"/", tmp+"/") +
+		"; }; } && " + shellCommand("mv", tmp, target)
+	_, err := runCommand(ctx, executer, cmd)
+	return err
+}
+
+func (b *xfsDirBackend) createVolume(ctx context.Context, executer Executer, env map[string]string) ([]byte, error) {
+	if env[CSI_REQ_VOLUME_MODE] == VOLUME_MODE_BLOCK {
+		return nil, fmt.Errorf("xfs-dir backend does not support block volumes")
+	}
+	volumeID := env[CSI_REQ_VOLUME_ID]
+	target, err := b.volumePath(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	capacity, err := strconv.ParseInt(env[CSI_REQ_CAPACITY_BYTES], 10, 64)
+	if err != nil || capacity <= 0 {
+		return nil, fmt.Errorf("invalid capacity %q", env[CSI_REQ_CAPACITY_BYTES])
+	}
+
+	exists, err := pathExists(ctx, executer, target)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		var source string
+		switch env[CSI_REQ_DATA_SOURCE] {
+		case "snapshot":
+			source, err = b.snapshotPath(env[CSI_REQ_SRC_SNAPSHOT_ID])
+		case "volume":
+			source, err = b.volumePath(env[CSI_REQ_SRC_VOLUME_ID])
+		}
+		if err != nil {
+			return nil, err
+		}
+		if source != "" {
+			err = copyDir(ctx, executer, source, target)
+		} else {
+			_, err = runCommand(ctx, executer, shellCommand("mkdir", target))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	id, err := b.assignProject(ctx, executer, target)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := b.xfsQuota(ctx, executer, fmt.Sprintf("limit -p bhard=%d %d", quotaLimit(capacity), id)); err != nil {
+		return nil, err
+	}
+	limit, err := b.volumeLimit(ctx, executer, id)
+	if err != nil {
+		return nil, err
+	}
+	output := map[string]string{
+		CSI_REP_VOLUME_ID:      volumeID,
+		CSI_REP_CAPACITY_BYTES: strconv.FormatInt(limit, 10),
+		NFS_SHARE_SERVER_KEY:   b.nfsServer,
+		NFS_SHARE_PATH_KEY:     b.nfsPath(target),
+		EXPORT_PATH_KEY:        target,
+	}
+	if env[CSI_REQ_DATA_SOURCE] != "" {
+		output[CSI_REP_DATA_SOURCE] = env[CSI_REQ_DATA_SOURCE]
+	}
+	return formatHookOutput(output), nil
+}
+
+func (b *xfsDirBackend) deleteVolume(ctx context.Context, executer Executer, env map[string]string) ([]byte, error) {
+	target, err := b.volumePath(env[CSI_REQ_VOLUME_ID])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := runCommand(ctx, executer, shellCommand("rm", "-rf", target)); err != nil {
+		return nil, err
+	}
+	if err := b.releaseProject(ctx, executer, target); err != nil {
+		return nil, err
+	}
+	return formatHookOutput(map[string]string{CSI_REP_VOLUME_ID: env[CSI_REQ_VOLUME_ID]}), nil
+}
+
+func (b *xfsDirBackend) expandVolume(ctx context.Context, executer Executer, env map[string]string) ([]byte, error) {
+	if env[CSI_REQ_VOLUME_MODE] == VOLUME_MODE_BLOCK {
+		return nil, fmt.Errorf("xfs-dir backend does not support block volumes")
+	}
+	target, err := b.volumePath(env[CSI_REQ_VOLUME_ID])
+	if err != nil {
+		return nil, err
+	}
+	capacity, err := strconv.ParseInt(env[CSI_REQ_CAPACITY_BYTES], 10, 64)
+	if err != nil || capacity <= 0 {
+		return nil, fmt.Errorf("invalid capacity %q", env[CSI_REQ_CAPACITY_BYTES])
+	}
+	b.mu.Lock()
+	projects, err := b.projects(ctx, executer)
+	b.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	id, ok := projects[target]
+	if !ok {
+		return nil, fmt.Errorf("volume %s has no project in %s", target, b.projectsFile)
+	}
+	if _, err := b.xfsQuota(ctx, executer, fmt.Sprintf("limit -p bhard=%d %d", quotaLimit(capacity), id)); err != nil {
+		return nil, err
+	}
+	limit, err := b.volumeLimit(ctx, executer, id)
+	if err != nil {
+		return nil, err
+	}
+	return formatHookOutput(map[string]string{CSI_REP_CAPACITY_BYTES: strconv.FormatInt(limit, 10)}), nil
+}
+
+func (b *xfsDirBackend) createSnapshot(ctx context.Context, executer Executer, env map[string]string) ([]byte, error) {
+	snapshotID := env[CSI_REQ_SRC_VOLUME_ID] + "@" + env[CSI_REQ_SNAPSHOT_NAME]
+	target, err := b.snapshotPath(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	exists, err := pathExists(ctx, executer, target)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		source, _ := b.volumePath(env[CSI_REQ_SRC_VOLUME_ID])
+		if err := copyDir(ctx, executer, source, target); err != nil {
+			return nil, err
+		}
+	}
+	id, err := b.assignProject(ctx, executer, target)
+	if err != nil {
+		return nil, err
+	}
+	report, err := b.projectReport(ctx, executer)
+	if err != nil {
+		return nil, err
+	}
+	return formatHookOutput(map[string]string{
+		CSI_REP_SNAPSHOT_ID:    snapshotID,
+		CSI_REP_CAPACITY_BYTES: strconv.FormatInt(report[id].used, 10),
+	}), nil
+}
+
+func (b *xfsDirBackend) deleteSnapshot(ctx context.Context, executer Executer, env map[string]string) ([]byte, error) {
+	target, err := b.snapshotPath(env[CSI_REQ_SNAPSHOT_ID])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := runCommand(ctx, executer, shellCommand("rm", "-rf", target)); err != nil {
+		return nil, err
+	}
+	if err := b.releaseProject(ctx, executer, target); err != nil {
+		return nil, err
+	}
+	return formatHookOutput(map[string]string{CSI_REP_SNAPSHOT_ID: env[CSI_REQ_SNAPSHOT_ID]}), nil
+}
+
+// listSnapshots lists the snapshots in projectsFile, which get their project
+// once they are complete.
+func (b *xfsDirBackend) listSnapshots(ctx context.Context, executer Executer, env map[string]string) ([]byte, error) {
+	b.mu.Lock()
+	projects, err := b.projects(ctx, executer)
+	b.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	report, err := b.projectReport(ctx, executer)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []*csi.Snapshot
+	for _, path := range slices.Sorted(maps.Keys(projects)) {
+		snapshotID, ok := strings.CutPrefix(path, b.snapshotsDir+"/")
+		if !ok {
+			continue
+		}
+		volumeID, _, _ := strings.Cut(snapshotID, "@")
+		if v := env[CSI_REQ_SRC_VOLUME_ID]; v != "" && v != volumeID {
+			continue
+		}
+		if s := env[CSI_REQ_SNAPSHOT_ID]; s != "" && s != snapshotID {
+			continue
+		}
+		snapshots = append(snapshots, &csi.Snapshot{SnapshotId: snapshotID, SourceVolumeId: volumeID, SizeBytes: report[projects[path]].used})
+	}
+	return formatSnapshotList(snapshots), nil
+}
@@ -0,0 +1,172 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+)
+
+func newTestXfsDirBackend(t *testing.T, config map[string]string) Backend {
+	t.Helper()
+	cfg := map[string]string{"volumesDir": "/data/nfs", "snapshotsDir": "/data/snapshots", "nfsServer": "nas", "mountPoint": "/data"}
+	for k, v := range config {
+		cfg[k] = v
+	}
+	b, err := NewBackend(XFS_DIR_BACKEND, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+const testProjectReport = `#10000       1024          0    1048576     00 [--------]
+#10001        512          0          0     00 [--------]
+`
+
+func TestXfsDirCreateVolume(t *testing.T) {
+	b := newTestXfsDirBackend(t, nil)
+	executer := (&scriptedExecuter{}).
+		on("'test' '-e'", "no\n", nil).
+		on("'cat'", "10000:/data/nfs/pvc-0\n", nil).
+		on("'report -p -b -n -N'", "#10001 0 0 1048576 00 [--------]\n", nil)
+	output := runBackend(t, b, executer, OP_CREATE_VOLUME, map[string]string{
+		CSI_REQ_VOLUME_ID:      "pvc-1",
+		CSI_REQ_CAPACITY_BYTES: "1073741824",
+	})
+	for _, cmd := range []string{
+		"'mkdir' '/data/nfs/pvc-1'",
+		"'printf' '%s' '10000:/data/nfs/pvc-0\n10001:/data/nfs/pvc-1\n' > '/etc/csi-ssh-projects.tmp' && 'mv'",
+		"'xfs_quota' '-x' '-c' 'project -s -p /data/nfs/pvc-1 10001' '/data'",
+		"'xfs_quota' '-x' '-c' 'limit -p bhard=1073741824 10001' '/data'",
+	} {
+		if !executer.ran(cmd) {
+			t.Errorf("expected %s, ran %v", cmd, executer.commands)
+		}
+	}
+	if output[CSI_REP_CAPACITY_BYTES] != "1073741824" || output[NFS_SHARE_PATH_KEY] != "/data/nfs/pvc-1" {
+		t.Errorf("unexpected output %v", output)
+	}
+
+	// a retry keeps the project of the volume
+	executer = (&scriptedExecuter{}).
+		on("'test' '-e'", "yes\n", nil).
+		on("'cat'", "10000:/data/nfs/pvc-0\n10001:/data/nfs/pvc-1\n", nil).
+		on("'report -p -b -n -N'", "#10001 0 0 1048576 00 [--------]\n", nil)
+	runBackend(t, b, executer, OP_CREATE_VOLUME, map[string]string{
+		CSI_REQ_VOLUME_ID:      "pvc-1",
+		CSI_REQ_CAPACITY_BYTES: "1073741824",
+	})
+	if executer.ran("'mkdir'") || executer.ran("'printf'") {
+		t.Errorf("existing volume should not be created again, ran %v", executer.commands)
+	}
+}
+
+func TestXfsDirClone(t *testing.T) {
+	executer := (&scriptedExecuter{}).
+		on("'test' '-e'", "no\n", nil).
+		on("'report -p -b -n -N'", "#10000 0 0 1048576 00 [--------]\n", nil)
+	runBackend(t, newTestXfsDirBackend(t, nil), executer, OP_CREATE_VOLUME, map[string]string{
+		CSI_REQ_VOLUME_ID:       "pvc-2",
+		CSI_REQ_CAPACITY_BYTES:  "1073741824",
+		CSI_REQ_DATA_SOURCE:     "snapshot",
+		CSI_REQ_SRC_SNAPSHOT_ID: "pvc-1@snap-1",
+	})
+	if !executer.ran("'cp' '-a' '--reflink=always' '/data/snapshots/pvc-1@snap-1' '/data/nfs/pvc-2.tmp'",
+		"'rsync' '-a' '/data/snapshots/pvc-1@snap-1/' '/data/nfs/pvc-2.tmp/'",
+		"'mv' '/data/nfs/pvc-2.tmp' '/data/nfs/pvc-2'") {
+		t.Errorf("expected a reflink or rsync copy, ran %v", executer.commands)
+	}
+	if executer.ran("'mkdir'") {
+		t.Error("a clone should not create an empty directory")
+	}
+}
+
+func TestXfsDirExpandVolume(t *testing.T) {
+	b := newTestXfsDirBackend(t, nil)
+	executer := (&scriptedExecuter{}).
+		on("'cat'", "10000:/data/nfs/pvc-1\n", nil).
+		on("'report -p -b -n -N'", "#10000 0 0 2097152 00 [--------]\n", nil)
+	output := runBackend(t, b, executer, OP_EXPAND_VOLUME, map[string]string{
+		CSI_REQ_VOLUME_ID:      "pvc-1",
+		CSI_REQ_CAPACITY_BYTES: "2147483648",
+	})
+	if !executer.ran("'limit -p bhard=2147483648 10000'") || output[CSI_REP_CAPACITY_BYTES] != "2147483648" {
+		t.Errorf("unexpected output %v, ran %v", output, executer.commands)
+	}
+
+	// the limit is set and read back in KiB blocks
+	executer = (&scriptedExecuter{}).
+		on("'cat'", "10000:/data/nfs/pvc-1\n", nil).
+		on("'report -p -b -n -N'", "#10000 0 0 2 00 [--------]\n", nil)
+	output = runBackend(t, b, executer, OP_EXPAND_VOLUME, map[string]string{
+		CSI_REQ_VOLUME_ID:      "pvc-1",
+		CSI_REQ_CAPACITY_BYTES: "1500",
+	})
+	if !executer.ran("'limit -p bhard=2048 10000'") || output[CSI_REP_CAPACITY_BYTES] != "2048" {
+		t.Errorf("expected the capacity rounded up to 2KiB, got %v, ran %v", output, executer.commands)
+	}
+	if unit := b.(allocationUnitBackend).AllocationUnit(); unit != 1024 {
+		t.Errorf("expected an allocation unit of 1KiB, got %d", unit)
+	}
+
+	executer = (&scriptedExecuter{}).on("'cat'", "", nil)
+	if _, err := b.Run(context.Background(), executer, OP_EXPAND_VOLUME, map[string]string{
+		CSI_REQ_VOLUME_ID:      "pvc-1",
+		CSI_REQ_CAPACITY_BYTES: "2147483648",
+	}); err == nil {
+		t.Error("a volume without project should fail to expand")
+	}
+}
+
+func TestXfsDirDeleteVolume(t *testing.T) {
+	b := newTestXfsDirBackend(t, nil)
+	executer := (&scriptedExecuter{}).on("'cat'", "10000:/data/nfs/pvc-0\n10001:/data/nfs/pvc-1\n", nil)
+	runBackend(t, b, executer, OP_DELETE_VOLUME, map[string]string{CSI_REQ_VOLUME_ID: "pvc-1"})
+	for _, cmd := range []string{
+		"'rm' '-rf' '/data/nfs/pvc-1'",
+		"'limit -p bhard=0 10001'",
+		"'printf' '%s' '10000:/data/nfs/pvc-0\n'",
+	} {
+		if !executer.ran(cmd) {
+			t.Errorf("expected %s, ran %v", cmd, executer.commands)
+		}
+	}
+
+	executer = (&scriptedExecuter{}).on("'cat'", "10000:/data/nfs/pvc-0\n", nil)
+	runBackend(t, b, executer, OP_DELETE_VOLUME, map[string]string{CSI_REQ_VOLUME_ID: "pvc-1"})
+	if executer.ran("'xfs_quota'") || executer.ran("'printf'") {
+		t.Errorf("a volume without project should only be removed, ran %v", executer.commands)
+	}
+}
+
+func TestXfsDirSnapshots(t *testing.T) {
+	b := newTestXfsDirBackend(t, nil)
+	executer := (&scriptedExecuter{}).
+		on("'test' '-e'", "no\n", nil).
+		on("'cat'", "10000:/data/nfs/pvc-1\n", nil).
+		on("'report -p -b -n -N'", testProjectReport, nil)
+	output := runBackend(t, b, executer, OP_CREATE_SNAPSHOT, map[string]string{
+		CSI_REQ_SRC_VOLUME_ID: "pvc-1",
+		CSI_REQ_SNAPSHOT_NAME: "snap-1",
+	})
+	if !executer.ran("'cp' '-a' '--reflink=always' '/data/nfs/pvc-1' '/data/snapshots/pvc-1@snap-1.tmp'") {
+		t.Errorf("expected a reflink copy, ran %v", executer.commands)
+	}
+	if output[CSI_REP_SNAPSHOT_ID] != "pvc-1@snap-1" || output[CSI_REP_CAPACITY_BYTES] != "524288" {
+		t.Errorf("unexpected output %v", output)
+	}
+
+	executer = (&scriptedExecuter{}).
+		on("'cat'", "10000:/data/nfs/pvc-1\n10001:/data/snapshots/pvc-1@snap-1\n10002:/data/snapshots/pvc-2@snap-2\n", nil).
+		on("'report -p -b -n -N'", testProjectReport, nil)
+	out, err := b.Run(context.Background(), executer, OP_LIST_SNAPSHOTS, map[string]string{CSI_REQ_SRC_VOLUME_ID: "pvc-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := parseSnapshotList(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 || snapshots[0].SnapshotId != "v1:pvc-1@snap-1" || snapshots[0].SizeBytes != 524288 {
+		t.Errorf("unexpected snapshots %v", snapshots)
+	}
+}
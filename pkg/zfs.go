@@ -0,0 +1,482 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+const (
+	ZFS_BACKEND = "zfs"
+
+	// ZFS_PARAM_PREFIX marks StorageClass parameters set as dataset properties, e.g. zfs.compression: lz4
+	ZFS_PARAM_PREFIX = "zfs."
+	// CLONE_MODE_KEY is the StorageClass parameter overriding the cloneMode backend config
+	CLONE_MODE_KEY = "cloneMode"
+
+	// ZFS_CLONE_MODE_COPY copies the origin with zfs send and recv, the clone is independent
+	ZFS_CLONE_MODE_COPY = "copy"
+	// ZFS_CLONE_MODE_CLONE uses zfs clone, fast but the origin can not be destroyed while the clone exists
+	ZFS_CLONE_MODE_CLONE = "clone"
+
+	zfsCloneSnapshotPrefix = "csi-clone-"
+)
+
+// zfsPropertyPattern matches native properties and user properties, which
+// contain a colon.
+var zfsPropertyPattern = regexp.MustCompile(`^([a-z][a-z0-9_]*|[a-z0-9+._-]*:[a-z0-9:+._-]*)$`)
+
+func init() {
+	registerBackend(ZFS_BACKEND, newZfsBackend)
+}
+
+// zfsBackend creates a dataset per volume under a parent dataset, limited by
+// its refquota and exported with sharenfs or by the exports of the server.
+// Snapshot IDs are <volume>@<snapshot name>.
+type zfsBackend struct {
+	parent    string
+	nfsServer string
+	// sharenfs is set on every new dataset, empty inherits it from the parent
+	sharenfs  string
+	cloneMode string
+}
+
+func newZfsBackend(config map[string]string) (Backend, error) {
+	if err := checkConfigKeys(ZFS_BACKEND, config, "parentDataset", "nfsServer", "sharenfs", "cloneMode"); err != nil {
+		return nil, err
+	}
+	parent, err := requiredConfig(ZFS_BACKEND, config, "parentDataset")
+	if err != nil {
+		return nil, err
+	}
+	nfsServer, err := requiredConfig(ZFS_BACKEND, config, "nfsServer")
+	if err != nil {
+		return nil, err
+	}
+	b := &zfsBackend{
+		parent:    strings.TrimSuffix(parent, "/"),
+		nfsServer: nfsServer,
+		sharenfs:  config["sharenfs"],
+		cloneMode: ZFS_CLONE_MODE_COPY,
+	}
+	if mode := config["cloneMode"]; mode != "" {
+		if err := checkZfsCloneMode(mode); err != nil {
+			return nil, err
+		}
+		b.cloneMode = mode
+	}
+	return b, nil
+}
+
+func checkZfsCloneMode(mode string) error {
+	if mode != ZFS_CLONE_MODE_COPY && mode != ZFS_CLONE_MODE_CLONE {
+		return fmt.Errorf("invalid %s %q, must be %s or %s", CLONE_MODE_KEY, mode, ZFS_CLONE_MODE_COPY, ZFS_CLONE_MODE_CLONE)
+	}
+	return nil
+}
+
+func (b *zfsBackend) Name() string {
+	return ZFS_BACKEND
+}
+
+func (b *zfsBackend) Supports(operation string) bool {
+	switch operation {
+	case OP_CREATE_VOLUME, OP_DELETE_VOLUME, OP_EXPAND_VOLUME, OP_CREATE_SNAPSHOT, OP_DELETE_SNAPSHOT, OP_LIST_SNAPSHOTS:
+		return true
+	}
+	return false
+}
+
+func (b *zfsBackend) Run(ctx context.Context, executer Executer, operation string, env map[string]string) ([]byte, error) {
+	switch operation {
+	case OP_CREATE_VOLUME:
+		return b.createVolume(ctx, executer, env)
+	case OP_DELETE_VOLUME:
+		return b.deleteVolume(ctx, executer, env)
+	case OP_EXPAND_VOLUME:
+		return b.expandVolume(ctx, executer, env)
+	case OP_CREATE_SNAPSHOT:
+		return b.createSnapshot(ctx, executer, env)
+	case OP_DELETE_SNAPSHOT:
+		return b.deleteSnapshot(ctx, executer, env)
+	case OP_LIST_SNAPSHOTS:
+		return b.listSnapshots(ctx, executer, env)
+	}
+	return nil, fmt.Errorf("zfs backend does not support %s", operation)
+}
+
+func (b *zfsBackend) dataset(volumeID string) (string, error) {
+	if err := checkBackendName("volume ID", volumeID); err != nil {
+		return "", err
+	}
+	return b.parent + "/" + volumeID, nil
+}
+
+// snapshot returns the zfs name of a <volume>@<name> snapshot ID.
+func (b *zfsBackend) snapshot(snapshotID string) (string, error) {
+	volumeID, name, ok := strings.Cut(snapshotID, "@")
+	if !ok {
+		return "", fmt.Errorf("invalid snapshot ID %q, expected <volume>@<name>", snapshotID)
+	}
+	if err := checkBackendName("snapshot name", name); err != nil {
+		return "", err
+	}
+	dataset, err := b.dataset(volumeID)
+	if err != nil {
+		return "", err
+	}
+	return dataset + "@" + name, nil
+}
+
+// exists reports whether the dataset or snapshot exists.
+func (b *zfsBackend) exists(ctx context.Context, executer Executer, name string) (bool, error) {
+	out, err := executer.ExecuteCommand(ctx, shellCommand("zfs", "list", "-H", "-o", "name", name), nil)
+	if err == nil {
+		return true, nil
+	}
+	if strings.Contains(string(out), "does not exist") {
+		return false, nil
+	}
+	return false, fmt.Errorf("zfs list %s failed: %w, output: %s", name, err, strings.TrimSpace(string(out)))
+}
+
+// zfsList runs zfs list -Hp with the given properties and returns its rows.
+func zfsList(ctx context.Context, executer Executer, properties []string, args ...string) ([][]string, error) {
+	cmd := append([]string{"zfs", "list", "-H", "-p", "-o", strings.Join(properties, ",")}, args...)
+	out, err := runCommand(ctx, executer, shellCommand(cmd...))
+	if err != nil {
+		return nil, err
+	}
+	return parseZfsList(out, len(properties))
+}
+
+// zfsListOne returns the properties of a single dataset or snapshot.
+func zfsListOne(ctx context.Context, executer Executer, properties []string, args ...string) ([]string, error) {
+	rows, err := zfsList(ctx, executer, properties, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) != 1 {
+		return nil, fmt.Errorf("expected one zfs list line, got %d", len(rows))
+	}
+	return rows[0], nil
+}
+
+func parseZfsList(out string, columns int) ([][]string, error) {
+	var rows [][]string
+	for _, line := range strings.Split(out, "\n") {
+		if line == "" {
+			continue
+		}
+		row := strings.Split(line, "\t")
+		if len(row) != columns {
+			return nil, fmt.Errorf("unexpected zfs list line %q, expected %d columns", line, columns)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// properties returns the -o arguments of a new volume, the zfs.<property>
+// parameters are read from CSI_PARAMETERS_JSON, the env names lose the dots
+// and colons of user properties.
+func (b *zfsBackend) properties(capacity int64, env map[string]string) ([]string, error) {
+	params := map[string]string{}
+	if data := env[CSI_REQ_PARAMETERS_JSON]; data != "" {
+		if err := json.Unmarshal([]byte(data), &params); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", CSI_REQ_PARAMETERS_JSON, err)
+		}
+	}
+	var args []string
+	if capacity > 0 {
+		args = append(args, "-o", fmt.Sprintf("refquota=%d", capacity))
+	}
+	if b.sharenfs != "" {
+		args = append(args, "-o", "sharenfs="+b.sharenfs)
+	}
+	for _, param := range slices.Sorted(maps.Keys(params)) {
+		name, ok := strings.CutPrefix(param, ZFS_PARAM_PREFIX)
+		if !ok {
+			continue
+		}
+		if len(name) > 256 || !zfsPropertyPattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid zfs property %q in parameter %s", name, param)
+		}
+		args = append(args, "-o", name+"="+params[param])
+	}
+	return args, nil
+}
+
+func (b *zfsBackend) createVolume(ctx context.Context, executer Executer, env map[string]string) ([]byte, error) {
+	if env[CSI_REQ_VOLUME_MODE] == VOLUME_MODE_BLOCK {
+		return nil, fmt.Errorf("zfs backend does not support block volumes")
+	}
+	volumeID := env[CSI_REQ_VOLUME_ID]
+	dataset, err := b.dataset(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	capacity, err := strconv.ParseInt(env[CSI_REQ_CAPACITY_BYTES], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid capacity %q: %w", env[CSI_REQ_CAPACITY_BYTES], err)
+	}
+	cloneMode := b.cloneMode
+	if mode := env[CSI_REQ_PARAM_PREFIX+CLONE_MODE_KEY]; mode != "" {
+		if err := checkZfsCloneMode(mode); err != nil {
+			return nil, err
+		}
+		cloneMode = mode
+	}
+
+	exists, err := b.exists(ctx, executer, dataset)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		properties, err := b.properties(capacity, env)
+		if err != nil {
+			return nil, err
+		}
+		switch env[CSI_REQ_DATA_SOURCE] {
+		case "snapshot":
+			origin, err := b.snapshot(env[CSI_REQ_SRC_SNAPSHOT_ID])
+			if err != nil {
+				return nil, err
+			}
+			if err := b.clone(ctx, executer, origin, dataset, cloneMode, properties); err != nil {
+				return nil, err
+			}
+		case "volume":
+			source, err := b.dataset(env[CSI_REQ_SRC_VOLUME_ID])
+			if err != nil {
+				return nil, err
+			}
+			if err := b.cloneVolume(ctx, executer, source, dataset, cloneMode, properties); err != nil {
+				return nil, err
+			}
+		default:
+			cmd := append(append([]string{"zfs", "create", "-p"}, properties...), dataset)
+			if _, err := runCommand(ctx, executer, shellCommand(cmd...)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	row, err := zfsListOne(ctx, executer, []string{"refquota", "mountpoint"}, dataset)
+	if err != nil {
+		return nil, err
+	}
+	output := map[string]string{
+		CSI_REP_VOLUME_ID:      volumeID,
+		CSI_REP_CAPACITY_BYTES: row[0],
+		NFS_SHARE_SERVER_KEY:   b.nfsServer,
+		NFS_SHARE_PATH_KEY:     row[1],
+		EXPORT_PATH_KEY:        row[1],
+	}
+	if env[CSI_REQ_DATA_SOURCE] != "" {
+		output[CSI_REP_DATA_SOURCE] = env[CSI_REQ_DATA_SOURCE]
+	}
+	return formatHookOutput(output), nil
+}
+
+// clone creates dataset from the origin snapshot, properties are the -o
+// arguments of the new dataset.
+func (b *zfsBackend) clone(ctx context.Context, executer Executer, origin string, dataset string, mode string, properties []string) error {
+	if mode == ZFS_CLONE_MODE_CLONE {
+		cmd := append(append([]string{"zfs", "clone"}, properties...), origin, dataset)
+		_, err := runCommand(ctx, executer, shellCommand(cmd...))
+		return err
+	}
+	recv := append(append([]string{"zfs", "recv"}, properties...), dataset)
+	if _, err := runCommand(ctx, executer, shellCommand("zfs", "send", origin)+" | "+shellCommand(recv...)); err != nil {
+		return err
+	}
+	// recv keeps the origin snapshot on the copy
+	_, err := runCommand(ctx, executer, shellCommand("zfs", "destroy", dataset+"@"+strings.SplitN(origin, "@", 2)[1]))
+	return err
+}
+
+// cloneVolume clones source through a temporary snapshot, which a zfs clone
+// depends on and is kept until the clone is deleted, and a copy does not need.
+func (b *zfsBackend) cloneVolume(ctx context.Context, executer Executer, source string, dataset string, mode string, properties []string) error {
+	origin := source + "@" + zfsCloneSnapshotPrefix + strings.TrimPrefix(dataset, b.parent+"/")
+	exists, err := b.exists(ctx, executer, origin)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if _, err := runCommand(ctx, executer, shellCommand("zfs", "snapshot", origin)); err != nil {
+			return err
+		}
+	}
+	if err := b.clone(ctx, executer, origin, dataset, mode, properties); err != nil {
+		return err
+	}
+	if mode == ZFS_CLONE_MODE_CLONE {
+		return nil
+	}
+	_, err = runCommand(ctx, executer, shellCommand("zfs", "destroy", origin))
+	return err
+}
+
+// deleteVolume destroys the dataset with its unused csi-clone snapshots, and
+// the csi-clone snapshot of the volume it was cloned from. A dataset with
+// snapshots of its own or zfs clones is kept.
+func (b *zfsBackend) deleteVolume(ctx context.Context, executer Executer, env map[string]string) ([]byte, error) {
+	volumeID := env[CSI_REQ_VOLUME_ID]
+	dataset, err := b.dataset(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := zfsList(ctx, executer, []string{"name", "clones"}, "-t", "snapshot", "-r", b.parent)
+	if err != nil {
+		return nil, err
+	}
+	var unused, dependents, origins []string
+	for _, row := range rows {
+		snapshotOf, name, _ := strings.Cut(row[0], "@")
+		cloned := row[1] != "" && row[1] != "-"
+		switch {
+		case snapshotOf == dataset && strings.HasPrefix(name, zfsCloneSnapshotPrefix) && !cloned:
+			unused = append(unused, row[0])
+		case snapshotOf == dataset:
+			dependents = append(dependents, row[0])
+		case name == zfsCloneSnapshotPrefix+volumeID:
+			origins = append(origins, row[0])
+		}
+	}
+	if len(dependents) > 0 {
+		return nil, fmt.Errorf("%w: %s has %s", errHasDependents, dataset, strings.Join(dependents, ", "))
+	}
+	for _, snapshot := range unused {
+		if _, err := runCommand(ctx, executer, shellCommand("zfs", "destroy", snapshot)); err != nil {
+			return nil, err
+		}
+	}
+	exists, err := b.exists(ctx, executer, dataset)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		if _, err := runCommand(ctx, executer, shellCommand("zfs", "destroy", dataset)); err != nil {
+			return nil, err
+		}
+	}
+	// a retry still finds the origin after the dataset is gone
+	for _, snapshot := range origins {
+		if _, err := runCommand(ctx, executer, shellCommand("zfs", "destroy", snapshot)); err != nil {
+			return nil, err
+		}
+	}
+	return formatHookOutput(map[string]string{CSI_REP_VOLUME_ID: env[CSI_REQ_VOLUME_ID]}), nil
+}
+
+func (b *zfsBackend) expandVolume(ctx context.Context, executer Executer, env map[string]string) ([]byte, error) {
+	if env[CSI_REQ_VOLUME_MODE] == VOLUME_MODE_BLOCK {
+		return nil, fmt.Errorf("zfs backend does not support block volumes")
+	}
+	dataset, err := b.dataset(env[CSI_REQ_VOLUME_ID])
+	if err != nil {
+		return nil, err
+	}
+	capacity, err := strconv.ParseInt(env[CSI_REQ_CAPACITY_BYTES], 10, 64)
+	if err != nil || capacity <= 0 {
+		return nil, fmt.Errorf("invalid capacity %q", env[CSI_REQ_CAPACITY_BYTES])
+	}
+	if _, err := runCommand(ctx, executer, shellCommand("zfs", "set", fmt.Sprintf("refquota=%d", capacity), dataset)); err != nil {
+		return nil, err
+	}
+	row, err := zfsListOne(ctx, executer, []string{"refquota"}, dataset)
+	if err != nil {
+		return nil, err
+	}
+	return formatHookOutput(map[string]string{CSI_REP_CAPACITY_BYTES: row[0]}), nil
+}
+
+func (b *zfsBackend) createSnapshot(ctx context.Context, executer Executer, env map[string]string) ([]byte, error) {
+	snapshotID := env[CSI_REQ_SRC_VOLUME_ID] + "@" + env[CSI_REQ_SNAPSHOT_NAME]
+	snapshot, err := b.snapshot(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	exists, err := b.exists(ctx, executer, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if _, err := runCommand(ctx, executer, shellCommand("zfs", "snapshot", snapshot)); err != nil {
+			return nil, err
+		}
+	}
+	row, err := zfsListOne(ctx, executer, []string{"referenced"}, "-t", "snapshot", snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return formatHookOutput(map[string]string{
+		CSI_REP_SNAPSHOT_ID:    snapshotID,
+		CSI_REP_CAPACITY_BYTES: row[0],
+	}), nil
+}
+
+func (b *zfsBackend) deleteSnapshot(ctx context.Context, executer Executer, env map[string]string) ([]byte, error) {
+	snapshot, err := b.snapshot(env[CSI_REQ_SNAPSHOT_ID])
+	if err != nil {
+		return nil, err
+	}
+	exists, err := b.exists(ctx, executer, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		if _, err := runCommand(ctx, executer, shellCommand("zfs", "destroy", snapshot)); err != nil {
+			return nil, err
+		}
+	}
+	return formatHookOutput(map[string]string{CSI_REP_SNAPSHOT_ID: env[CSI_REQ_SNAPSHOT_ID]}), nil
+}
+
+func (b *zfsBackend) listSnapshots(ctx context.Context, executer Executer, env map[string]string) ([]byte, error) {
+	root := b.parent
+	if volumeID := env[CSI_REQ_SRC_VOLUME_ID]; volumeID != "" {
+		dataset, err := b.dataset(volumeID)
+		if err != nil {
+			return nil, err
+		}
+		exists, err := b.exists(ctx, executer, dataset)
+		if err != nil || !exists {
+			return nil, err
+		}
+		root = dataset
+	}
+	rows, err := zfsList(ctx, executer, []string{"name", "referenced"}, "-t", "snapshot", "-r", root)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []*csi.Snapshot
+	for _, row := range rows {
+		name, ok := strings.CutPrefix(row[0], b.parent+"/")
+		if !ok || strings.Contains(name, "/") {
+			continue
+		}
+		volumeID, snapshotName, _ := strings.Cut(name, "@")
+		if strings.HasPrefix(snapshotName, zfsCloneSnapshotPrefix) {
+			continue
+		}
+		if id := env[CSI_REQ_SNAPSHOT_ID]; id != "" && id != name {
+			continue
+		}
+		size, err := strconv.ParseInt(row[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size of snapshot %s: %w", row[0], err)
+		}
+		snapshots = append(snapshots, &csi.Snapshot{SnapshotId: name, SourceVolumeId: volumeID, SizeBytes: size})
+	}
+	return formatSnapshotList(snapshots), nil
+}
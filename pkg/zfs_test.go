@@ -0,0 +1,244 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestZfsBackend(t *testing.T, config map[string]string) Backend {
+	t.Helper()
+	cfg := map[string]string{"parentDataset": "tank/csi/", "nfsServer": "nas"}
+	for k, v := range config {
+		cfg[k] = v
+	}
+	b, err := NewBackend(ZFS_BACKEND, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func runBackend(t *testing.T, b Backend, executer Executer, operation string, env map[string]string) map[string]string {
+	t.Helper()
+	out, err := b.Run(context.Background(), executer, operation, env)
+	if err != nil {
+		t.Fatalf("%s failed: %v", operation, err)
+	}
+	output, err := parseShellResponse(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return output
+}
+
+func TestZfsCreateVolume(t *testing.T) {
+	b := newTestZfsBackend(t, map[string]string{"sharenfs": "rw=@10.0.0.0/8"})
+	executer := (&scriptedExecuter{}).
+		on("'-o' 'name'", "cannot open 'tank/csi/pvc-1': dataset does not exist", errExit1).
+		on("'refquota,mountpoint'", "1073741824\t/tank/csi/pvc-1\n", nil)
+	output := runBackend(t, b, executer, OP_CREATE_VOLUME, map[string]string{
+		CSI_REQ_VOLUME_ID:       "pvc-1",
+		CSI_REQ_CAPACITY_BYTES:  "1073741824",
+		CSI_REQ_PARAMETERS_JSON: `{"zfs.compression":"lz4","zfs.com.example:tag":"a b","zfs_atime":"off"}`,
+	})
+	if !executer.ran("'zfs' 'create' '-p' '-o' 'refquota=1073741824' '-o' 'sharenfs=rw=@10.0.0.0/8' '-o' 'com.example:tag=a b' '-o' 'compression=lz4' 'tank/csi/pvc-1'") {
+		t.Errorf("unexpected commands %v", executer.commands)
+	}
+	if output[CSI_REP_CAPACITY_BYTES] != "1073741824" || output[NFS_SHARE_PATH_KEY] != "/tank/csi/pvc-1" || output[NFS_SHARE_SERVER_KEY] != "nas" {
+		t.Errorf("unexpected output %v", output)
+	}
+
+	// an existing dataset is reported as is
+	executer = (&scriptedExecuter{}).on("'refquota,mountpoint'", "1073741824\t/tank/csi/pvc-1\n", nil)
+	runBackend(t, b, executer, OP_CREATE_VOLUME, map[string]string{CSI_REQ_VOLUME_ID: "pvc-1", CSI_REQ_CAPACITY_BYTES: "1073741824"})
+	if executer.ran("'zfs' 'create'") {
+		t.Error("existing dataset should not be created again")
+	}
+
+	executer = (&scriptedExecuter{}).on("'-o' 'name'", "dataset does not exist", errExit1)
+	for _, params := range []string{`{"zfs.Compression":"lz4"}`, `{"zfs.compression=off -o atime":"on"}`, `{"zfs.":"on"}`} {
+		if _, err := b.Run(context.Background(), executer, OP_CREATE_VOLUME, map[string]string{
+			CSI_REQ_VOLUME_ID: "pvc-1", CSI_REQ_CAPACITY_BYTES: "1", CSI_REQ_PARAMETERS_JSON: params,
+		}); err == nil || executer.ran("'zfs' 'create'") {
+			t.Errorf("invalid property in %s should be rejected, got %v", params, err)
+		}
+	}
+	if _, err := b.Run(context.Background(), executer, OP_CREATE_VOLUME, map[string]string{
+		CSI_REQ_VOLUME_ID: "pvc-1", CSI_REQ_CAPACITY_BYTES: "1", CSI_REQ_VOLUME_MODE: VOLUME_MODE_BLOCK,
+	}); err == nil {
+		t.Error("block volumes should be rejected")
+	}
+	if _, err := b.Run(context.Background(), executer, OP_CREATE_VOLUME, map[string]string{
+		CSI_REQ_VOLUME_ID: "../pvc-1", CSI_REQ_CAPACITY_BYTES: "1",
+	}); err == nil {
+		t.Error("volume ID with a path should be rejected")
+	}
+}
+
+func TestZfsCreateVolumeFromSnapshot(t *testing.T) {
+	env := map[string]string{
+		CSI_REQ_VOLUME_ID:       "pvc-2",
+		CSI_REQ_CAPACITY_BYTES:  "1024",
+		CSI_REQ_DATA_SOURCE:     "snapshot",
+		CSI_REQ_SRC_SNAPSHOT_ID: "pvc-1@snap-1",
+	}
+	newExecuter := func() *scriptedExecuter {
+		return (&scriptedExecuter{}).
+			on("'-o' 'name' 'tank/csi/pvc-2'", "dataset does not exist", errExit1).
+			on("'refquota,mountpoint'", "1024\t/tank/csi/pvc-2\n", nil)
+	}
+
+	executer := newExecuter()
+	output := runBackend(t, newTestZfsBackend(t, nil), executer, OP_CREATE_VOLUME, env)
+	if !executer.ran("'zfs' 'send' 'tank/csi/pvc-1@snap-1' | 'zfs' 'recv' '-o' 'refquota=1024' 'tank/csi/pvc-2'") ||
+		!executer.ran("'zfs' 'destroy' 'tank/csi/pvc-2@snap-1'") {
+		t.Errorf("copy mode should send and recv the snapshot, ran %v", executer.commands)
+	}
+	if output[CSI_REP_DATA_SOURCE] != "snapshot" {
+		t.Errorf("unexpected output %v", output)
+	}
+
+	executer = newExecuter()
+	env[CSI_REQ_PARAM_PREFIX+CLONE_MODE_KEY] = ZFS_CLONE_MODE_CLONE
+	runBackend(t, newTestZfsBackend(t, nil), executer, OP_CREATE_VOLUME, env)
+	if !executer.ran("'zfs' 'clone' '-o' 'refquota=1024' 'tank/csi/pvc-1@snap-1' 'tank/csi/pvc-2'") {
+		t.Errorf("clone mode should zfs clone, ran %v", executer.commands)
+	}
+}
+
+func TestZfsCreateVolumeFromVolume(t *testing.T) {
+	executer := (&scriptedExecuter{}).
+		on("'-o' 'name'", "dataset does not exist", errExit1).
+		on("'refquota,mountpoint'", "1024\t/tank/csi/pvc-2\n", nil)
+	runBackend(t, newTestZfsBackend(t, nil), executer, OP_CREATE_VOLUME, map[string]string{
+		CSI_REQ_VOLUME_ID:      "pvc-2",
+		CSI_REQ_CAPACITY_BYTES: "1024",
+		CSI_REQ_DATA_SOURCE:    "volume",
+		CSI_REQ_SRC_VOLUME_ID:  "pvc-1",
+	})
+	for _, cmd := range []string{
+		"'zfs' 'snapshot' 'tank/csi/pvc-1@csi-clone-pvc-2'",
+		"'zfs' 'send' 'tank/csi/pvc-1@csi-clone-pvc-2' | 'zfs' 'recv'",
+		"'zfs' 'destroy' 'tank/csi/pvc-2@csi-clone-pvc-2'",
+		"'zfs' 'destroy' 'tank/csi/pvc-1@csi-clone-pvc-2'",
+	} {
+		if !executer.ran(cmd) {
+			t.Errorf("expected %s, ran %v", cmd, executer.commands)
+		}
+	}
+}
+
+func TestZfsDeleteVolume(t *testing.T) {
+	b := newTestZfsBackend(t, nil)
+	executer := &scriptedExecuter{}
+	runBackend(t, b, executer, OP_DELETE_VOLUME, map[string]string{CSI_REQ_VOLUME_ID: "pvc-1"})
+	if !executer.ran("'zfs' 'destroy' 'tank/csi/pvc-1'") {
+		t.Errorf("expected zfs destroy, ran %v", executer.commands)
+	}
+
+	executer = (&scriptedExecuter{}).on("'-o' 'name'", "dataset does not exist", errExit1)
+	runBackend(t, b, executer, OP_DELETE_VOLUME, map[string]string{CSI_REQ_VOLUME_ID: "pvc-1"})
+	if executer.ran("'zfs' 'destroy'") {
+		t.Error("deleting a missing dataset should succeed without destroy")
+	}
+}
+
+func TestZfsDeleteVolumeSnapshots(t *testing.T) {
+	b := newTestZfsBackend(t, nil)
+	// pvc-1 was cloned from pvc-0, and pvc-3 from pvc-1 with a copy that left its snapshot
+	executer := (&scriptedExecuter{}).on("'name,clones'",
+		"tank/csi/pvc-0@csi-clone-pvc-1\ttank/csi/pvc-1\n"+
+			"tank/csi/pvc-1@csi-clone-pvc-3\t-\n"+
+			"tank/csi/pvc-2@csi-clone-pvc-4\ttank/csi/pvc-4\n", nil)
+	runBackend(t, b, executer, OP_DELETE_VOLUME, map[string]string{CSI_REQ_VOLUME_ID: "pvc-1"})
+	for _, cmd := range []string{
+		"'zfs' 'destroy' 'tank/csi/pvc-1@csi-clone-pvc-3'",
+		"'zfs' 'destroy' 'tank/csi/pvc-1'",
+		"'zfs' 'destroy' 'tank/csi/pvc-0@csi-clone-pvc-1'",
+	} {
+		if !executer.ran(cmd) {
+			t.Errorf("expected %s, ran %v", cmd, executer.commands)
+		}
+	}
+	if executer.ran("'tank/csi/pvc-2@csi-clone-pvc-4'") {
+		t.Errorf("the origin of another clone should be kept, ran %v", executer.commands)
+	}
+
+	for _, snapshots := range []string{
+		"tank/csi/pvc-1@snap-1\t-\n",
+		"tank/csi/pvc-1@csi-clone-pvc-5\ttank/csi/pvc-5\n",
+	} {
+		executer = (&scriptedExecuter{}).on("'name,clones'", snapshots, nil)
+		_, err := b.Run(context.Background(), executer, OP_DELETE_VOLUME, map[string]string{CSI_REQ_VOLUME_ID: "pvc-1"})
+		if !errors.Is(err, errHasDependents) || executer.ran("'zfs' 'destroy'") {
+			t.Errorf("a volume with %q should be kept, got %v, ran %v", snapshots, err, executer.commands)
+		}
+	}
+}
+
+func TestZfsExpandVolume(t *testing.T) {
+	executer := (&scriptedExecuter{}).on("'zfs' 'list'", "2048\n", nil)
+	output := runBackend(t, newTestZfsBackend(t, nil), executer, OP_EXPAND_VOLUME, map[string]string{
+		CSI_REQ_VOLUME_ID:      "pvc-1",
+		CSI_REQ_CAPACITY_BYTES: "2048",
+	})
+	if !executer.ran("'zfs' 'set' 'refquota=2048' 'tank/csi/pvc-1'") || output[CSI_REP_CAPACITY_BYTES] != "2048" {
+		t.Errorf("unexpected output %v, ran %v", output, executer.commands)
+	}
+}
+
+func TestZfsSnapshots(t *testing.T) {
+	b := newTestZfsBackend(t, nil)
+	executer := (&scriptedExecuter{}).
+		on("'-o' 'name'", "dataset does not exist", errExit1).
+		on("'referenced'", "512\n", nil)
+	output := runBackend(t, b, executer, OP_CREATE_SNAPSHOT, map[string]string{
+		CSI_REQ_SRC_VOLUME_ID: "pvc-1",
+		CSI_REQ_SNAPSHOT_NAME: "snap-1",
+	})
+	if !executer.ran("'zfs' 'snapshot' 'tank/csi/pvc-1@snap-1'") || output[CSI_REP_SNAPSHOT_ID] != "pvc-1@snap-1" || output[CSI_REP_CAPACITY_BYTES] != "512" {
+		t.Errorf("unexpected output %v, ran %v", output, executer.commands)
+	}
+
+	executer = (&scriptedExecuter{}).on("'name,referenced'",
+		"tank/csi/pvc-1@snap-1\t512\ntank/csi/pvc-1@csi-clone-pvc-2\t512\ntank/csi/pvc-3@snap-2\t100\ntank/csi/pvc-3/child@x\t1\n", nil)
+	out, err := b.Run(context.Background(), executer, OP_LIST_SNAPSHOTS, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := parseSnapshotList(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 || snapshots[0].SnapshotId != "v1:pvc-1@snap-1" || snapshots[1].SourceVolumeId != "v1:pvc-3" || snapshots[1].SizeBytes != 100 {
+		t.Errorf("unexpected snapshots %v", snapshots)
+	}
+
+	out, err = b.Run(context.Background(), executer, OP_LIST_SNAPSHOTS, map[string]string{CSI_REQ_SNAPSHOT_ID: "pvc-3@snap-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshots, _ := parseSnapshotList(out); len(snapshots) != 1 {
+		t.Errorf("expected the requested snapshot only, got %v", snapshots)
+	}
+
+	if _, err := b.Run(context.Background(), executer, OP_DELETE_SNAPSHOT, map[string]string{CSI_REQ_SNAPSHOT_ID: "pvc-1"}); err == nil {
+		t.Error("snapshot ID without @ should be rejected")
+	}
+}
+
+func TestZfsDeleteVolumeFailedPrecondition(t *testing.T) {
+	driver := NewOfflineController(ControllerCfg{}, true)
+	driver.backend = newTestZfsBackend(t, nil)
+	driver.executer = (&scriptedExecuter{}).on("'name,clones'", "tank/csi/pvc-1@snap-1\t-\n", nil)
+	_, err := driver.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "v1:pvc-1"})
+	if status.Code(err) != codes.FailedPrecondition || !strings.Contains(err.Error(), "tank/csi/pvc-1@snap-1") {
+		t.Errorf("expected FailedPrecondition naming the snapshot, got %v", err)
+	}
+}
@@ -3,4 +3,8 @@ echo mkdir -p $target
 echo "csi-shell-output:volume_id=${CSI_VOLUME_ID}"
 echo "csi-shell-output:capacity_bytes=${CSI_CAPACITY_BYTES}"
 echo "csi-shell-output:nfs_path=/export/${CSI_VOLUME_ID}"
-echo "csi-shell-output:nfs_server=localhost"
\ No newline at end of file
+echo "csi-shell-output:nfs_server=localhost"
+if [ "${CSI_VOLUME_MODE}" = "block" ]; then
+  echo truncate -s ${CSI_CAPACITY_BYTES} $target/disk.img
+  echo "csi-shell-output:block_image=disk.img"
+fi
@@ -0,0 +1,2 @@
+echo "csi-shell-output:snapshot=snapshot_id=snapshot-1 source_volume_id=test-volume capacity_bytes=1"
+echo "csi-shell-output:snapshot=snapshot_id=snapshot-2 source_volume_id=other-volume capacity_bytes=2"